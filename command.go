@@ -9,6 +9,8 @@ import (
 const (
 	profile = `(.+@.+:\d+)`
 	integer = `(\d+)`
+	word    = `(\S+)` // such as a handle or single word name
+	name    = `(.+)`  // handle or name which may contain spaces
 	rest    = `(.*)`
 	spaces  = `\s+`
 )
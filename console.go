@@ -6,15 +6,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // Console abstracts the line-by-line reading of text, using an optional prompt.
+//
+// Lines are only read from the reader when asked for by Read(), so that
+// while a line is being processed the reader may be used directly, such
+// as by ReadPassword().
 type Console struct {
 	Format     func() string
 	prompt     string
 	showPrompt bool
 	reader     io.Reader
 	lines      chan string
+	requests   chan struct{} // asks the read loop for a line
+	mu         sync.Mutex    // guards waiting and sends on lines
+	waiting    bool          // a line has been requested but not yet scanned
 	scan       *bufio.Scanner
 }
 
@@ -23,7 +34,8 @@ func NewConsole(r io.Reader) *Console {
 	c := &Console{
 		showPrompt: true,
 		reader:     r,
-		lines:      make(chan string),
+		lines:      make(chan string, 1),
+		requests:   make(chan struct{}, 1),
 		scan:       bufio.NewScanner(r),
 	}
 	return c
@@ -36,15 +48,20 @@ func (c *Console) Run(ctx context.Context) {
 	go func() {
 		// this gofunc never exits "correctly" since i can't figure
 		// out how to "unblock" ReadString()
-		for {
+		for range c.requests {
 			c.scan.Scan()
 			line := c.scan.Text()
 			err := c.scan.Err()
+
 			// line, err := c.scan.ReadString('\n')
 			// line = strings.TrimSuffix(line, "\n") // trim trailing newline
+			c.mu.Lock()
 			if err == nil { //&& len(line) > 0 {
-				c.lines <- line
+				c.lines <- line // never blocks; at most 1 line is requested
 			}
+			c.waiting = false
+			c.mu.Unlock()
+
 			if err != nil {
 				log.Println(err)
 			}
@@ -62,9 +79,51 @@ func (c *Console) Read() chan string {
 	if c.showPrompt && c.Format != nil {
 		fmt.Print(c.Format())
 	}
+
+	c.mu.Lock()
+	if !c.waiting && len(c.lines) == 0 {
+		c.waiting = true
+		c.requests <- struct{}{}
+	}
+	c.mu.Unlock()
+
 	return c.lines
 }
 
+// ReadPassword prints prompt and reads a line without echoing it, if the
+// Console is reading from a terminal. It must not be called while a line
+// requested by Read() is outstanding.
+func (c *Console) ReadPassword(prompt string) ([]byte, error) {
+	fmt.Print(prompt)
+
+	if f, ok := c.reader.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		defer fmt.Println()
+		return terminal.ReadPassword(int(f.Fd()))
+	}
+
+	if !c.scan.Scan() {
+		if c.scan.Err() != nil {
+			return nil, c.scan.Err()
+		}
+		return nil, io.EOF
+	}
+	return []byte(c.scan.Text()), nil
+}
+
+// ReadLine prints prompt and reads a line directly. Like ReadPassword(), it
+// must not be called while a line requested by Read() is outstanding.
+func (c *Console) ReadLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+
+	if !c.scan.Scan() {
+		if c.scan.Err() != nil {
+			return "", c.scan.Err()
+		}
+		return "", io.EOF
+	}
+	return c.scan.Text(), nil
+}
+
 // SetPrompt sets the prompt according to Format where s is the "%s" term in Format.
 // If Format is an empty string, the prompt is set to s.
 // func (c *Console) SetPrompt(s string) {
@@ -10,13 +10,61 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math/big"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
 /*
 
+AEAD
+
+*/
+
+// AEADSeal encrypts and authenticates plaintext and authenticates (but does
+// not encrypt) additionalData using XChaCha20-Poly1305. Key must be 32 bytes.
+// The random nonce is prepended to the returned ciphertext.
+func AEADSeal(plaintext, key, additionalData []byte) (ciphertext []byte, err error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+
+	ciphertext = aead.Seal(nonce, nonce, plaintext, additionalData)
+	return
+}
+
+// AEADOpen decrypts and authenticates ciphertext created by AEADSeal. Any
+// modification of ciphertext or additionalData results in an error.
+func AEADOpen(ciphertext, key, additionalData []byte) (plaintext []byte, err error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return
+	}
+
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		err = fmt.Errorf("ciphertext too short")
+		return
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	ciphertext = ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+/*
+
 AES
 
 */
@@ -117,6 +165,35 @@ func ValidSignatureHS512(signature, message, key []byte) bool {
 	return hmac.Equal(signature, expectedMAC)
 }
 
+// RouteTag derives a short tag used to route Messages to a Session without
+// trial decryption. It is derived from the shared key and session ID so it
+// is only meaningful to the two parties of a session.
+func RouteTag(sharedKey []byte, sessionID uint64) []byte {
+	const size = 8
+	id := make([]byte, 8)
+	binary.LittleEndian.PutUint64(id, sessionID)
+	return SignHS256(append([]byte("chat route tag"), id...), sharedKey)[:size]
+}
+
+// DeriveKey expands secret into n bytes of key material using HKDF-SHA256.
+// Salt may be nil. Info distinguishes keys derived for different purposes
+// from the same secret.
+func DeriveKey(secret, salt []byte, info string, n int) ([]byte, error) {
+	key := make([]byte, n)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// wipe overwrites b with zeros so that key material does not linger in memory.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 /*
 
 RSA
@@ -210,6 +287,63 @@ func EDHSharedKey(myPrivKey, theirPubKey []byte) ([]byte, error) {
 	return curve25519.X25519(myPrivKey, theirPubKey)
 }
 
+// Ed25519PrivateKeyToCurve25519 converts an Ed25519 signing key into the
+// X25519 private key with the matching public key, so that a single identity
+// key may be used for both signing and Diffie-Hellman.
+func Ed25519PrivateKeyToCurve25519(privateKey ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(privateKey.Seed())
+	key := h[:32]
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	return key
+}
+
+// curve25519P is the field prime 2^255 - 19.
+var curve25519P, _ = new(big.Int).SetString(
+	"7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// Ed25519PublicKeyToCurve25519 converts an Ed25519 public key into the X25519
+// public key of the same identity, using the birational map from the Edwards
+// curve to the Montgomery curve: u = (1 + y) / (1 - y).
+func Ed25519PublicKeyToCurve25519(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad public key length %d", len(publicKey))
+	}
+
+	// y is little endian with the sign of x in the top bit
+	le := make([]byte, 32)
+	copy(le, publicKey)
+	le[31] &= 127
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	b := u.Bytes()
+	out := make([]byte, 32)
+	copy(out[32-len(b):], b)
+	return reverse(out), nil
+}
+
+// reverse the order of bytes in b, in place, returning b.
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
 // Ed25519KeyPair creates a new keypair for signing.
 func Ed25519KeyPair() (private ed25519.PrivateKey, public ed25519.PublicKey, err error) {
 	// public is 32 byte []byte
@@ -223,7 +357,8 @@ func SignEd25519(senderKey ed25519.PrivateKey, message []byte) (signature []byte
 	return ed25519.Sign(senderKey, message)
 }
 
-// ValidSignatureEd25519 wraps ed25519.Verify().
+// ValidSignatureEd25519 wraps ed25519.Verify(). A key of the wrong size is
+// never valid, where ed25519.Verify() would panic.
 func ValidSignatureEd25519(signature, message []byte, senderKey ed25519.PublicKey) bool {
-	return ed25519.Verify(senderKey, message, signature)
+	return len(senderKey) == ed25519.PublicKeySize && ed25519.Verify(senderKey, message, signature)
 }
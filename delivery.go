@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DeliveryState is the delivery status of an outbound Text.
+type DeliveryState string
+
+const (
+	// Queued indicates the Text is waiting for room in the in-flight window.
+	Queued DeliveryState = "queued"
+	// Sent indicates the Text was sent but not yet acknowledged.
+	Sent DeliveryState = "sent"
+	// Acked indicates the other client acknowledged receipt of the Text.
+	Acked DeliveryState = "acked"
+	// Failed indicates the Text was never acknowledged despite retransmission.
+	Failed DeliveryState = "failed"
+)
+
+// Delivery tuning parameters.
+const (
+	MaxInFlight          = 16                     // max unacknowledged Texts per Session
+	MaxSendAttempts      = 6                      // attempts before a Text is Failed
+	RetransmitTimeout    = 500 * time.Millisecond // wait before first retransmission
+	MaxRetransmitTimeout = 8 * time.Second        // backoff ceiling
+)
+
+// delivery tracks retransmission of a single in-flight Text.
+type delivery struct {
+	text     *Text
+	m        *Message // the sealed Text, sent on every attempt
+	attempts int
+	timeout  time.Duration // current backoff
+	next     time.Time     // time of next retransmission
+}
+
+// outgoing is a Message built while holding the session lock, which is sent
+// by flush() once the lock is released.
+type outgoing struct {
+	m    *Message
+	addr string
+	seq  uint64 // of the Text
+}
+
+// transmit packages the delivery's Text to be sent by flush(), and schedules
+// the next retransmission with exponential backoff. A failure to send is not
+// fatal; it is treated like a lost datagram and retried later. The Text is
+// sealed once, so that lost copies do not leave skipped message keys with
+// the receiver, which recognizes retransmissions by their used key. The
+// caller must hold the session lock, as for the other unexported functions
+// here except flush().
+func (s *Session) transmit(d *delivery) {
+	d.attempts++
+	if d.timeout == 0 {
+		d.timeout = RetransmitTimeout
+	} else if d.timeout *= 2; d.timeout > MaxRetransmitTimeout {
+		d.timeout = MaxRetransmitTimeout
+	}
+	d.next = time.Now().Add(d.timeout)
+	d.text.state = Sent
+
+	if d.m == nil {
+		header, messageKey, err := s.ratchet.Encrypt()
+		if err == nil {
+			d.m, err = PackageText(d.text, messageKey, header, s.route)
+			wipe(messageKey)
+		}
+		if err != nil {
+			log.Printf("sending message %d for session %d: %s\n", d.text.Seq, s.ID, err)
+			return
+		}
+	}
+	s.unsent = append(s.unsent, outgoing{d.m, s.sendAddress(), d.text.Seq})
+}
+
+// flush sends the Messages packaged by transmit(). It must be called without
+// holding the session lock, so that a slow Transport, such as one dialing a
+// TCP connection, does not hold up others using the session.
+func (s *Session) flush() {
+	s.mu.Lock()
+	unsent := s.unsent
+	s.unsent = nil
+	s.mu.Unlock()
+
+	for _, o := range unsent {
+		if err := Send(s.transport, o.addr, o.m); err != nil {
+			log.Printf("sending message %d for session %d: %s\n", o.seq, s.ID, err)
+		}
+	}
+}
+
+// fillWindow transmits queued Texts while there is room in the in-flight window.
+func (s *Session) fillWindow() {
+	for len(s.queued) > 0 && len(s.inflight) < MaxInFlight {
+		t := s.queued[0]
+		s.queued = s.queued[1:]
+
+		d := &delivery{text: t}
+		s.inflight[t.Seq] = d
+		s.transmit(d)
+	}
+}
+
+// Acknowledge marks the in-flight Text with the sequence number as Acked.
+// Unknown sequence numbers (eg duplicate Acks) are ignored.
+func (s *Session) Acknowledge(seq uint64) {
+	defer s.flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.inflight[seq]
+	if !ok {
+		return
+	}
+
+	d.text.state = Acked
+	delete(s.inflight, seq)
+	s.fillWindow()
+}
+
+// Retransmit resends in-flight Texts whose acknowledgement is overdue. Texts
+// that have run out of attempts are marked Failed and returned.
+func (s *Session) Retransmit(now time.Time) (failed []*Text) {
+	defer s.flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for seq, d := range s.inflight {
+		if now.Before(d.next) {
+			continue
+		}
+
+		if d.attempts >= MaxSendAttempts {
+			d.text.state = Failed
+			delete(s.inflight, seq)
+			failed = append(failed, d.text)
+			continue
+		}
+		s.transmit(d)
+	}
+
+	s.fillWindow()
+	return
+}
+
+// SendAck acknowledges receipt of the Text with the sequence number.
+func (s *Session) SendAck(seq uint64) error {
+	s.mu.Lock()
+	m, err := PackageAck(&Ack{Seq: seq}, s.sendControlKey, s.route)
+	addr := s.sendAddress()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return Send(s.transport, addr, m)
+}
+
+// Retransmitter runs a loop which periodically retransmits unacknowledged
+// Texts for all Active sessions. Failed Texts to contacts are kept in the
+// outbox. see QueueText()
+func (eng *ChatEngine) Retransmitter(ctx context.Context) {
+	const interval = 100 * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case now := <-ticker.C:
+			for _, s := range eng.Sessions() {
+				if !s.IsActive() {
+					continue
+				}
+
+				for _, t := range s.Retransmit(now) {
+					if h, ok := eng.requeue(s, t); ok {
+						eng.emit(SendFailed, s.Handle(), t, "message %d to %s was not delivered. kept in outbox as %s", t.Seq, s.Peer(), h)
+						continue
+					}
+					eng.emit(SendFailed, s.Handle(), t, "message %d to %s was not delivered", t.Seq, s.Peer())
+				}
+			}
+		}
+	}
+
+	log.Println("exiting retransmitter")
+}
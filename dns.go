@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// This file implements the parts of the DNS message format (RFC 1035) used
+// by multicast DNS: questions, and PTR, SRV, TXT, A and AAAA records. Names
+// are written uncompressed, but compressed names are read.
+
+// DNS record types and classes.
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypePTR  uint16 = 12
+	dnsTypeTXT  uint16 = 16
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV  uint16 = 33
+	dnsTypeANY  uint16 = 255
+	dnsClassIN  uint16 = 1
+	dnsClassANY uint16 = 255
+
+	dnsFlagQR       uint16 = 0x8000 // message is a response
+	dnsFlagResponse uint16 = 0x8400 // response, authoritative answer
+	dnsClassMask    uint16 = 0x7FFF // without the mDNS unicast/cache flush bit
+	dnsHeaderSize          = 12
+	dnsMaxPointers         = 16 // max compression pointers followed in a name
+)
+
+// dnsMessage is a DNS query or response. Authority records are ignored.
+type dnsMessage struct {
+	ID          uint16
+	Flags       uint16
+	Questions   []dnsQuestion
+	Answers     []dnsRecord
+	Additionals []dnsRecord
+}
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// dnsRecord is a resource record. Only the fields of its Type are used.
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Class  uint16
+	TTL    uint32
+	Target string   // PTR, SRV
+	Port   uint16   // SRV
+	Text   []string // TXT
+	IP     net.IP   // A, AAAA
+}
+
+// Records gets the answer and additional records.
+func (m *dnsMessage) Records() []dnsRecord {
+	return append(append([]dnsRecord(nil), m.Answers...), m.Additionals...)
+}
+
+// pack encodes the message.
+func (m *dnsMessage) pack() ([]byte, error) {
+	b := make([]byte, dnsHeaderSize, 512)
+	binary.BigEndian.PutUint16(b[0:2], m.ID)
+	binary.BigEndian.PutUint16(b[2:4], m.Flags)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(m.Additionals)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+	for _, r := range m.Records() {
+		if b, err = r.pack(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// pack appends the record to b.
+func (r *dnsRecord) pack(b []byte) ([]byte, error) {
+	var data []byte
+	var err error
+	switch r.Type {
+	case dnsTypePTR:
+		data, err = appendName(nil, r.Target)
+	case dnsTypeSRV:
+		data = make([]byte, 6) // priority and weight are 0
+		binary.BigEndian.PutUint16(data[4:6], r.Port)
+		data, err = appendName(data, r.Target)
+	case dnsTypeTXT:
+		for _, s := range r.Text {
+			if len(s) > 255 {
+				return nil, fmt.Errorf("TXT string too long")
+			}
+			data = append(append(data, byte(len(s))), s...)
+		}
+	case dnsTypeA:
+		data = r.IP.To4()
+	case dnsTypeAAAA:
+		data = r.IP.To16()
+	default:
+		return nil, fmt.Errorf("unsupported record type %d", r.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = appendName(b, r.Name); err != nil {
+		return nil, err
+	}
+	b = appendUint16(b, r.Type)
+	b = appendUint16(b, r.Class)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], r.TTL)
+	b = appendUint16(b, uint16(len(data)))
+	return append(b, data...), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendName appends a dot separated name to b. Labels may not contain dots.
+func appendName(b []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0), nil
+}
+
+// parseDNS decodes a DNS message.
+func parseDNS(b []byte) (*dnsMessage, error) {
+	if len(b) < dnsHeaderSize {
+		return nil, fmt.Errorf("short DNS message")
+	}
+	m := &dnsMessage{
+		ID:    binary.BigEndian.Uint16(b[0:2]),
+		Flags: binary.BigEndian.Uint16(b[2:4]),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:6]))
+	an := int(binary.BigEndian.Uint16(b[6:8]))
+	ns := int(binary.BigEndian.Uint16(b[8:10]))
+	ar := int(binary.BigEndian.Uint16(b[10:12]))
+
+	off := dnsHeaderSize
+	for i := 0; i < qd; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+4 > len(b) {
+			return nil, fmt.Errorf("short DNS question")
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[off : off+2]),
+			Class: binary.BigEndian.Uint16(b[off+2 : off+4]),
+		})
+		off += 4
+	}
+
+	for i := 0; i < an+ns+ar; i++ {
+		r, n, err := readRecord(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		switch {
+		case i < an:
+			m.Answers = append(m.Answers, r)
+		case i >= an+ns:
+			m.Additionals = append(m.Additionals, r)
+		}
+	}
+	return m, nil
+}
+
+// readRecord reads the resource record at off, returning the offset after it.
+func readRecord(b []byte, off int) (r dnsRecord, next int, err error) {
+	r.Name, off, err = readName(b, off)
+	if err != nil {
+		return
+	}
+	if off+10 > len(b) {
+		return r, 0, fmt.Errorf("short DNS record")
+	}
+	r.Type = binary.BigEndian.Uint16(b[off : off+2])
+	r.Class = binary.BigEndian.Uint16(b[off+2 : off+4])
+	r.TTL = binary.BigEndian.Uint32(b[off+4 : off+8])
+	n := int(binary.BigEndian.Uint16(b[off+8 : off+10]))
+	off += 10
+	if off+n > len(b) {
+		return r, 0, fmt.Errorf("short DNS record")
+	}
+	data := b[off : off+n]
+	next = off + n
+
+	switch r.Type {
+	case dnsTypePTR:
+		r.Target, _, err = readName(b, off)
+	case dnsTypeSRV:
+		if n < 7 {
+			return r, 0, fmt.Errorf("short SRV record")
+		}
+		r.Port = binary.BigEndian.Uint16(data[4:6])
+		r.Target, _, err = readName(b, off+6)
+	case dnsTypeTXT:
+		for len(data) > 0 {
+			l := int(data[0])
+			if 1+l > len(data) {
+				return r, 0, fmt.Errorf("short TXT record")
+			}
+			r.Text = append(r.Text, string(data[1:1+l]))
+			data = data[1+l:]
+		}
+	case dnsTypeA, dnsTypeAAAA:
+		if n == net.IPv4len || n == net.IPv6len {
+			r.IP = append(net.IP(nil), data...)
+		}
+	}
+	return
+}
+
+// readName reads the possibly compressed name at off, returning the offset
+// after it.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1 // offset after the name, once a pointer is followed
+	for pointers := 0; ; {
+		if off >= len(b) {
+			return "", 0, fmt.Errorf("short DNS name")
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+
+		case l&0xC0 == 0xC0:
+			if off+2 > len(b) {
+				return "", 0, fmt.Errorf("short DNS name")
+			}
+			if pointers++; pointers > dnsMaxPointers {
+				return "", 0, fmt.Errorf("DNS name has too many pointers")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:off+2]) & 0x3FFF)
+
+		case l <= 63:
+			if off+1+l > len(b) {
+				return "", 0, fmt.Errorf("short DNS name")
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+
+		default:
+			return "", 0, fmt.Errorf("invalid DNS label")
+		}
+	}
+}
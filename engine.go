@@ -4,27 +4,74 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // ChatEngine incorporates all the nitty gritty of dealing with other chat clients.
 // It also simplifys managment of various state by the User Interface and
 // provides a mechanism for incoming events to be communicated to the User Interface.
+//
+// The engine is safe for concurrent use. Its state is only accessed through
+// methods, which synchronize with the network goroutines started by Start().
 type ChatEngine struct {
-	Me          *Profile           // profile in use by this client
-	PrivSignKey ed25519.PrivateKey // 64 byte private key for signing
-	Contacts    []*Profile         // a list of known profiles
-	Sessions    []*Session         // chat sessions of all status
-	Requests    []*Request         // requests needing approval
-	Events      chan EngineEvent   // incoming events to signal the UI that something needs done
-	queue       chan *Message      // queue of messages between Listener() and MessageProcessor()
+	PrivSignKey   ed25519.PrivateKey       // 64 byte private key for signing
+	KeyPolicy     KeyChangePolicy          // what to do when a contact's key changes
+	Noise         bool                     // begin sessions with a Noise handshake instead of a Request
+	Roaming       bool                     // follow peers whose address changes. see Session.Roam()
+	ContactsFile  string                   // where contacts are saved, if set
+	OutboxFile    string                   // where pending messages are saved, if set. see QueueText()
+	LettersFile   string                   // where Letters received are saved, if set. see SaveLetters()
+	Rendezvous    string                   // address of a rendezvous server to register with, if set
+	Relay         string                   // address of a relay server holding Letters, if set. see Collector()
+	STUNServers   []string                 // STUN servers which discover the mapped address. see MappedAddress()
+	PortMap       bool                     // map the listening port on the NAT gateway. see Mapper()
+	Gateway       PortMapper               // maps the port. found by DiscoverPortMapper() if nil
+	Advertise     bool                     // advertise Me on the local network with multicast DNS. see Advertiser()
+	Events        chan EngineEvent         // incoming events to signal the UI that something needs done
+	queue         chan *Message            // queue of messages between Listener() and MessageProcessor()
+	transport     Transport                // network used to send and receive Messages
+	mu            sync.RWMutex             // guards the fields below
+	me            *Profile                 // profile in use by this client
+	contacts      []*Contact               // a list of known profiles
+	sessions      []*Session               // chat sessions of all status
+	requests      []*Request               // requests needing approval
+	peers         []*Peer                  // clients found on the local network. see Discover()
+	outbox        []*OutboxEntry           // messages waiting for delivery to contacts
+	routes        map[string]*Session      // Active sessions keyed by routing tag
+	handshakes    map[string]*noiseSession // handshakes begun by other clients. see handshakeKey()
+	introductions map[string]time.Time     // when introductions asked for by fingerprint expire
+	bindings      map[stunTxID]chan string // STUN Binding requests awaiting a response
+	letters       map[string]time.Time     // when Letters received, by signature, become too old to replay
+	rendezvous    *net.UDPAddr             // Rendezvous, once resolved by the Registrar
+	handles       uint64                   // last number used in a Handle
+	cookieSecret  []byte                   // keys handshake cookies. see handshakeCookie()
+}
+
+// Handle is a short identifier for a contact, session or request, such as
+// "c3" or "s12". Handles remain valid until the item is removed and are not
+// reused while the engine runs.
+type Handle string
+
+// Contact is a known Profile in the engine's contact list.
+type Contact struct {
+	*Profile
+	Verified bool `json:",omitempty"` // user confirmed the key out of band
+	handle   Handle
 }
 
+// Handle gets the contact's handle.
+func (c *Contact) Handle() Handle { return c.handle }
+
 // EngineEvent communicates engine events to the User Interface.
 type EngineEvent struct {
 	Data    interface{} // pointer Request, Response, Profile, Session associated with event
-	Index   int         // index of Data in an associated slice, if applicable
+	ID      Handle      // handle of the Request or Session associated with event, if applicable
 	Type    EventType   // General event type. Specifics determined by Type and type of Data.
 	Message string      // text with details?
 }
@@ -34,91 +81,242 @@ type EventType int
 
 // EventTypes
 const (
-	Error EventType = iota
-	Add
-	Remove
-	Change
+	Error           EventType = iota // generic error. see Message
+	RequestReceived                  // Data is *Request, ID is its handle
+	SessionUpgraded                  // Data is *Session, ID is its handle
+	TextReceived                     // Data is *Text, ID is its session's handle
+	SessionExpired                   // Data is *Session, ID is its handle
+	SessionClosed                    // Data is *Session, ID is its handle
+	SendFailed                       // Data is *Text (if applicable), ID is its session's handle
+	DecodeError                      // Data is *Message (if decoded), ID is empty
+	KeyChanged                       // Data is *Request, *Response or *Handshake, ID is the request's or session's handle, if any
+	ProfileUpdated                   // Data is the new *Profile, ID is the contact's handle
+	PeerMoved                        // Data is *Session, ID is its handle
+	LetterReceived                   // Data is *Letter, ID is the sender's contact handle, if any
 )
 
-// NewChatEngine initializes a new chat engine.
-func NewChatEngine(privateKey ed25519.PrivateKey, me *Profile, contacts []*Profile) (*ChatEngine, error) {
-	const defaultListeningPort = "5190" // old AIM port
+var eventTypeNames = [...]string{"error", "request received", "session upgraded",
+	"text received", "session expired", "session closed", "send failed", "decode error", "key changed", "profile updated", "peer moved", "letter received"}
+
+// String name of the event type.
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypeNames) {
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+	return eventTypeNames[t]
+}
+
+// DefaultPort is the port used when no profile is available.
+const DefaultPort = "5190" // old AIM port
+
+// NewChatEngine initializes a new chat engine which communicates using transport.
+// If privateKey is empty, a new identity is generated for me. Otherwise it
+// must be the private key of me's PublicSigningKey.
+func NewChatEngine(transport Transport, privateKey ed25519.PrivateKey, me *Profile, contacts []*Contact) (*ChatEngine, error) {
+	if transport == nil {
+		return nil, fmt.Errorf("nil Transport")
+	}
 	if me == nil {
-		ip, err := GetIP()
-		if err != nil {
-			return nil, fmt.Errorf("no address given and unable to connect to IP service")
+		// the mapped address is only known once the engine runs. see Endpoints()
+		ips, err := LocalAddresses()
+		if err != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("no address given and no network interface found")
 		}
 		me = &Profile{
 			Name:    "unknown",
-			Address: ip,
-			Port:    defaultListeningPort,
+			Address: ips[0],
+			Port:    DefaultPort,
 		}
 	}
-	if contacts == nil {
-		contacts = make([]*Profile, 0)
-	}
-	if len(privateKey) != ed25519.PrivateKeySize || !bytes.Equal(privateKey[32:], me.PublicSigningKey) {
-		// TODO: check that privateKey's public key is the same as public key in Profile,
-		// that it's the correct size, etc.
+	switch {
+	case len(privateKey) == 0:
 		var err error
 		privateKey, me.PublicSigningKey, err = Ed25519KeyPair()
 		if err != nil {
 			return nil, err
 		}
+	case len(privateKey) != ed25519.PrivateKeySize:
+		return nil, fmt.Errorf("invalid private key")
+	case len(me.PublicSigningKey) == 0:
+		me.PublicSigningKey = privateKey.Public().(ed25519.PublicKey)
+	case !bytes.Equal(privateKey.Public().(ed25519.PublicKey), me.PublicSigningKey):
+		return nil, fmt.Errorf("private key doesn't match the profile's public key")
+	}
+	if me.Verify() != nil {
+		me.Seq++
+		if err := me.Sign(privateKey); err != nil {
+			return nil, err
+		}
+	}
+	cookieSecret := make([]byte, 32)
+	if _, err := rand.Read(cookieSecret); err != nil {
+		return nil, err
+	}
+
+	eng := &ChatEngine{
+		PrivSignKey:   privateKey,
+		KeyPolicy:     QuarantineKeyChange,
+		Roaming:       true,
+		Events:        make(chan EngineEvent, 16),
+		queue:         make(chan *Message, 16),
+		transport:     transport,
+		me:            me,
+		contacts:      make([]*Contact, 0),
+		sessions:      make([]*Session, 0),
+		requests:      make([]*Request, 0),
+		routes:        make(map[string]*Session),
+		handshakes:    make(map[string]*noiseSession),
+		introductions: make(map[string]time.Time),
+		bindings:      make(map[stunTxID]chan string),
+		letters:       make(map[string]time.Time),
+		cookieSecret:  cookieSecret,
+	}
+	for _, c := range contacts {
+		if c != nil && c.Profile != nil {
+			c.handle = eng.nextHandle("c")
+			eng.contacts = append(eng.contacts, c)
+		}
+	}
+	return eng, nil
+}
+
+// Start kicks off sub processes of the engine. They stop when ctx is done,
+// and the returned WaitGroup waits for them to finish, which includes
+// releasing any port mapping.
+func (eng *ChatEngine) Start(ctx context.Context) *sync.WaitGroup {
+	wg := new(sync.WaitGroup)
+	run := func(process func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			process(ctx)
+		}()
 	}
 
-	return &ChatEngine{
-		Me:          me,
-		PrivSignKey: privateKey,
-		Contacts:    contacts,
-		Sessions:    make([]*Session, 0),
-		Requests:    make([]*Request, 0),
-		Events:      make(chan EngineEvent, 16),
-		queue:       make(chan *Message, 16),
-	}, nil
+	run(eng.Listener)
+	run(eng.MessageProcessor)
+	run(eng.Retransmitter)
+	run(eng.Reaper)
+	run(eng.Courier)
+	if eng.Rendezvous != "" {
+		run(eng.Registrar)
+	}
+	if eng.PortMap {
+		run(eng.Mapper)
+	}
+	if eng.Advertise {
+		run(eng.Advertiser)
+	}
+	if eng.Relay != "" {
+		run(eng.Collector)
+	}
+	return wg
 }
 
-// Start kicks off sub processes of the engine.
-func (eng *ChatEngine) Start(ctx context.Context) {
-	go eng.Listener(ctx)
-	go eng.MessageProcessor(ctx)
+// emit sends an event to the UI. If the UI is not keeping up and the Events
+// buffer is full, the event is dropped rather than stalling the engine.
+func (eng *ChatEngine) emit(t EventType, id Handle, data interface{}, format string, a ...interface{}) {
+	ev := EngineEvent{
+		Data:    data,
+		ID:      id,
+		Type:    t,
+		Message: fmt.Sprintf(format, a...),
+	}
+
+	select {
+	case eng.Events <- ev:
+	default:
+		log.Printf("dropped event: %s: %s\n", ev.Type, ev.Message)
+	}
 }
 
 // AcceptRequest performs the routine work in responding positively (accepting)
 // to a Request to chat. It manages Session state and sends an affirmative
 // Response to the other client.
 func (eng *ChatEngine) AcceptRequest(request *Request) error {
+	if request.Quarantined() {
+		return fmt.Errorf("key of %s changed. trust the request before accepting", request.Profile)
+	}
+
 	// after accepting a request.
 	// 1. begin new (active) session
 	// 2. send response
 	// 3. add session to manager
 
-	sess, resp, err := BeginSession(eng.Me, request)
-	if err != nil {
-		return err
+	var sess *Session
+	var err error
+	if request.noise != nil {
+		var accept *Handshake
+		sess, accept, err = BeginNoiseSession(eng.Me(), request)
+		if err != nil {
+			return err
+		}
+		eng.replyAddress(sess, request)
+		err = sess.SendHandshake(accept)
+	} else {
+		var resp *Response
+		sess, resp, err = BeginSession(eng.Me(), request)
+		if err != nil {
+			return err
+		}
+		eng.replyAddress(sess, request)
+		err = sess.SendResponse(resp, eng.PrivSignKey)
 	}
-
-	err = sess.SendResponse(resp, eng.PrivSignKey)
 	if err != nil {
 		return err
 	}
 
 	// remove request from waiting list
-	eng.RemoveRequest(eng.FindRequest(request))
+	eng.mu.Lock()
+	if r, ok := eng.findRequest(request); ok {
+		eng.removeRequest(r.handle)
+	}
+	eng.mu.Unlock()
 
 	// TODO: ?? add/modify contact list with new/updated Profile?
 	eng.AddSession(sess)
-	log.Printf("began session with %s\n", sess.Other)
+	log.Printf("began session with %s\n", sess.Peer())
+	eng.deliverPending(sess)
 	return nil
 }
 
+// replyAddress prepares a session begun from request to send to the address
+// the request came from. When the other client is behind NAT, such as after
+// an introduction by a rendezvous server, this differs from the address in
+// its Profile.
+func (eng *ChatEngine) replyAddress(sess *Session, request *Request) {
+	sess.transport = eng.transport
+	if eng.Roaming && request.addr != "" && request.addr != request.Profile.FullAddress() {
+		sess.addr = request.addr
+	}
+}
+
 // SendRequest performs the routine work in asking another client to chat.
 // This includes Session managmenent and sending a Request to ther other client.
 func (eng *ChatEngine) SendRequest(to *Profile) error {
-	sess, req, err := InitiateSession(eng.Me, to)
+	if eng.Noise {
+		sess, h, err := InitiateNoiseSession(eng.Me(), to, eng.PrivSignKey)
+		if err != nil {
+			return err
+		}
+		sess.transport = eng.transport
+
+		// added first, since the reply may be a NoiseCookie which comes
+		// back at once
+		eng.AddSession(sess)
+		err = sess.SendHandshake(h)
+		if err != nil {
+			eng.RemoveSession(sess.Handle())
+			return err
+		}
+		return nil
+	}
+
+	sess, req, err := InitiateSession(eng.Me(), to)
 	if err != nil {
 		return err
 	}
+	sess.transport = eng.transport
 
 	err = sess.SendRequest(req, eng.PrivSignKey)
 	if err != nil {
@@ -129,188 +327,453 @@ func (eng *ChatEngine) SendRequest(to *Profile) error {
 	return nil
 }
 
+// Me gets the profile in use by this client.
+func (eng *ChatEngine) Me() *Profile {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+	return eng.me
+}
+
+// listenPort gets the port the transport listens on. Me's Port may be
+// another, such as the external port of a mapping. see Mapper()
+func (eng *ChatEngine) listenPort() (int, error) {
+	_, port, err := net.SplitHostPort(eng.transport.Addr())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
+
+// SetMe replaces the profile in use by this client. The profile must have
+// the same PublicSigningKey as the engine's private key. It is given the
+// next Seq, signed, and sent to the other clients of Active sessions.
+func (eng *ChatEngine) SetMe(p *Profile) error {
+	if p == nil || !bytes.Equal(eng.PrivSignKey.Public().(ed25519.PublicKey), p.PublicSigningKey) {
+		return fmt.Errorf("profile does not match private key")
+	}
+
+	eng.mu.Lock()
+	p.Seq = eng.me.Seq + 1
+	if err := p.Sign(eng.PrivSignKey); err != nil {
+		eng.mu.Unlock()
+		return err
+	}
+	eng.me = p
+	eng.mu.Unlock()
+
+	for _, s := range eng.Sessions() {
+		if err := s.SendProfile(p); err != nil {
+			log.Printf("sending profile to %s: %s\n", s.Peer(), err)
+		}
+	}
+	return nil
+}
+
 //
 // Get, Find, Add, Remove series of functions for
-// Contacts, Sessions, and Requests.
+// Contacts, Sessions, and Requests. The exported functions
+// lock the engine; the unexported ones expect the caller to.
+//
+
+// nextHandle makes a new Handle with the prefix. Caller must hold the lock.
+func (eng *ChatEngine) nextHandle(prefix string) Handle {
+	eng.handles++
+	return Handle(prefix + strconv.FormatUint(eng.handles, 10))
+}
+
 //
+// List
+//
+
+// Contacts gets a copy of the contact list.
+func (eng *ChatEngine) Contacts() []*Contact {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+	return append([]*Contact(nil), eng.contacts...)
+}
+
+// Sessions gets a copy of the session list.
+func (eng *ChatEngine) Sessions() []*Session {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+	return append([]*Session(nil), eng.sessions...)
+}
+
+// Requests gets a copy of the request list.
+func (eng *ChatEngine) Requests() []*Request {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+	return append([]*Request(nil), eng.requests...)
+}
 
 //
 // Get
 //
 
-// GetContact returns the item at index and a boolean indicating if the
-// index was in bounds and contained a non-nil item.
-func (eng *ChatEngine) GetContact(index int) (item *Profile, ok bool) {
-	if index < 0 || index >= len(eng.Contacts) ||
-		eng.Contacts[index] == nil {
-		return nil, false
+// GetContact returns the contact with the handle and a boolean indicating
+// if it was found.
+func (eng *ChatEngine) GetContact(h Handle) (item *Contact, ok bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
+	for _, c := range eng.contacts {
+		if c.handle == h {
+			return c, true
+		}
 	}
-	return eng.Contacts[index], true
+	return nil, false
 }
 
-// GetSession returns the item at index and a boolean indicating if the
-// index was in bounds and contained a non-nil item.
-func (eng *ChatEngine) GetSession(index int) (item *Session, ok bool) {
-	if index < 0 || index >= len(eng.Sessions) ||
-		eng.Sessions[index] == nil {
-		return nil, false
+// GetSession returns the session with the handle and a boolean indicating
+// if it was found.
+func (eng *ChatEngine) GetSession(h Handle) (item *Session, ok bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
+	for _, s := range eng.sessions {
+		if s.handle == h {
+			return s, true
+		}
 	}
-	return eng.Sessions[index], true
+	return nil, false
 }
 
-// GetRequest returns the item at index and a boolean indicating if the
-// index was in bounds and contained a non-nil item.
-func (eng *ChatEngine) GetRequest(index int) (item *Request, ok bool) {
-	if index < 0 || index >= len(eng.Requests) ||
-		eng.Requests[index] == nil {
-		return nil, false
+// GetRequest returns the request with the handle and a boolean indicating
+// if it was found.
+func (eng *ChatEngine) GetRequest(h Handle) (item *Request, ok bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
+	for _, r := range eng.requests {
+		if r.handle == h {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// routeSession gets the Active session with the routing tag.
+func (eng *ChatEngine) routeSession(route []byte) (s *Session, ok bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
+	s, ok = eng.routes[string(route)]
+	return
+}
+
+// sessionByID gets the session with the session ID.
+func (eng *ChatEngine) sessionByID(id uint64) (s *Session, ok bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
+	for _, s := range eng.sessions {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+//
+// Lookup
+//
+
+// LookupContact finds a contact by handle or, failing that, by name.
+// It is an error if more than one contact has the name.
+func (eng *ChatEngine) LookupContact(handleOrName string) (*Contact, error) {
+	if c, ok := eng.GetContact(Handle(handleOrName)); ok {
+		return c, nil
+	}
+
+	var found *Contact
+	for _, c := range eng.Contacts() {
+		if c.Name == handleOrName {
+			if found != nil {
+				return nil, fmt.Errorf("more than one contact named %q", handleOrName)
+			}
+			found = c
+		}
 	}
-	return eng.Requests[index], true
+	if found == nil {
+		return nil, fmt.Errorf("%s not found", handleOrName)
+	}
+	return found, nil
+}
+
+// LookupSession finds a session by handle or, failing that, by the name of
+// the other client. If several sessions are with the same name, the most
+// recent Active one is used.
+func (eng *ChatEngine) LookupSession(handleOrName string) (*Session, error) {
+	if s, ok := eng.GetSession(Handle(handleOrName)); ok {
+		return s, nil
+	}
+
+	var found *Session
+	for _, s := range eng.Sessions() {
+		if p := s.Peer(); p != nil && p.Name == handleOrName {
+			if found == nil || s.IsActive() || !found.IsActive() {
+				found = s
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s not found", handleOrName)
+	}
+	return found, nil
+}
+
+// LookupRequest finds a request by handle or, failing that, by the name of
+// the requesting client. If several requests have the name, the most
+// recent is used.
+func (eng *ChatEngine) LookupRequest(handleOrName string) (*Request, error) {
+	if r, ok := eng.GetRequest(Handle(handleOrName)); ok {
+		return r, nil
+	}
+
+	var found *Request
+	for _, r := range eng.Requests() {
+		if r.Profile.Name == handleOrName {
+			found = r
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s not found", handleOrName)
+	}
+	return found, nil
 }
 
 //
 // Find
 //
 
-// FindContact returns index of first contact Equal() to the param, or -1
-// if not found.
-func (eng *ChatEngine) FindContact(p *Profile) int {
+// FindContact returns the first contact Equal() to the param, and a
+// boolean indicating if one was found.
+func (eng *ChatEngine) FindContact(p *Profile) (*Contact, bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
 	if p == nil {
-		return -1
+		return nil, false
 	}
 
-	for i, o := range eng.Contacts {
-		if p == o || p.Equal(o) {
-			return i
+	for _, c := range eng.contacts {
+		if p == c.Profile || p.Equal(c.Profile) {
+			return c, true
 		}
 	}
-	return -1
+	return nil, false
 }
 
-// FindSession returns index of first session Equal() to the param, or -1
-// if not found.
-func (eng *ChatEngine) FindSession(s *Session) int {
+// FindSession returns the first session Equal() to the param, and a
+// boolean indicating if one was found.
+func (eng *ChatEngine) FindSession(s *Session) (*Session, bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
 	if s == nil {
-		return -1
+		return nil, false
 	}
 
-	for i, o := range eng.Sessions {
+	for _, o := range eng.sessions {
 		if s == o || s.Equal(o) {
-			return i
+			return o, true
 		}
 	}
-	return -1
+	return nil, false
+}
+
+// FindRequest returns the first request Equal() to the param, and a
+// boolean indicating if one was found.
+func (eng *ChatEngine) FindRequest(r *Request) (*Request, bool) {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+	return eng.findRequest(r)
 }
 
-// FindRequest returns index of first request Equal() to the param, or -1
-// if not found.
-func (eng *ChatEngine) FindRequest(r *Request) int {
+func (eng *ChatEngine) findRequest(r *Request) (*Request, bool) {
 	if r == nil {
-		return -1
+		return nil, false
 	}
 
-	for i, o := range eng.Requests {
+	for _, o := range eng.requests {
 		if r == o || r.Equal(o) {
-			return i
+			return o, true
 		}
 	}
-	return -1
+	return nil, false
 }
 
 //
 // Add
 //
 
-// AddContact adds the contact. Returns index of added item.
-func (eng *ChatEngine) AddContact(p *Profile) int {
-	if p == nil {
-		return -1
-	}
+// AddContact adds the contact. Returns handle of added item.
+func (eng *ChatEngine) AddContact(p *Profile) Handle {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
 
-	// attempt insert at first nil
-	for i := range eng.Contacts {
-		if eng.Contacts[i] == nil {
-			eng.Contacts[i] = p
-			return i
-		}
+	if p == nil {
+		return ""
 	}
 
-	eng.Contacts = append(eng.Contacts, p)
-	return len(eng.Contacts) - 1
+	c := &Contact{Profile: p, handle: eng.nextHandle("c")}
+	eng.contacts = append(eng.contacts, c)
+	return c.handle
 }
 
-// AddSession adds the session. Returns index of added item.
-func (eng *ChatEngine) AddSession(s *Session) int {
+// AddSession adds the session. Returns handle of added item.
+func (eng *ChatEngine) AddSession(s *Session) Handle {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
 	if s == nil {
-		return -1
+		return ""
 	}
 
-	// attempt insert at first nil
-	for i := range eng.Sessions {
-		if eng.Sessions[i] == nil {
-			eng.Sessions[i] = s
-			return i
-		}
-	}
+	s.handle = eng.nextHandle("s")
+	eng.addRoute(s)
+	eng.sessions = append(eng.sessions, s)
+	return s.handle
+}
 
-	eng.Sessions = append(eng.Sessions, s)
-	return len(eng.Sessions) - 1
+// AddRoute makes an Active session findable by its routing tag.
+// Sessions that are not yet Active are ignored.
+func (eng *ChatEngine) AddRoute(s *Session) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	eng.addRoute(s)
 }
 
-// AddRequest adds the Request. Returns index of added item.
-func (eng *ChatEngine) AddRequest(r *Request) int {
-	if r == nil {
-		return -1
+func (eng *ChatEngine) addRoute(s *Session) {
+	if s != nil && s.Route() != nil {
+		eng.routes[string(s.Route())] = s
 	}
+}
 
-	// attempt insert at first nil
-	for i := range eng.Requests {
-		if eng.Requests[i] == nil {
-			eng.Requests[i] = r
-			return i
-		}
+// AddRequest adds the Request. Returns handle of added item.
+func (eng *ChatEngine) AddRequest(r *Request) Handle {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	if r == nil {
+		return ""
 	}
 
-	eng.Requests = append(eng.Requests, r)
-	return len(eng.Requests) - 1
+	r.handle = eng.nextHandle("r")
+	eng.requests = append(eng.requests, r)
+	return r.handle
 }
 
 //
-// Remove
+// Update
 //
 
-// RemoveContact removes the Contact at index.
-// Ignores out-of-bound indices. Return value indicates if item
-// was successfully removed.
-func (eng *ChatEngine) RemoveContact(index int) bool {
-	if index < 0 || index >= len(eng.Contacts) {
+// UpdateContact replaces the profile of the contact with the handle.
+// The contact remains Verified only if the key is unchanged.
+// Return value indicates if there was a contact to update.
+func (eng *ChatEngine) UpdateContact(h Handle, p *Profile) bool {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	if p == nil {
 		return false
 	}
 
-	eng.Contacts[index] = nil
-	return true
+	for i, c := range eng.contacts {
+		if c.handle == h {
+			eng.contacts[i] = &Contact{
+				Profile:  p,
+				Verified: c.Verified && bytes.Equal(c.PublicSigningKey, p.PublicSigningKey),
+				handle:   h,
+			}
+			return true
+		}
+	}
+	return false
 }
 
-// RemoveSession removes the Session at index.
-// Ignores out-of-bound indices. Return value indicates if item
-// was successfully removed.
-func (eng *ChatEngine) RemoveSession(index int) bool {
-	if index < 0 || index >= len(eng.Sessions) {
+// VerifyContact marks the contact with the handle as verified (or not).
+// Return value indicates if there was a contact to update.
+func (eng *ChatEngine) VerifyContact(h Handle, verified bool) bool {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	for i, c := range eng.contacts {
+		if c.handle == h {
+			updated := *c
+			updated.Verified = verified
+			eng.contacts[i] = &updated
+			return true
+		}
+	}
+	return false
+}
+
+// IsVerified determines if the profile's key belongs to a verified contact.
+func (eng *ChatEngine) IsVerified(p *Profile) bool {
+	if p == nil || len(p.PublicSigningKey) == 0 {
 		return false
 	}
 
-	eng.Sessions[index] = nil
-	return true
+	for _, c := range eng.Contacts() {
+		if c.Verified && bytes.Equal(c.PublicSigningKey, p.PublicSigningKey) {
+			return true
+		}
+	}
+	return false
 }
 
-// RemoveRequest removes the Request at index.
-// Ignores out-of-bound indices. Return value indicates if item
-// was successfully removed.
-func (eng *ChatEngine) RemoveRequest(index int) bool {
-	if index < 0 || index >= len(eng.Requests) {
-		return false
+//
+// Remove
+//
+
+// RemoveContact removes the Contact with the handle.
+// Return value indicates if item was successfully removed.
+func (eng *ChatEngine) RemoveContact(h Handle) bool {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	for i, c := range eng.contacts {
+		if c.handle == h {
+			eng.contacts = append(eng.contacts[:i], eng.contacts[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveSession removes the Session with the handle.
+// Return value indicates if item was successfully removed.
+func (eng *ChatEngine) RemoveSession(h Handle) bool {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	for i, s := range eng.sessions {
+		if s.handle == h {
+			if s.Route() != nil {
+				delete(eng.routes, string(s.Route()))
+			}
+			eng.sessions = append(eng.sessions[:i], eng.sessions[i+1:]...)
+			return true
+		}
 	}
+	return false
+}
+
+// RemoveRequest removes the Request with the handle.
+// Return value indicates if item was successfully removed.
+func (eng *ChatEngine) RemoveRequest(h Handle) bool {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	return eng.removeRequest(h)
+}
 
-	eng.Requests[index] = nil
-	return true
+func (eng *ChatEngine) removeRequest(h Handle) bool {
+	for i, r := range eng.requests {
+		if r.handle == h {
+			eng.requests = append(eng.requests[:i], eng.requests[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestEngine makes a ChatEngine named name on the network at name:1.
+func newTestEngine(t *testing.T, n *MemoryNetwork, name string, contacts ...*Contact) *ChatEngine {
+	t.Helper()
+	eng, err := NewChatEngine(n.Transport(name+":1"), nil, &Profile{Name: name, Address: name, Port: "1"}, contacts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eng
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// waitEvent waits for an event of type et, skipping others.
+func waitEvent(t *testing.T, eng *ChatEngine, et EventType) EngineEvent {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case ev := <-eng.Events:
+			if ev.Type == et {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event", et)
+		}
+	}
+}
+
+// connect starts a session from a to b, accepted by b.
+func connect(t *testing.T, a, b *ChatEngine) (sa, sb *Session) {
+	t.Helper()
+	if err := a.SendRequest(b.Me()); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitEvent(t, b, RequestReceived)
+	if err := b.AcceptRequest(ev.Data.(*Request)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "session", func() bool {
+		ss := a.Sessions()
+		return len(ss) == 1 && ss[0].IsActive()
+	})
+	return a.Sessions()[0], b.Sessions()[0]
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := NewMemoryNetwork()
+	a := newTestEngine(t, n, "alice")
+	b := newTestEngine(t, n, "bob")
+	a.Start(ctx)
+	b.Start(ctx)
+
+	sa, sb := connect(t, a, b)
+
+	// large enough to be fragmented
+	message := "hello " + strings.Repeat("x", 3*MaxFragmentSize)
+	if err := sa.SendText(message); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitEvent(t, b, TextReceived)
+	if text := ev.Data.(*Text); text.Message != message || ev.ID != sb.Handle() {
+		t.Fatalf("received %.20q on %s", text.Message, ev.ID)
+	}
+	waitFor(t, "ack", func() bool { return sa.Messages(0)[0].State() == Acked })
+
+	if err := a.DropSession(sa.Handle()); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, b, SessionClosed)
+	if len(a.Sessions()) != 0 || len(b.Sessions()) != 0 {
+		t.Fatal("sessions not removed")
+	}
+}
+
+func TestNewChatEngineKey(t *testing.T) {
+	n := NewMemoryNetwork()
+	a := newTestEngine(t, n, "alice")
+	b := newTestEngine(t, n, "bob")
+
+	// the key is kept with its profile, or one without a key
+	eng, err := NewChatEngine(n.Transport("a:1"), a.PrivSignKey, a.Me(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eng.Me().PublicSigningKey.Equal(publicKey(a)) {
+		t.Fatal("the identity changed")
+	}
+	eng, err = NewChatEngine(n.Transport("a:1"), a.PrivSignKey, &Profile{Name: "alice", Address: "a", Port: "1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.Me().Verify(); err != nil || !eng.Me().PublicSigningKey.Equal(publicKey(a)) {
+		t.Fatalf("profile not signed by the key: %v", err)
+	}
+
+	// but not with another's
+	if _, err := NewChatEngine(n.Transport("a:1"), a.PrivSignKey, b.Me(), nil); err == nil {
+		t.Fatal("used a key not matching the profile")
+	}
+	if _, err := NewChatEngine(n.Transport("a:1"), a.PrivSignKey[:32], a.Me(), nil); err == nil {
+		t.Fatal("used a truncated key")
+	}
+}
+
+func TestReflectedAck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := NewMemoryNetwork()
+	a, b := newTestEngine(t, n, "alice"), newTestEngine(t, n, "bob")
+	a.Start(ctx)
+	b.Start(ctx)
+	sa, sb := connect(t, a, b)
+
+	// alice's Text doesn't reach bob
+	b.transport.Close()
+	if err := sa.SendText("hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice's acknowledgement of bob's first Text is sent back to her
+	sa.mu.Lock()
+	ack, err := PackageAck(&Ack{Seq: 1}, sa.sendControlKey, sa.route)
+	sa.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.OpenAck(ack); err != nil {
+		t.Fatalf("bob can't open alice's Ack: %s", err)
+	}
+	if err := Send(n.Transport("mallory:1"), "alice:1", ack); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, a, DecodeError)
+	if state := sa.Messages(0)[0].State(); state == Acked {
+		t.Fatal("alice accepted her own Ack")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Fingerprint gets a short, human readable identifier of a public signing key.
+// It is the first 80 bits of the key's SHA-256 hash in base32, in groups of 4.
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	s := base32.StdEncoding.EncodeToString(sum[:10]) // 16 chars
+
+	var groups []string
+	for i := 0; i < len(s); i += 4 {
+		groups = append(groups, s[i:i+4])
+	}
+	return strings.ToLower(strings.Join(groups, "-"))
+}
+
+// safetyIterations is the number of hash iterations used for safety numbers,
+// which makes finding a key with a colliding number expensive.
+const safetyIterations = 5200
+
+// SafetyNumber computes a 60 digit number from the keys of two parties, in
+// 12 groups of 5 digits. Both parties compute the same number regardless of
+// argument order, so it can be compared out of band (in person, by phone)
+// to verify neither key was substituted.
+func SafetyNumber(a, b ed25519.PublicKey) string {
+	fa, fb := safetyDigits(a), safetyDigits(b)
+	if bytes.Compare(a, b) > 0 {
+		fa, fb = fb, fa
+	}
+
+	var groups []string
+	for _, f := range [][]byte{fa, fb} {
+		for i := 0; i < 30; i += 5 {
+			n := uint64(f[i])<<32 | uint64(f[i+1])<<24 | uint64(f[i+2])<<16 |
+				uint64(f[i+3])<<8 | uint64(f[i+4])
+			groups = append(groups, fmt.Sprintf("%05d", n%100000))
+		}
+	}
+	return strings.Join(groups, " ")
+}
+
+// safetyDigits gets the iterated hash of a single key used for its half
+// of a safety number.
+func safetyDigits(key ed25519.PublicKey) []byte {
+	const version = 0
+	hash := append([]byte{0, version}, key...)
+	for i := 0; i < safetyIterations; i++ {
+		sum := sha512.Sum512(append(hash, key...))
+		hash = sum[:]
+	}
+	return hash[:30]
+}
+
+// SafetyWords computes a list of 8 words from the keys of two parties. It is
+// an easier to read alternative to SafetyNumber, but with less security
+// (64 bits).
+func SafetyWords(a, b ed25519.PublicKey) []string {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	h := sha256.New()
+	h.Write([]byte("chat safety words"))
+	h.Write(a)
+	h.Write(b)
+	sum := h.Sum(nil)
+
+	words := make([]string, 8)
+	n := binary.BigEndian.Uint64(sum)
+	for i := range words {
+		words[i] = wordList[byte(n>>(8*uint(i)))]
+	}
+	return words
+}
+
+// wordList has 256 distinct, easy to pronounce words, one for each byte value.
+var wordList = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alpha",
+	"amber", "angle", "ankle", "apple", "apron", "arena", "armor", "arrow",
+	"atlas", "attic", "award", "bacon", "badge", "bagel", "baker", "bamboo",
+	"banjo", "barn", "basil", "basin", "beach", "beard", "beaver", "bench",
+	"berry", "bison", "blade", "blaze", "bloom", "board", "bonus", "boots",
+	"brick", "bride", "broom", "brush", "bucket", "buddy", "bugle", "cabin",
+	"cactus", "camel", "candy", "canoe", "canvas", "cargo", "carpet", "castle",
+	"cedar", "chalk", "charm", "cheek", "chess", "chief", "chili", "cider",
+	"cigar", "circus", "clamp", "cliff", "clock", "cloud", "clover", "cobra",
+	"cocoa", "comet", "coral", "couch", "cowboy", "crane", "crater", "crown",
+	"cubic", "curtain", "daisy", "dance", "delta", "denim", "desert", "diary",
+	"dingo", "dolphin", "donkey", "dragon", "drama", "dune", "eagle", "easel",
+	"echo", "elbow", "elder", "ember", "empire", "engine", "epoch", "fable",
+	"falcon", "fence", "ferry", "fiber", "fiddle", "flame", "flute", "forest",
+	"fossil", "fox", "frost", "fudge", "gadget", "galaxy", "garden", "garlic",
+	"gecko", "genie", "ghost", "giant", "ginger", "glacier", "globe", "goblin",
+	"gopher", "grape", "gravel", "guitar", "hammer", "harbor", "harp", "hazel",
+	"helmet", "heron", "hippo", "honey", "hornet", "hotel", "husky", "igloo",
+	"index", "indigo", "iris", "island", "ivory", "jacket", "jaguar", "jelly",
+	"jester", "jewel", "jungle", "kayak", "kernel", "kettle", "kiwi", "koala",
+	"ladder", "lagoon", "lantern", "laser", "lemon", "lilac", "lime", "linen",
+	"lizard", "llama", "lobster", "locket", "lotus", "lunar", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "mercury", "meteor", "mint", "mirror",
+	"mitten", "monkey", "mosaic", "motor", "muffin", "museum", "nectar",
+	"needle", "nickel", "noodle", "nutmeg", "oasis", "ocean", "olive", "onion",
+	"opal", "orbit", "orchid", "otter", "oyster", "paddle", "palace", "panda",
+	"parrot", "pebble", "pepper", "piano", "pickle", "pilot", "pirate",
+	"planet", "plaza", "poet", "pony", "poppy", "prism", "pumpkin", "puzzle",
+	"quartz", "quill", "rabbit", "radar", "radio", "raven", "ribbon", "river",
+	"robin", "rocket", "rose", "ruby", "saddle", "salmon", "satin", "scarf",
+	"shadow", "shark", "shell", "silver", "sketch", "sloth", "spider", "spruce",
+	"squid", "stamp", "statue", "sugar", "summit", "sunset", "swan", "tablet",
+	"tango", "temple",
+}
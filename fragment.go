@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Fragmentation splits encoded Messages into datagrams small enough to
+// avoid IP fragmentation, and reassembles them on receipt.
+//
+// Each datagram (fragment) has a 13 byte header followed by data:
+//
+//	magic    1 byte   always fragmentMagic
+//	id       8 bytes  random per-Message identifier
+//	index    2 bytes  fragment number, starting at 0
+//	count    2 bytes  total number of fragments in the Message
+const (
+	fragmentMagic      byte = 0xC7
+	fragmentHeaderSize      = 13
+	MaxFragmentSize         = 1200 // max datagram size. safe for most MTUs
+	MaxMessageSize          = 64 * 1024
+	ReassemblyTimeout       = 10 * time.Second
+	MaxReassemblyBytes      = 1024 * 1024 // max buffered across all partial Messages
+	MaxSourceBytes          = 256 * 1024  // max buffered for partial Messages from one address
+	MaxSourcePartials       = 8           // max partial Messages from one address
+)
+
+// Fragment splits data into datagrams no larger than MaxFragmentSize.
+func Fragment(data []byte) ([][]byte, error) {
+	if len(data) > MaxMessageSize {
+		return nil, fmt.Errorf("message too large (%d bytes)", len(data))
+	}
+
+	const chunk = MaxFragmentSize - fragmentHeaderSize
+	count := (len(data) + chunk - 1) / chunk
+	if count == 0 {
+		count = 1
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	frags := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start, end := i*chunk, (i+1)*chunk
+		if end > len(data) {
+			end = len(data)
+		}
+
+		f := make([]byte, fragmentHeaderSize, fragmentHeaderSize+end-start)
+		f[0] = fragmentMagic
+		copy(f[1:9], id)
+		binary.BigEndian.PutUint16(f[9:11], uint16(i))
+		binary.BigEndian.PutUint16(f[11:13], uint16(count))
+		frags = append(frags, append(f, data[start:end]...))
+	}
+
+	return frags, nil
+}
+
+// partial is a Message which is being reassembled.
+type partial struct {
+	addr     string
+	frags    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// source is the partial Messages from one address.
+type source struct {
+	keys []string // oldest first
+	size int
+}
+
+// Reassembler collects fragments until complete Messages can be rebuilt.
+// Partial Messages are discarded if not completed within ReassemblyTimeout.
+// Each address may have MaxSourcePartials partial Messages buffering up to
+// MaxSourceBytes, and when it needs more its oldest are discarded, so that
+// one sender cannot take the buffer from others. Fragments which would
+// exceed MaxReassemblyBytes are refused once the sender has no older
+// partial Messages to give up.
+type Reassembler struct {
+	mu       sync.Mutex
+	partials map[string]*partial // keyed by source address + fragment id
+	sources  map[string]*source  // keyed by source address
+	buffered int
+}
+
+// NewReassembler makes a new Reassembler.
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		partials: make(map[string]*partial),
+		sources:  make(map[string]*source),
+	}
+}
+
+// Add a fragment received from addr. Once all fragments of a Message are
+// received, the complete data is returned. Otherwise data is nil.
+func (r *Reassembler) Add(addr string, frag []byte) (data []byte, err error) {
+	if len(frag) < fragmentHeaderSize || frag[0] != fragmentMagic {
+		return nil, fmt.Errorf("not a fragment")
+	}
+	index := int(binary.BigEndian.Uint16(frag[9:11]))
+	count := int(binary.BigEndian.Uint16(frag[11:13]))
+	body := frag[fragmentHeaderSize:]
+
+	const maxCount = (MaxMessageSize + MaxFragmentSize - fragmentHeaderSize - 1) /
+		(MaxFragmentSize - fragmentHeaderSize)
+	if count == 0 || count > maxCount || index >= count {
+		return nil, fmt.Errorf("invalid fragment %d of %d", index, count)
+	}
+	if count == 1 {
+		return body, nil // fast path for small messages
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := addr + "/" + string(frag[1:9])
+	p, ok := r.partials[key]
+	if !ok {
+		src, ok := r.sources[addr]
+		if !ok {
+			src = &source{}
+			r.sources[addr] = src
+		}
+		if len(src.keys) >= MaxSourcePartials {
+			r.drop(src.keys[0])
+		}
+		p = &partial{addr: addr, frags: make([][]byte, count), started: time.Now()}
+		r.partials[key] = p
+		src.keys = append(src.keys, key)
+	}
+	if len(p.frags) != count {
+		r.drop(key)
+		return nil, fmt.Errorf("inconsistent fragment count")
+	}
+	if p.frags[index] != nil {
+		return nil, nil // duplicate fragment
+	}
+
+	if p.size+len(body) > MaxMessageSize {
+		r.drop(key)
+		return nil, fmt.Errorf("reassembled message too large")
+	}
+	src := r.sources[addr]
+	for src.size+len(body) > MaxSourceBytes || r.buffered+len(body) > MaxReassemblyBytes {
+		if src.keys[0] == key { // nothing older from this sender to give up
+			r.drop(key)
+			return nil, fmt.Errorf("reassembly buffer full")
+		}
+		r.drop(src.keys[0])
+	}
+
+	p.frags[index] = body
+	p.received++
+	p.size += len(body)
+	src.size += len(body)
+	r.buffered += len(body)
+
+	if p.received < count {
+		return nil, nil
+	}
+
+	data = make([]byte, 0, p.size)
+	for _, f := range p.frags {
+		data = append(data, f...)
+	}
+	r.drop(key)
+	return data, nil
+}
+
+// Expire discards partial Messages older than ReassemblyTimeout, returning
+// the number discarded.
+func (r *Reassembler) Expire(now time.Time) (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, p := range r.partials {
+		if now.Sub(p.started) > ReassemblyTimeout {
+			r.drop(key)
+			n++
+		}
+	}
+	return
+}
+
+// drop removes a partial Message. Caller must hold the lock.
+func (r *Reassembler) drop(key string) {
+	p, ok := r.partials[key]
+	if !ok {
+		return
+	}
+	r.buffered -= p.size
+	delete(r.partials, key)
+
+	src := r.sources[p.addr]
+	src.size -= p.size
+	for i, k := range src.keys {
+		if k == key {
+			src.keys = append(src.keys[:i], src.keys[i+1:]...)
+			break
+		}
+	}
+	if len(src.keys) == 0 {
+		delete(r.sources, p.addr)
+	}
+}
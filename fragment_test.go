@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// makeFragment makes fragment index of count for the Message with id.
+func makeFragment(id byte, index, count int, body []byte) []byte {
+	f := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(body))
+	f[0], f[1] = fragmentMagic, id
+	binary.BigEndian.PutUint16(f[9:11], uint16(index))
+	binary.BigEndian.PutUint16(f[11:13], uint16(count))
+	return append(f, body...)
+}
+
+func TestReassembly(t *testing.T) {
+	data := make([]byte, 3*MaxFragmentSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	frags, err := Fragment(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) != 4 {
+		t.Fatalf("%d fragments", len(frags))
+	}
+
+	// fragments may arrive in any order, and more than once
+	r := NewReassembler()
+	var got []byte
+	for _, i := range []int{3, 1, 1, 0, 2} {
+		out, err := r.Add("a", frags[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != nil {
+			got = out
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("reassembled data differs")
+	}
+	if len(r.partials) != 0 || len(r.sources) != 0 || r.buffered != 0 {
+		t.Fatal("reassembly left buffered fragments")
+	}
+
+	if _, err := Fragment(make([]byte, MaxMessageSize+1)); err == nil {
+		t.Fatal("fragmented an oversized message")
+	}
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	chunk := make([]byte, MaxFragmentSize-fragmentHeaderSize)
+	maxCount := (MaxMessageSize + len(chunk) - 1) / len(chunk)
+
+	r := NewReassembler()
+	for name, frag := range map[string][]byte{
+		"short header":   {fragmentMagic, 1, 2},
+		"no magic":       makeFragment(1, 0, 2, nil)[1:],
+		"zero count":     makeFragment(1, 0, 0, nil),
+		"index >= count": makeFragment(1, 2, 2, nil),
+		"too many":       makeFragment(1, 0, maxCount+1, nil),
+	} {
+		if _, err := r.Add("a", frag); err == nil {
+			t.Errorf("added a fragment with %s", name)
+		}
+	}
+
+	// a fragment count differing from the first drops the Message
+	r.Add("a", makeFragment(1, 0, 3, chunk))
+	if _, err := r.Add("a", makeFragment(1, 1, 2, chunk)); err == nil {
+		t.Error("accepted an inconsistent fragment count")
+	}
+	if len(r.partials) != 0 {
+		t.Error("kept the inconsistent Message")
+	}
+
+	// full fragments, as many as the count allows, exceed MaxMessageSize
+	for i := 0; i < maxCount-1; i++ {
+		if _, err := r.Add("a", makeFragment(2, i, maxCount, chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Add("a", makeFragment(2, maxCount-1, maxCount, chunk)); err == nil {
+		t.Error("reassembled an oversized message")
+	}
+	if r.buffered != 0 {
+		t.Errorf("%d bytes still buffered", r.buffered)
+	}
+}
+
+func TestReassemblyBuffer(t *testing.T) {
+	chunk := make([]byte, MaxFragmentSize-fragmentHeaderSize)
+	r := NewReassembler()
+
+	// an address giving more partial Messages loses its oldest
+	for id := 0; id < MaxSourcePartials+2; id++ {
+		r.Add("a", makeFragment(byte(id), 0, 2, chunk))
+	}
+	if n := len(r.sources["a"].keys); n != MaxSourcePartials {
+		t.Fatalf("%d partial Messages from one address", n)
+	}
+	if _, ok := r.partials["a/"+string([]byte{0, 0, 0, 0, 0, 0, 0, 0})]; ok {
+		t.Fatal("kept the oldest partial Message")
+	}
+
+	// and when it buffers too much, it gives up its own oldest
+	r = NewReassembler()
+	for i := 0; i < MaxSourceBytes/len(chunk)+1; i++ {
+		if _, err := r.Add("a", makeFragment(byte(i/50), i%50, 51, chunk)); err != nil {
+			t.Fatal(err)
+		}
+		if r.sources["a"].size > MaxSourceBytes {
+			t.Fatalf("buffered %d bytes from one address", r.sources["a"].size)
+		}
+	}
+	if _, ok := r.partials["a/"+string([]byte{0, 0, 0, 0, 0, 0, 0, 0})]; ok {
+		t.Fatal("kept the oldest partial Message")
+	}
+
+	// a single partial Message can't exceed the limit by itself
+	r = NewReassembler()
+	var err error
+	for i := 0; i < MaxSourceBytes/len(chunk)+1 && err == nil; i++ {
+		_, err = r.Add("a", makeFragment(1, i, MaxSourceBytes/len(chunk)+2, chunk))
+	}
+	if err == nil {
+		t.Fatal("buffered beyond the limit for one address")
+	}
+
+	// and all addresses share the total buffer
+	r = NewReassembler()
+	err = nil
+	for i := 0; err == nil && i < 2*MaxReassemblyBytes/len(chunk); i++ {
+		addr := fmt.Sprintf("%d", i/50)
+		_, err = r.Add(addr, makeFragment(1, i%50, 51, chunk))
+	}
+	if err == nil || r.buffered > MaxReassemblyBytes {
+		t.Fatalf("buffered %d bytes: %v", r.buffered, err)
+	}
+}
+
+func TestReassemblyExpiry(t *testing.T) {
+	frags, err := Fragment(make([]byte, 2*MaxFragmentSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler()
+	r.Add("a", frags[0])
+
+	if n := r.Expire(time.Now()); n != 0 {
+		t.Fatalf("expired %d fresh partial Messages", n)
+	}
+	if n := r.Expire(time.Now().Add(ReassemblyTimeout + time.Second)); n != 1 {
+		t.Fatalf("expired %d partial Messages", n)
+	}
+	if r.buffered != 0 || len(r.sources) != 0 {
+		t.Fatal("expiry left buffered fragments")
+	}
+
+	// the rest of an expired Message is not enough to rebuild it
+	for _, f := range frags[1:] {
+		if out, err := r.Add("a", f); err != nil || out != nil {
+			t.Fatalf("reassembled an expired Message: %v", err)
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 //
 // These 2 functions provide an slightly less tedious way to encode/decode
-// the 3 primary datatypes used by the ChatEngine.
+// the primary datatypes used by the ChatEngine.
 //
 
 func gobDecode(b []byte, plType PayloadType) interface{} {
@@ -36,6 +36,36 @@ func gobDecode(b []byte, plType PayloadType) interface{} {
 		if dec().Decode(x) == nil {
 			return x
 		}
+
+	case PayloadAck:
+		x := &Ack{}
+		if dec().Decode(x) == nil {
+			return x
+		}
+
+	case PayloadClose:
+		x := &SessionClose{}
+		if dec().Decode(x) == nil {
+			return x
+		}
+
+	case PayloadHandshake:
+		x := &Handshake{}
+		if dec().Decode(x) == nil {
+			return x
+		}
+
+	case PayloadProfile:
+		x := &Profile{}
+		if dec().Decode(x) == nil {
+			return x
+		}
+
+	case PayloadRendezvous:
+		x := &Rendezvous{}
+		if dec().Decode(x) == nil {
+			return x
+		}
 	}
 
 	return nil
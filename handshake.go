@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// handshakeLabel identifies the key exchange in the transcript, so that keys
+// derived by a different protocol (or version of this one) never coincide.
+const handshakeLabel = "chat session handshake v1"
+
+// sessionTranscript hashes the public values of a Request/Response exchange:
+// both clients' identity (signing) keys, both session keys and the session
+// ID. The initiator is the client that sent the Request. Since the Request
+// and Response are signed, and keys are derived from the transcript, the
+// session keys are bound to both identities and to this session.
+func sessionTranscript(initiatorID, responderID, initiatorKey, responderKey []byte, sessionID uint64) []byte {
+	h := sha256.New()
+	h.Write([]byte(handshakeLabel))
+	for _, v := range [][]byte{initiatorID, responderID, initiatorKey, responderKey} {
+		var n [2]byte
+		binary.LittleEndian.PutUint16(n[:], uint16(len(v)))
+		h.Write(n[:])
+		h.Write(v)
+	}
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], sessionID)
+	h.Write(id[:])
+	return h.Sum(nil)
+}
+
+// sessionKeys derives the session's shared key, and a key used only to
+// confirm that both clients derived it, from the X25519 output and the
+// handshake transcript.
+func sessionKeys(dh, transcript []byte) (sharedKey, confirmKey []byte, err error) {
+	keys, err := DeriveKey(dh, transcript, "chat session keys", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// controlKeys derives the keys which seal a session's Acks, Closes and
+// Profiles from its shared key: one for those sent by the initiator and one
+// for those sent by the responder, so that neither client accepts its own
+// control Messages reflected back to it.
+func controlKeys(sharedKey []byte) (initiatorKey, responderKey []byte, err error) {
+	keys, err := DeriveKey(sharedKey, nil, "chat control keys", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// confirmSession computes the key confirmation sent in a Response, which
+// proves the responder derived the same keys from the same transcript.
+func confirmSession(confirmKey, transcript []byte) []byte {
+	return SignHS256(append([]byte("chat key confirmation"), transcript...), confirmKey)
+}
+
+// checkConfirmation verifies the key confirmation of a Response.
+func checkConfirmation(confirmation, confirmKey, transcript []byte) error {
+	if !ValidSignatureHS256(confirmation, append([]byte("chat key confirmation"), transcript...), confirmKey) {
+		return fmt.Errorf("key confirmation failed")
+	}
+	return nil
+}
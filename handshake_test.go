@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// fill makes n bytes of b.
+func fill(b byte, n int) []byte { return bytes.Repeat([]byte{b}, n) }
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestSessionKeyVectors checks the key schedule of a Request/Response
+// exchange against values computed independently from its definition.
+func TestSessionKeyVectors(t *testing.T) {
+	const sessionID = 0x0102030405060708
+	transcript := sessionTranscript(fill(1, 32), fill(2, 32), fill(3, 32), fill(4, 32), sessionID)
+
+	sharedKey, confirmKey, err := sessionKeys(fill(5, 32), transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiatorKey, responderKey, err := controlKeys(sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootKey, chainKey, err := initialRatchetKeys(sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"transcript", transcript, "bb39ed03d9cfbfda1c3cc8162633b5588a80482eb552f8d8cd854d232961513c"},
+		{"shared key", sharedKey, "489e0c073a816e3dcf4a048e41d4a81e96f77ff5c66a17306b279253ac438d18"},
+		{"confirmation key", confirmKey, "b75a5a20760b45c547ae2489228f12a049d022cf73c632a10693366dee8e483c"},
+		{"confirmation", confirmSession(confirmKey, transcript), "4018aeffb9ff112dc44984ffa5e09002e75e7fe5b4d58e8c0a76f9c03d8a358e"},
+		{"route", RouteTag(sharedKey, sessionID), "effa0946442a74c9"},
+		{"initiator control key", initiatorKey, "c0765e353f01cf7db38f1c0f741a8398a8d4a544f05c8ac4954a9edf257670dd"},
+		{"responder control key", responderKey, "cc1f25e06c864416347195312a089763f7b0c4876446b22195fc56ff26ffe3ab"},
+		{"ratchet root key", rootKey, "152132c4957dd42ff5abcda8ec1db038d3ee0416dca7b036246adeb2d69523b7"},
+		{"ratchet chain key", chainKey, "272f4a11deed33c5135dc75ddd7355135adff26fd9a2d3d2656fb536256cd5bf"},
+	} {
+		if want := mustHex(t, v.want); !bytes.Equal(v.got, want) {
+			t.Errorf("%s = %x, want %x", v.name, v.got, want)
+		}
+	}
+
+	if err := checkConfirmation(confirmSession(confirmKey, transcript), confirmKey, transcript); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestSessionTranscriptBinding checks that the transcript changes with
+// every input, including the order of the identities.
+func TestSessionTranscriptBinding(t *testing.T) {
+	a, b, c, d := fill(1, 32), fill(2, 32), fill(3, 32), fill(4, 32)
+	base := sessionTranscript(a, b, c, d, 1)
+	for name, other := range map[string][]byte{
+		"swapped identities": sessionTranscript(b, a, c, d, 1),
+		"swapped keys":       sessionTranscript(a, b, d, c, 1),
+		"session ID":         sessionTranscript(a, b, c, d, 2),
+		"shifted boundary":   sessionTranscript(a[:31], append(a[31:], b...), c, d, 1),
+	} {
+		if bytes.Equal(base, other) {
+			t.Errorf("transcript unchanged by %s", name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// KeyChangePolicy determines what the engine does when a known contact
+// presents a different PublicSigningKey than the one pinned in Contacts.
+type KeyChangePolicy string
+
+const (
+	// RejectKeyChange drops Requests and Responses with a changed key.
+	RejectKeyChange KeyChangePolicy = "reject"
+	// QuarantineKeyChange holds Requests with a changed key until the user
+	// trusts the new key. Responses with a changed key are dropped.
+	QuarantineKeyChange KeyChangePolicy = "quarantine"
+	// AcceptKeyChange pins the new key, after warning the user.
+	AcceptKeyChange KeyChangePolicy = "accept"
+)
+
+// ParseKeyChangePolicy converts a string to a KeyChangePolicy.
+func ParseKeyChangePolicy(s string) (KeyChangePolicy, error) {
+	switch p := KeyChangePolicy(s); p {
+	case RejectKeyChange, QuarantineKeyChange, AcceptKeyChange:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown key change policy %q", s)
+}
+
+// pinnedContact finds the contact a Profile claims to be, matching first by
+// address and then by name.
+func (eng *ChatEngine) pinnedContact(p *Profile) (*Contact, bool) {
+	contacts := eng.Contacts()
+	for _, c := range contacts {
+		if c.FullAddress() == p.FullAddress() {
+			return c, true
+		}
+	}
+	for _, c := range contacts {
+		if c.Name == p.Name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// checkIdentity compares the key in a received Profile with the key pinned
+// for the matching contact. A contact without a key has the received key
+// pinned (trust on first use). If the key differs from the pinned one, the
+// contact is returned with changed = true.
+func (eng *ChatEngine) checkIdentity(p *Profile) (c *Contact, changed bool) {
+	c, ok := eng.pinnedContact(p)
+	if !ok {
+		return nil, false
+	}
+
+	if len(c.PublicSigningKey) == 0 {
+		eng.pinKey(c, p.PublicSigningKey)
+		return c, false
+	}
+
+	return c, !bytes.Equal(c.PublicSigningKey, p.PublicSigningKey)
+}
+
+// contactByKey finds the contact with the key.
+func (eng *ChatEngine) contactByKey(key []byte) (*Contact, bool) {
+	for _, c := range eng.Contacts() {
+		if len(key) > 0 && bytes.Equal(c.PublicSigningKey, key) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// acceptProfile compares a received (and verified) Profile with the contact
+// having the same key. A newer Profile replaces the contact's, which is
+// saved. An older Profile, or a different one with the same Seq, is an error.
+func (eng *ChatEngine) acceptProfile(p *Profile) error {
+	c, ok := eng.contactByKey(p.PublicSigningKey)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case p.Seq < c.Seq:
+		return fmt.Errorf("profile of %s was rolled back from version %d to %d", c, c.Seq, p.Seq)
+	case p.Seq == c.Seq && c.Signature != nil:
+		if !p.SameFields(c.Profile) {
+			return fmt.Errorf("conflicting profiles of %s with version %d", c, p.Seq)
+		}
+		return nil
+	}
+
+	eng.UpdateContact(c.Handle(), p)
+	if err := eng.SaveContacts(); err != nil {
+		log.Println(err)
+	}
+	if !p.SameFields(c.Profile) {
+		eng.emit(ProfileUpdated, c.Handle(), p, "%s updated their profile to %s", c, p)
+	}
+	return nil
+}
+
+// checkResponder checks the identity of the client answering a session's
+// request, which is only acceptable with a changed key under AcceptKeyChange.
+// Data is the Response or Handshake reported with a KeyChanged event.
+func (eng *ChatEngine) checkResponder(p *Profile, h Handle, data interface{}) bool {
+	c, changed := eng.checkIdentity(p)
+	if !changed {
+		if err := eng.acceptProfile(p); err != nil {
+			eng.emit(Error, h, data, "response rejected: %s", err)
+			return false
+		}
+		return true
+	}
+
+	if eng.KeyPolicy != AcceptKeyChange {
+		eng.emit(KeyChanged, h, data, "%s has a new key. response rejected", p)
+		return false
+	}
+	eng.pinKey(c, p.PublicSigningKey)
+	eng.emit(KeyChanged, h, data, "%s has a new key. accepted new key", p)
+	return true
+}
+
+// pinKey replaces the key pinned for a contact and saves the contacts.
+func (eng *ChatEngine) pinKey(c *Contact, key []byte) {
+	pinned := *c.Profile
+	pinned.PublicSigningKey = key
+	pinned.Seq, pinned.Signature = 0, nil // versions of the old key don't apply
+	eng.UpdateContact(c.Handle(), &pinned)
+	eng.SaveContacts()
+}
+
+// TrustRequest accepts the changed key of a quarantined Request, pinning it
+// for the matching contact. The Request may then be accepted.
+func (eng *ChatEngine) TrustRequest(h Handle) error {
+	eng.mu.Lock()
+	var r *Request
+	for _, o := range eng.requests {
+		if o.handle == h {
+			r = o
+		}
+	}
+	if r != nil {
+		r.quarantined = false
+	}
+	eng.mu.Unlock()
+
+	if r == nil {
+		return fmt.Errorf("%s not found", h)
+	}
+
+	if c, ok := eng.pinnedContact(r.Profile); ok {
+		eng.pinKey(c, r.Profile.PublicSigningKey)
+	}
+	return nil
+}
+
+// SaveContacts writes the contact list to ContactsFile, if set.
+func (eng *ChatEngine) SaveContacts() error {
+	if eng.ContactsFile == "" {
+		return nil
+	}
+
+	return WriteContacts(eng.Contacts(), eng.ContactsFile)
+}
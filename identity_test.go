@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestAcceptProfile(t *testing.T) {
+	n := NewMemoryNetwork()
+	b := newTestEngine(t, n, "bob")
+	first := *b.Me()
+	a := newTestEngine(t, n, "alice", &Contact{Profile: &first})
+
+	// version signs a copy of bob's profile changed by change
+	version := func(seq uint64, change func(p *Profile)) *Profile {
+		p := first
+		p.Seq = seq
+		change(&p)
+		if err := p.Sign(b.PrivSignKey); err != nil {
+			t.Fatal(err)
+		}
+		return &p
+	}
+
+	newer := version(first.Seq+1, func(p *Profile) { p.Address = "bob2" })
+	if err := a.acceptProfile(newer); err != nil {
+		t.Fatal(err)
+	}
+	if c := a.Contacts()[0]; c.Address != "bob2" || c.Seq != newer.Seq {
+		t.Fatalf("contact is %s version %d", c.FullAddress(), c.Seq)
+	}
+	if err := a.acceptProfile(&first); err == nil {
+		t.Error("profile rolled back to an older version")
+	}
+	conflict := version(newer.Seq, func(p *Profile) { p.Address = "mallory" })
+	if err := a.acceptProfile(conflict); err == nil {
+		t.Error("accepted a different profile with the same version")
+	}
+	if err := a.acceptProfile(newer); err != nil {
+		t.Errorf("the same profile again: %s", err)
+	}
+	if c := a.Contacts()[0]; c.Address != "bob2" {
+		t.Fatalf("contact changed to %s", c.FullAddress())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// An invite gives another party everything needed to add this client as a
+// contact: its name, address, port and signing key. It is shared in one of
+// two forms, both checksummed so that mistyped invites are rejected:
+//
+// A URI, where the key parameter is the base32 key followed by the first
+// 4 bytes of the sha256 of the key:
+//
+//	chat://<name>@<address>:<port>?key=<base32 key and checksum>
+//
+// A code, which is the base32 of the binary invite below. It only uses
+// characters which QR codes encode compactly, and may be typed in any case
+// with dashes or spaces between groups.
+//
+//	version   1 byte     1
+//	key       32 bytes
+//	port      2 bytes
+//	name      1 byte length, then the name
+//	address   the rest, before the checksum
+//	checksum  4 bytes    first 4 bytes of the sha256 of the bytes before it
+const (
+	InviteScheme   = "chat"
+	inviteVersion  = 1
+	inviteChecksum = 4
+)
+
+var inviteEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// inviteSum gets the checksum of b.
+func inviteSum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:inviteChecksum]
+}
+
+// decodeInvite decodes s, refusing a last character with stray low bits so
+// that each invite has only one spelling.
+func decodeInvite(s string) ([]byte, error) {
+	b, err := inviteEncoding.DecodeString(s)
+	if err == nil && inviteEncoding.EncodeToString(b) != s {
+		err = fmt.Errorf("non-canonical encoding")
+	}
+	return b, err
+}
+
+// InviteURI makes a chat:// URI for the profile.
+func (p *Profile) InviteURI() (string, error) {
+	if len(p.PublicSigningKey) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("profile has no signing key")
+	}
+	key := append(append([]byte(nil), p.PublicSigningKey...), inviteSum(p.PublicSigningKey)...)
+	u := url.URL{
+		Scheme:   InviteScheme,
+		User:     url.User(p.Name),
+		Host:     p.FullAddress(),
+		RawQuery: url.Values{"key": {inviteEncoding.EncodeToString(key)}}.Encode(),
+	}
+	return u.String(), nil
+}
+
+// InviteCode makes an invite code for the profile.
+func (p *Profile) InviteCode() (string, error) {
+	if len(p.PublicSigningKey) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("profile has no signing key")
+	}
+	port, err := strconv.ParseUint(p.Port, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", p.Port)
+	}
+	if len(p.Name) > 255 {
+		return "", fmt.Errorf("name too long")
+	}
+
+	b := []byte{inviteVersion}
+	b = append(b, p.PublicSigningKey...)
+	b = append(b, byte(port>>8), byte(port))
+	b = append(append(b, byte(len(p.Name))), p.Name...)
+	b = append(b, p.Address...)
+	b = append(b, inviteSum(b)...)
+	return inviteEncoding.EncodeToString(b), nil
+}
+
+// ParseInvite parses an invite URI or code into a Profile. The Profile is
+// not signed, so it is not verified until a session authenticates its key.
+func ParseInvite(invite string) (*Profile, error) {
+	invite = strings.TrimSpace(invite)
+	if strings.HasPrefix(strings.ToLower(invite), InviteScheme+"://") {
+		return parseInviteURI(invite)
+	}
+	return parseInviteCode(invite)
+}
+
+func parseInviteURI(invite string) (*Profile, error) {
+	u, err := url.Parse(invite)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("no name")
+	}
+	p := &Profile{Name: u.User.Username()}
+	if p.Address, p.Port, err = splitEndpoint(u.Host); err != nil {
+		return nil, err
+	}
+
+	key, err := decodeInvite(strings.ToUpper(u.Query().Get("key")))
+	if err != nil || len(key) != ed25519.PublicKeySize+inviteChecksum {
+		return nil, fmt.Errorf("invalid key")
+	}
+	sum := key[ed25519.PublicKeySize:]
+	p.PublicSigningKey = ed25519.PublicKey(key[:ed25519.PublicKeySize])
+	if !bytes.Equal(sum, inviteSum(p.PublicSigningKey)) {
+		return nil, fmt.Errorf("invalid key checksum")
+	}
+	return p, nil
+}
+
+func parseInviteCode(invite string) (*Profile, error) {
+	code := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(invite))
+	b, err := decodeInvite(code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite code")
+	}
+
+	const fixed = 1 + ed25519.PublicKeySize + 2 + 1
+	if len(b) < fixed+inviteChecksum {
+		return nil, fmt.Errorf("invite code too short")
+	}
+	data, sum := b[:len(b)-inviteChecksum], b[len(b)-inviteChecksum:]
+	if !bytes.Equal(sum, inviteSum(data)) {
+		return nil, fmt.Errorf("invalid invite code checksum")
+	}
+	if data[0] != inviteVersion {
+		return nil, fmt.Errorf("unsupported invite version %d", data[0])
+	}
+
+	p := &Profile{
+		PublicSigningKey: ed25519.PublicKey(append([]byte(nil), data[1:1+ed25519.PublicKeySize]...)),
+		Port:             strconv.Itoa(int(binary.BigEndian.Uint16(data[1+ed25519.PublicKeySize:]))),
+	}
+	nameLen := int(data[fixed-1])
+	if fixed+nameLen > len(data) {
+		return nil, fmt.Errorf("invite code too short")
+	}
+	p.Name = string(data[fixed : fixed+nameLen])
+	p.Address = string(data[fixed+nameLen:])
+	if p.Name == "" || p.Address == "" {
+		return nil, fmt.Errorf("invite has no name or address")
+	}
+	return p, nil
+}
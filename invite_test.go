@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestInviteRoundTrip(t *testing.T) {
+	_, pub, err := Ed25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Profile{Name: "alice", Address: "192.0.2.1", Port: "5190", PublicSigningKey: pub}
+
+	uri, err := p.InviteURI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := p.InviteCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "chat://alice@192.0.2.1:5190?key=") {
+		t.Errorf("invite URI is %s", uri)
+	}
+	if strings.Trim(code, qrAlphanumeric) != "" {
+		t.Errorf("invite code %s is not alphanumeric", code)
+	}
+
+	// codes may be typed in lower case, in groups
+	lower := strings.ToLower(code)
+	var groups []string
+	for i := 0; i < len(lower); i += 4 {
+		end := i + 4
+		if end > len(lower) {
+			end = len(lower)
+		}
+		groups = append(groups, lower[i:end])
+	}
+	for _, invite := range []string{uri, code, " " + strings.Join(groups, "-") + "\n", strings.Join(groups, " ")} {
+		got, err := ParseInvite(invite)
+		if err != nil {
+			t.Fatalf("%q: %s", invite, err)
+		}
+		if got.Name != p.Name || got.FullAddress() != p.FullAddress() || !bytes.Equal(got.PublicSigningKey, pub) {
+			t.Errorf("%q is %s at %s", invite, got, got.FullAddress())
+		}
+	}
+
+	if _, err := (&Profile{Name: "alice", Address: "a", Port: "1"}).InviteCode(); err == nil {
+		t.Error("made an invite without a key")
+	}
+}
+
+func TestInviteChecksum(t *testing.T) {
+	_, pub, err := Ed25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Profile{Name: "alice", Address: "192.0.2.1", Port: "5190", PublicSigningKey: pub}
+	uri, err := p.InviteURI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := p.InviteCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// any mistyped character is noticed
+	mistype := func(s string, i int) string {
+		c := byte('A')
+		if s[i] == 'A' || s[i] == 'a' {
+			c = 'B'
+		}
+		return s[:i] + string(c) + s[i+1:]
+	}
+	key := strings.Index(uri, "key=") + len("key=")
+	for i := key; i < len(uri); i++ {
+		if _, err := ParseInvite(mistype(uri, i)); err == nil {
+			t.Fatalf("accepted %s", mistype(uri, i))
+		}
+	}
+	for i := range code {
+		if _, err := ParseInvite(mistype(code, i)); err == nil {
+			t.Fatalf("accepted %s", mistype(code, i))
+		}
+	}
+
+	// as are stray bits in the last character, which decode the same
+	stray := func(s string) string {
+		const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+		last := strings.IndexByte(alphabet, s[len(s)-1])
+		return s[:len(s)-1] + string(alphabet[last^1])
+	}
+	for _, invite := range []string{stray(uri), stray(code)} {
+		if _, err := ParseInvite(invite); err == nil {
+			t.Errorf("accepted %s", invite)
+		}
+	}
+
+	for _, invite := range []string{"", "chat://alice@192.0.2.1:5190", "chat://192.0.2.1:5190?key=" + uri[key:], code[:20]} {
+		if _, err := ParseInvite(invite); err == nil {
+			t.Errorf("accepted %q", invite)
+		}
+	}
+}
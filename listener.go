@@ -5,66 +5,73 @@ import (
 	"context"
 	"encoding/gob"
 	"log"
-	"net"
 	"time"
 )
 
-// Listener runs a loop to read data from a specific port using the UDP
-// protocol. Each successful read spawns a goroutine to decode the data
-// into a Message and forward that to MessageProcessor().
-func (eng *ChatEngine) Listener(ctx context.Context) error {
-	const maxBufferSize = 4096
+// Listener runs a loop to read Packets from the engine's Transport. Each
+// Packet is a fragment of a Message, or a STUN response (see MappedAddress).
+// Once a Message is reassembled, a goroutine is spawned to decode the data
+// into a Message and forward that to MessageProcessor(). The Transport is
+// closed when ctx is done.
+func (eng *ChatEngine) Listener(ctx context.Context) {
+	defer eng.transport.Close()
 
-	listenAddress, err := net.ResolveUDPAddr("udp", ":"+eng.Me.Port)
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.ListenUDP("udp", listenAddress)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+	reassembler := NewReassembler()
+	expire := time.NewTicker(time.Second)
+	defer expire.Stop()
 
-	log.Printf("listening on %s\n", eng.Me.Port)
+	log.Printf("listening on %s\n", eng.Me().Port)
 	var done bool
 	for !done {
 		select {
 		case <-ctx.Done():
 			done = true // exit for loop
 
-		default:
-			b := make([]byte, maxBufferSize)
-			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-			_, addr, errRead := conn.ReadFrom(b) // blocking read
-			if errRead == nil {
-				go processData(b, addr.String(), eng.queue)
-			} else {
-				// expect io timeout error on read
-				if neterr, ok := errRead.(net.Error); ok && !neterr.Timeout() {
-					log.Println(neterr)
-				}
+		case now := <-expire.C:
+			reassembler.Expire(now)
+
+		case p, ok := <-eng.transport.Receive():
+			if !ok {
+				done = true
+				break
+			}
+
+			if isSTUN(p.Data) {
+				go eng.processSTUN(p.Data, p.Addr)
+				break
+			}
+
+			data, err := reassembler.Add(p.Addr, p.Data)
+			if err != nil {
+				eng.emit(DecodeError, "", nil, "packet from %s: %s", p.Addr, err)
+			} else if data != nil {
+				go eng.processData(data, p.Addr)
 			}
 		}
 	}
 
 	log.Println("exiting listener")
-	return err
 }
 
 // processData transforms []byte to Message and enqueues it for processing.
-func processData(b []byte, addr string, msgQueue chan *Message) {
-	var m Message
-	m.addr = addr
-
-	buf := bytes.NewBuffer(b)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&m)
-
+func (eng *ChatEngine) processData(b []byte, addr string) {
+	m, err := decodeMessage(b, addr)
 	if err != nil {
-		log.Println(err)
+		eng.emit(DecodeError, "", nil, "message from %s: %s", addr, err)
 		return
 	}
 
-	msgQueue <- &m
+	eng.queue <- m
+}
+
+// decodeMessage transforms []byte received from addr to Message.
+func decodeMessage(b []byte, addr string) (*Message, error) {
+	m := &Message{addr: addr}
+
+	buf := bytes.NewBuffer(b)
+	dec := gob.NewDecoder(buf)
+	if err := dec.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
 )
 
 func main() {
 	meProfile := flag.String("profile", "", "profile")
 	contactsFile := flag.String("contacts", "", "contacts")
+	outboxFile := flag.String("outbox", "", "messages waiting for delivery")
 	privKeyFile := flag.String("key", "", "private key")
+	network := flag.String("transport", "udp", "network transport (udp or tcp)")
+	keyPolicy := flag.String("keypolicy", "quarantine", "action when a contact's key changes (reject, quarantine or accept)")
+	noise := flag.Bool("noise", false, "begin sessions with a Noise XX handshake")
+	rendezvous := flag.String("rendezvous", "", "rendezvous server address (host:port)")
+	serveRendezvous := flag.String("serve-rendezvous", "", "run a rendezvous and STUN server on port instead of chatting")
+	relay := flag.String("relay", "", "relay server address (host:port) holding messages for offline contacts")
+	serveRelay := flag.String("serve-relay", "", "run a relay server on tcp port instead of chatting")
+	advertise := flag.Bool("advertise", false, "advertise your profile on the local network with multicast DNS")
+	portMap := flag.Bool("portmap", false, "map the listening port on the router with PCP, NAT-PMP or UPnP")
+	stunServers := flag.String("stun", "", "comma separated STUN servers (host:port) which discover your external address. defaults to the rendezvous server")
 	flag.Parse()
 
 	// log stuff
@@ -29,7 +41,34 @@ func main() {
 	log.SetPrefix("  ")
 	enableLog(true)
 
-	app := NewReplApp(*meProfile, *contactsFile, *privKeyFile, Color(os.Stdout, Green))
+	if *serveRendezvous != "" {
+		runRendezvousServer(*network, *serveRendezvous)
+		return
+	}
+	if *serveRelay != "" {
+		runRelayServer(*serveRelay)
+		return
+	}
+
+	stun := splitList(*stunServers)
+	if len(stun) == 0 && *rendezvous != "" {
+		stun = []string{*rendezvous} // the rendezvous server also answers STUN
+	}
+
+	app := NewReplApp(ReplConfig{
+		ProfileFile:  *meProfile,
+		ContactsFile: *contactsFile,
+		OutboxFile:   *outboxFile,
+		KeyFile:      *privKeyFile,
+		Transport:    *network,
+		KeyPolicy:    *keyPolicy,
+		Noise:        *noise,
+		Rendezvous:   *rendezvous,
+		Relay:        *relay,
+		STUNServers:  stun,
+		PortMap:      *portMap,
+		Advertise:    *advertise,
+	}, Color(os.Stdout, Green))
 	app.Run()
 
 	// doing a "bot"
@@ -45,10 +84,63 @@ func main() {
 	// }()
 	// time.Sleep(100 * time.Millisecond) // give 'bot' chance to run
 
-	time.Sleep(500 * time.Millisecond)
 	log.Println("exiting program")
 }
 
+// runRendezvousServer serves rendezvous clients on port until interrupted.
+func runRendezvousServer(network, port string) {
+	transport, err := NewTransport(network, port)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	rs, err := NewRendezvousServer(transport)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Printf("rendezvous server listening on %s port %s\n", network, port)
+	rs.Run(ctx)
+}
+
+// runRelayServer serves relay clients on tcp port until interrupted.
+func runRelayServer(port string) {
+	rs, err := NewRelayServer(port)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	log.Printf("relay server listening on tcp port %s\n", port)
+	rs.Run(ctx)
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 // Color constants.
 const (
 	wrapper       = "\x1B[%sm"
@@ -88,16 +180,3 @@ type scw struct {
 func (w scw) Write(b []byte) (n int, err error) {
 	return w.writer.Write([]byte(w.color + string(b) + reset))
 }
-
-// GetIP gets the client's external IP address using an external webservice.
-func GetIP() (ip string, err error) {
-	// uses just amazon, but could use multiple/alt
-	resp, err := http.Get("http://checkip.amazonaws.com/")
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	_, err = fmt.Fscan(resp.Body, &ip)
-	return
-}
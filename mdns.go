@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local network discovery advertises this client's Profile with multicast
+// DNS service discovery (RFC 6762, RFC 6763), as an instance of the service
+// "_chat._udp.local." (or "_chat._tcp.local."). Its SRV record gives the
+// port, and its TXT record the signed Profile and key fingerprint:
+//
+//	txtvers=2 name=<name> addr=<address> port=<port> key=<base64 key>
+//	seq=<profile version> sig=<base64 signature> fp=<fingerprint>
+//
+// Profiles which fail Verify() are ignored. A valid one only shows that the
+// owner of the key signed it, not who that is: the key is not trusted
+// because it was advertised, and sessions are still established by the
+// usual handshake which authenticates it.
+
+// Multicast DNS parameters.
+const (
+	MDNSAddress     = "224.0.0.251:5353"
+	MDNSTTL         = 120 // seconds records may be cached
+	DiscoverTimeout = 2 * time.Second
+	mdnsPort        = 5353
+	mdnsMaxPacket   = 9000
+)
+
+// Peer is a client found on the local network by Discover().
+type Peer struct {
+	*Profile // as advertised and signed by the client
+	handle   Handle
+	address  string // address the client answered from
+	port     string // port of the client's SRV record
+}
+
+// Handle gets the Peer's handle, such as "d4".
+func (p *Peer) Handle() Handle { return p.handle }
+
+// Local gets a copy of the Peer's Profile with the address and port it was
+// found at, which reach it on the local network. The signature does not
+// cover those, so the copy is unsigned: it is only for sending a Request.
+func (p *Peer) Local() *Profile {
+	local := *p.Profile
+	local.Address, local.Port = p.address, p.port
+	local.Signature = nil
+	return &local
+}
+
+// mdnsService gets the DNS-SD service name of clients using the transport.
+func (eng *ChatEngine) mdnsService() string {
+	if _, ok := eng.transport.(*TCPTransport); ok {
+		return "_chat._tcp.local."
+	}
+	return "_chat._udp.local."
+}
+
+// mdnsLabel makes a name into a DNS label.
+func mdnsLabel(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '.' {
+			return '-'
+		}
+		return r
+	}, name)
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+// mdnsRecords makes the records which advertise me, listening on port.
+func (eng *ChatEngine) mdnsRecords(me *Profile, port uint16, ttl uint32) (ptr dnsRecord, rest []dnsRecord) {
+	service := eng.mdnsService()
+	fp := Fingerprint(me.PublicSigningKey)
+	instance := mdnsLabel(fmt.Sprintf("%s (%s)", me.Name, fp[:4])) + "." + service
+
+	host, _ := os.Hostname()
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		host = host[:i]
+	}
+	if host = mdnsLabel(host); host == "" {
+		host = "chat-" + fp[:4]
+	}
+	host += ".local."
+
+	ptr = dnsRecord{Name: service, Type: dnsTypePTR, Class: dnsClassIN, TTL: ttl, Target: instance}
+	rest = []dnsRecord{
+		{Name: instance, Type: dnsTypeSRV, Class: dnsClassIN, TTL: ttl, Target: host, Port: port},
+		{Name: instance, Type: dnsTypeTXT, Class: dnsClassIN, TTL: ttl, Text: []string{
+			"txtvers=2",
+			"name=" + me.Name,
+			"addr=" + me.Address,
+			"port=" + me.Port,
+			"key=" + base64.StdEncoding.EncodeToString(me.PublicSigningKey),
+			"seq=" + strconv.FormatUint(me.Seq, 10),
+			"sig=" + base64.StdEncoding.EncodeToString(me.Signature),
+			"fp=" + fp,
+		}},
+	}
+
+	ips, _ := LocalAddresses()
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		t := dnsTypeA
+		if ip.To4() == nil {
+			t = dnsTypeAAAA
+		}
+		rest = append(rest, dnsRecord{Name: host, Type: t, Class: dnsClassIN, TTL: ttl, IP: ip})
+	}
+	return ptr, rest
+}
+
+// Advertiser runs a loop which answers multicast DNS queries for this
+// client's service. It announces the client when started and says goodbye
+// when ctx is done.
+func (eng *ChatEngine) Advertiser(ctx context.Context) {
+	group, err := net.ResolveUDPAddr("udp4", MDNSAddress)
+	if err != nil {
+		log.Printf("mdns: %s\n", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("mdns: %s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	port, err := eng.listenPort()
+	if err != nil {
+		log.Printf("mdns: %s\n", err)
+		return
+	}
+
+	type packet struct {
+		data []byte
+		from *net.UDPAddr
+	}
+	packets := make(chan packet)
+	go func() {
+		defer close(packets)
+		for {
+			buf := make([]byte, mdnsMaxPacket)
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return // closed
+			}
+			select {
+			case packets <- packet{buf[:n], from}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	announce := func(ttl uint32) {
+		ptr, rest := eng.mdnsRecords(eng.Me(), uint16(port), ttl)
+		resp := &dnsMessage{Flags: dnsFlagResponse, Answers: append([]dnsRecord{ptr}, rest...)}
+		if err := mdnsSend(conn, group, resp); err != nil {
+			log.Printf("mdns: %s\n", err)
+		}
+	}
+	announce(MDNSTTL)
+	reannounce := time.NewTimer(time.Second) // in case the first was lost
+	defer reannounce.Stop()
+
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case <-reannounce.C:
+			announce(MDNSTTL)
+
+		case p, ok := <-packets:
+			if !ok {
+				done = true
+				break
+			}
+
+			q, err := parseDNS(p.data)
+			if err != nil || q.Flags&dnsFlagQR != 0 {
+				continue // responses are not of interest
+			}
+			resp := eng.mdnsAnswer(q, uint16(port))
+			if resp == nil {
+				continue
+			}
+
+			to := group
+			if p.from.Port != mdnsPort { // legacy unicast query. see RFC 6762 6.7
+				to = p.from
+				resp.ID = q.ID
+				resp.Questions = q.Questions
+				for i := range resp.Answers {
+					resp.Answers[i].TTL = 10
+				}
+			}
+			if err := mdnsSend(conn, to, resp); err != nil {
+				log.Printf("mdns: %s\n", err)
+			}
+		}
+	}
+
+	announce(0) // goodbye
+	log.Println("exiting advertiser")
+}
+
+// mdnsAnswer answers a query about this client's service, or returns nil.
+func (eng *ChatEngine) mdnsAnswer(q *dnsMessage, port uint16) *dnsMessage {
+	ptr, rest := eng.mdnsRecords(eng.Me(), port, MDNSTTL)
+
+	resp := &dnsMessage{Flags: dnsFlagResponse}
+	for _, question := range q.Questions {
+		class := question.Class & dnsClassMask
+		if class != dnsClassIN && class != dnsClassANY {
+			continue
+		}
+		if strings.EqualFold(question.Name, ptr.Name) &&
+			(question.Type == dnsTypePTR || question.Type == dnsTypeANY) {
+			resp.Answers = append([]dnsRecord{ptr}, resp.Answers...)
+			continue
+		}
+		for _, r := range rest {
+			if strings.EqualFold(question.Name, r.Name) &&
+				(question.Type == r.Type || question.Type == dnsTypeANY) {
+				resp.Answers = append(resp.Answers, r)
+			}
+		}
+	}
+	if len(resp.Answers) == 0 {
+		return nil
+	}
+
+	// the other records of the instance, so a single query suffices
+	for _, r := range rest {
+		if !containsRecord(resp.Answers, r) {
+			resp.Additionals = append(resp.Additionals, r)
+		}
+	}
+	return resp
+}
+
+func containsRecord(records []dnsRecord, r dnsRecord) bool {
+	for _, a := range records {
+		if a.Type == r.Type && strings.EqualFold(a.Name, r.Name) && a.IP.Equal(r.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func mdnsSend(conn *net.UDPConn, to *net.UDPAddr, m *dnsMessage) error {
+	b, err := m.pack()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteToUDP(b, to)
+	return err
+}
+
+// Discover queries the local network for other clients for timeout, and
+// replaces the list of Peers with those which answered.
+func (eng *ChatEngine) Discover(timeout time.Duration) ([]*Peer, error) {
+	group, err := net.ResolveUDPAddr("udp4", MDNSAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var id [2]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	service := eng.mdnsService()
+	query := &dnsMessage{
+		ID:        binary.BigEndian.Uint16(id[:]),
+		Questions: []dnsQuestion{{Name: service, Type: dnsTypePTR, Class: dnsClassIN}},
+	}
+	if err = mdnsSend(conn, group, query); err != nil {
+		return nil, err
+	}
+
+	var found []*Peer
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, mdnsMaxPacket)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // deadline
+		}
+		resp, err := parseDNS(buf[:n])
+		if err != nil || resp.Flags&dnsFlagQR == 0 {
+			continue
+		}
+		for _, p := range mdnsPeers(resp, service, from.IP) {
+			if !containsKey(found, p.PublicSigningKey) && !bytes.Equal(p.PublicSigningKey, eng.Me().PublicSigningKey) {
+				found = append(found, p)
+			}
+		}
+	}
+
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	eng.peers = eng.peers[:0]
+	for _, p := range found {
+		p.handle = eng.nextHandle("d")
+		eng.peers = append(eng.peers, p)
+	}
+	return append([]*Peer(nil), eng.peers...), nil
+}
+
+// mdnsPeers gets the Peers advertised as instances of service in resp, which
+// came from the address src. Instances without a valid signed Profile are
+// skipped.
+func mdnsPeers(resp *dnsMessage, service string, src net.IP) []*Peer {
+	records := resp.Records()
+	find := func(name string, t uint16) (dnsRecord, bool) {
+		for _, r := range records {
+			if r.Type == t && strings.EqualFold(r.Name, name) {
+				return r, true
+			}
+		}
+		return dnsRecord{}, false
+	}
+
+	var peers []*Peer
+	for _, ptr := range records {
+		if ptr.Type != dnsTypePTR || !strings.EqualFold(ptr.Name, service) || ptr.TTL == 0 {
+			continue
+		}
+		srv, ok := find(ptr.Target, dnsTypeSRV)
+		if !ok {
+			continue
+		}
+		txt, ok := find(ptr.Target, dnsTypeTXT)
+		if !ok {
+			continue
+		}
+
+		p := new(Profile)
+		var fp string
+		for _, s := range txt.Text {
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "name":
+				p.Name = kv[1]
+			case "addr":
+				p.Address = kv[1]
+			case "port":
+				p.Port = kv[1]
+			case "key":
+				key, err := base64.StdEncoding.DecodeString(kv[1])
+				if err == nil && len(key) == ed25519.PublicKeySize {
+					p.PublicSigningKey = key
+				}
+			case "seq":
+				p.Seq, _ = strconv.ParseUint(kv[1], 10, 64)
+			case "sig":
+				p.Signature, _ = base64.StdEncoding.DecodeString(kv[1])
+			case "fp":
+				fp = kv[1]
+			}
+		}
+		if p.PublicSigningKey == nil || fp != Fingerprint(p.PublicSigningKey) {
+			continue
+		}
+		if err := p.Verify(); err != nil {
+			log.Printf("mdns: %s\n", err)
+			continue
+		}
+
+		// the address the response came from is known to be reachable
+		ip := src
+		if a, ok := find(srv.Target, dnsTypeA); ip == nil && ok {
+			ip = a.IP
+		}
+		if ip == nil {
+			continue
+		}
+		peers = append(peers, &Peer{Profile: p, address: ip.String(), port: fmt.Sprint(srv.Port)})
+	}
+	return peers
+}
+
+func containsKey(peers []*Peer, key ed25519.PublicKey) bool {
+	for _, p := range peers {
+		if bytes.Equal(p.PublicSigningKey, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers gets a copy of the Peers found by the last Discover().
+func (eng *ChatEngine) Peers() []*Peer {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+	return append([]*Peer(nil), eng.peers...)
+}
+
+// LookupPeer finds a Peer by handle. Peers are not found by name, which
+// anyone on the local network can advertise.
+func (eng *ChatEngine) LookupPeer(handle string) (*Peer, error) {
+	for _, p := range eng.Peers() {
+		if p.handle == Handle(handle) {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found", handle)
+}
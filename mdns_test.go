@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// mdnsExchange asks eng for its service, returning the packed and parsed
+// answer.
+func mdnsExchange(t *testing.T, eng *ChatEngine) *dnsMessage {
+	t.Helper()
+	q := &dnsMessage{Questions: []dnsQuestion{{Name: eng.mdnsService(), Type: dnsTypePTR, Class: dnsClassIN}}}
+	resp := eng.mdnsAnswer(q, 5190)
+	if resp == nil {
+		t.Fatal("no answer")
+	}
+	b, err := resp.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = parseDNS(b); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestMDNSSignedProfile(t *testing.T) {
+	a := newTestEngine(t, NewMemoryNetwork(), "alice")
+	src := net.ParseIP("192.168.1.9")
+
+	peers := mdnsPeers(mdnsExchange(t, a), a.mdnsService(), src)
+	if len(peers) != 1 {
+		t.Fatalf("found %d peers", len(peers))
+	}
+	p := peers[0]
+	if err := p.Verify(); err != nil || !p.SameFields(a.Me()) {
+		t.Fatalf("advertised profile %s differs: %v", p.Profile, err)
+	}
+	if local := p.Local(); local.FullAddress() != "192.168.1.9:5190" || local.Signature != nil {
+		t.Errorf("local profile is %s", local)
+	}
+
+	// a profile changed by someone else is ignored
+	resp := mdnsExchange(t, a)
+	for i, r := range resp.Additionals {
+		if r.Type != dnsTypeTXT {
+			continue
+		}
+		for j, s := range r.Text {
+			if strings.HasPrefix(s, "name=") {
+				resp.Additionals[i].Text[j] = "name=mallory"
+			}
+		}
+	}
+	if peers := mdnsPeers(resp, a.mdnsService(), src); len(peers) != 0 {
+		t.Fatalf("found %s with a forged name", peers[0].Profile)
+	}
+}
+
+func TestLookupPeer(t *testing.T) {
+	eng := newTestEngine(t, NewMemoryNetwork(), "alice")
+	eng.peers = []*Peer{{Profile: &Profile{Name: "bob"}, handle: "d1"}}
+
+	if p, err := eng.LookupPeer("d1"); err != nil || p.Name != "bob" {
+		t.Fatalf("looking up d1: %v", err)
+	}
+	if _, err := eng.LookupPeer("bob"); err == nil {
+		t.Fatal("found a discovered peer by its advertised name")
+	}
+}
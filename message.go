@@ -5,15 +5,25 @@ import (
 	"fmt"
 )
 
-// Message always uses AES256 and HMAC-SHA256.
+// Message is the unit of data sent between clients. Requests and Responses
+// are signed with Ed25519. Texts are sealed with XChaCha20-Poly1305 using a
+// message key from the session's ratchet, and Acks and Closes using its
+// control key, with Version, Type, Route and Header as associated data.
 // Generally use Package*() functions to create a new Message.
 type Message struct {
+	Version   byte        // wire format version. see WireVersion
 	Payload   []byte      // chat request/response/text
-	Signature []byte      // HMAC-SHA256 hash
+	Signature []byte      // Ed25519 signature (Request/Response only)
 	Type      PayloadType // used to process message into higher level types
+	Route     []byte      // session routing tag (sealed types only). see RouteTag()
+	Header    []byte      // ratchet header (Text only)
 	addr      string      // 'true' ip address where the message came from
 }
 
+// WireVersion is the Message format produced by this client. Messages with
+// any other version are rejected.
+const WireVersion byte = 4
+
 // PayloadType indicates the type encrypted in a Message.
 type PayloadType byte
 
@@ -22,19 +32,50 @@ const (
 	PayloadText PayloadType = iota
 	PayloadRequest
 	PayloadResponse
+	PayloadAck
+	PayloadClose
+	PayloadHandshake
+	PayloadProfile
+	PayloadRendezvous
+	PayloadPunch // opens a path through NAT. carries nothing
 )
 
+// associatedData gets the unencrypted Message fields which are authenticated
+// along with a sealed Payload.
+func (m *Message) associatedData() []byte {
+	ad := append([]byte{m.Version, byte(m.Type), byte(len(m.Route))}, m.Route...)
+	return append(ad, m.Header...)
+}
+
+// checkVersion returns an error if the Message has an unsupported wire format.
+func (m *Message) checkVersion() error {
+	if m.Version != WireVersion {
+		return fmt.Errorf("unsupported message version %d", m.Version)
+	}
+	return nil
+}
+
 // GetRequest attempts to decrypt and decode the Message into a Request.
 func (m *Message) GetRequest() (req *Request, err error) {
+	if err = m.checkVersion(); err != nil {
+		return
+	}
+
 	req, ok := gobDecode(m.Payload, m.Type).(*Request)
 	if !ok {
 		err = fmt.Errorf("message type wasn't Request")
 		return
 	}
 
+	if req.Profile == nil || len(req.Profile.PublicSigningKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("request has no valid profile")
+	}
 	if !ValidSignatureEd25519(m.Signature, m.Payload, req.Profile.PublicSigningKey) {
 		return nil, fmt.Errorf("invalid signature")
 	}
+	if err = req.Profile.Verify(); err != nil {
+		return nil, err
+	}
 
 	return
 }
@@ -42,31 +83,78 @@ func (m *Message) GetRequest() (req *Request, err error) {
 // GetResponse attempts to decrypt and decode the Message into a Response.
 // SharedKey remains encrypted.
 func (m *Message) GetResponse() (resp *Response, err error) {
+	if err = m.checkVersion(); err != nil {
+		return
+	}
+
 	resp, ok := gobDecode(m.Payload, m.Type).(*Response)
 	if !ok {
 		err = fmt.Errorf("message type wasn't Response")
 		return
 	}
 
+	if resp.Profile == nil || len(resp.Profile.PublicSigningKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("response has no valid profile")
+	}
 	if !ValidSignatureEd25519(m.Signature, m.Payload, resp.Profile.PublicSigningKey) {
 		return nil, fmt.Errorf("invalid signature")
 	}
+	if err = resp.Profile.Verify(); err != nil {
+		return nil, err
+	}
 
 	return
 }
 
-// GetText attempts to decrypt and decode the Message into a Text (using shared key).
-func (m *Message) GetText(sharedKey []byte) (t *Text, err error) {
-	plaintext, err := AESDecrypt(m.Payload, sharedKey)
-	if err != nil {
+// GetHandshake attempts to decode the Message into a Handshake. Handshakes
+// are not signed; the handshake protocol authenticates them.
+func (m *Message) GetHandshake() (h *Handshake, err error) {
+	if err = m.checkVersion(); err != nil {
+		return
+	}
+
+	h, ok := gobDecode(m.Payload, m.Type).(*Handshake)
+	if !ok {
+		err = fmt.Errorf("message type wasn't Handshake")
+		return
+	}
+
+	return
+}
+
+// GetRendezvous attempts to decode the Message into a Rendezvous. Its Key,
+// if any, must be an Ed25519 public key, and if the Message is signed, the
+// signature must be valid for it.
+func (m *Message) GetRendezvous() (r *Rendezvous, err error) {
+	if err = m.checkVersion(); err != nil {
 		return
 	}
-	fmt.Printf("gettext plaintext %x\n", plaintext)
 
-	if !ValidSignatureHS256(m.Signature, plaintext, sharedKey) {
+	r, ok := gobDecode(m.Payload, m.Type).(*Rendezvous)
+	if !ok {
+		err = fmt.Errorf("message type wasn't Rendezvous")
+		return
+	}
+
+	if len(r.Key) != 0 && len(r.Key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid rendezvous key")
+	}
+	if m.Signature != nil && !ValidSignatureEd25519(m.Signature, m.Payload, r.Key) {
 		return nil, fmt.Errorf("invalid signature")
 	}
 
+	return
+}
+
+// GetText attempts to decrypt and decode the Message into a Text (using the
+// message key for its Header). It fails if the Payload or any of the
+// associated header fields were modified.
+func (m *Message) GetText(messageKey []byte) (t *Text, err error) {
+	plaintext, err := m.open(messageKey)
+	if err != nil {
+		return
+	}
+
 	t, ok := gobDecode(plaintext, m.Type).(*Text)
 	if !ok {
 		err = fmt.Errorf("message type wasn't Text")
@@ -76,6 +164,68 @@ func (m *Message) GetText(sharedKey []byte) (t *Text, err error) {
 	return
 }
 
+// GetAck attempts to decrypt and decode the Message into an Ack (using control key).
+func (m *Message) GetAck(controlKey []byte) (a *Ack, err error) {
+	plaintext, err := m.open(controlKey)
+	if err != nil {
+		return
+	}
+
+	a, ok := gobDecode(plaintext, m.Type).(*Ack)
+	if !ok {
+		err = fmt.Errorf("message type wasn't Ack")
+		return
+	}
+
+	return
+}
+
+// GetClose attempts to decrypt and decode the Message into a SessionClose (using control key).
+func (m *Message) GetClose(controlKey []byte) (c *SessionClose, err error) {
+	plaintext, err := m.open(controlKey)
+	if err != nil {
+		return
+	}
+
+	c, ok := gobDecode(plaintext, m.Type).(*SessionClose)
+	if !ok {
+		err = fmt.Errorf("message type wasn't SessionClose")
+		return
+	}
+
+	return
+}
+
+// GetProfile attempts to decrypt and decode the Message into a Profile
+// (using control key) and checks the Profile's signature.
+func (m *Message) GetProfile(controlKey []byte) (p *Profile, err error) {
+	plaintext, err := m.open(controlKey)
+	if err != nil {
+		return
+	}
+
+	p, ok := gobDecode(plaintext, m.Type).(*Profile)
+	if !ok {
+		err = fmt.Errorf("message type wasn't Profile")
+		return
+	}
+
+	if err = p.Verify(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// open decrypts and authenticates a sealed Payload.
+func (m *Message) open(key []byte) (plaintext []byte, err error) {
+	if err = m.checkVersion(); err != nil {
+		return
+	}
+
+	return AEADOpen(m.Payload, key, m.associatedData())
+}
+
 // PackageRequest makes it easier to make a Message from Request.
 func PackageRequest(req *Request, privSigningKey ed25519.PrivateKey) (m *Message, err error) {
 	data, err := gobEncode(req)
@@ -84,6 +234,7 @@ func PackageRequest(req *Request, privSigningKey ed25519.PrivateKey) (m *Message
 	}
 
 	m = &Message{
+		Version:   WireVersion,
 		Payload:   data,
 		Signature: SignEd25519(privSigningKey, data),
 		Type:      PayloadRequest,
@@ -100,6 +251,7 @@ func PackageResponse(resp *Response, privSigningKey ed25519.PrivateKey) (m *Mess
 	}
 
 	m = &Message{
+		Version:   WireVersion,
 		Payload:   data,
 		Signature: SignEd25519(privSigningKey, data),
 		Type:      PayloadResponse,
@@ -108,36 +260,94 @@ func PackageResponse(resp *Response, privSigningKey ed25519.PrivateKey) (m *Mess
 	return
 }
 
-// PackageText makes it easier to make a Message from Text.
-//
-// Encryption is done using AES256 in cipher block chaining (CBC) mode, and
-// signing is done using HMAC-SHA256. Shared key should be 32 bytes to do
-// AES256. Use GenerateAES256Key() to do so.
-func PackageText(t *Text, sharedKey []byte) (m *Message, err error) {
-	plaintext, err := gobEncode(t)
+// PackageHandshake makes it easier to make a Message from Handshake.
+func PackageHandshake(h *Handshake) (m *Message, err error) {
+	data, err := gobEncode(h)
 	if err != nil {
 		return
 	}
 
-	// Use encrypt-and-mac scheme
-	ciphertext, err := AESEncrypt(plaintext, sharedKey)
+	m = &Message{
+		Version: WireVersion,
+		Payload: data,
+		Type:    PayloadHandshake,
+	}
+
+	return
+}
+
+// PackageRendezvous makes it easier to make a Message from Rendezvous. The
+// Message is signed if privSigningKey is not nil.
+func PackageRendezvous(r *Rendezvous, privSigningKey ed25519.PrivateKey) (m *Message, err error) {
+	data, err := gobEncode(r)
 	if err != nil {
 		return
 	}
 
-	// bodge to make sure the "plaintext" used in signing is padded (per AES)
-	// so that the padded-then-decrypted plaintext on the other end will
-	// pass signature validation
-	plaintext, err = AESDecrypt(ciphertext, sharedKey)
+	m = &Message{
+		Version: WireVersion,
+		Payload: data,
+		Type:    PayloadRendezvous,
+	}
+	if privSigningKey != nil {
+		m.Signature = SignEd25519(privSigningKey, data)
+	}
+
+	return
+}
+
+// PackagePunch makes a Message which only serves to open a path through
+// NAT to the receiver.
+func PackagePunch() *Message {
+	return &Message{Version: WireVersion, Type: PayloadPunch}
+}
+
+// PackageText makes it easier to make a Message from Text.
+//
+// The Text is sealed with XChaCha20-Poly1305, which both encrypts and
+// authenticates it. The Message header (Version, Type, Route, Header) is
+// authenticated as associated data. Message key must be 32 bytes and used
+// only once. Route is the receiving Session's routing tag, and header the
+// ratchet header from which the receiver finds the message key.
+func PackageText(t *Text, messageKey, header, route []byte) (m *Message, err error) {
+	return packageSealed(t, PayloadText, messageKey, header, route)
+}
+
+// PackageAck makes it easier to make a Message from Ack. It is sealed the
+// same way as a Text, but with the session's control key.
+func PackageAck(a *Ack, controlKey, route []byte) (m *Message, err error) {
+	return packageSealed(a, PayloadAck, controlKey, nil, route)
+}
+
+// PackageClose makes it easier to make a Message from SessionClose. It is
+// sealed the same way as a Text, so only the other client of the session
+// can produce a valid one.
+func PackageClose(c *SessionClose, controlKey, route []byte) (m *Message, err error) {
+	return packageSealed(c, PayloadClose, controlKey, nil, route)
+}
+
+// PackageProfile makes it easier to make a Message from an updated Profile.
+// It is sealed the same way as a SessionClose.
+func PackageProfile(p *Profile, controlKey, route []byte) (m *Message, err error) {
+	return packageSealed(p, PayloadProfile, controlKey, nil, route)
+}
+
+// packageSealed encodes v and seals it into a Message of type plType.
+func packageSealed(v interface{}, plType PayloadType, key, header, route []byte) (m *Message, err error) {
+	plaintext, err := gobEncode(v)
 	if err != nil {
 		return
 	}
-	fmt.Printf("pkgtext plaintext %x\n", plaintext)
 
 	m = &Message{
-		Payload:   ciphertext,
-		Signature: SignHS256(plaintext, sharedKey),
-		Type:      PayloadText,
+		Version: WireVersion,
+		Type:    plType,
+		Route:   route,
+		Header:  header,
+	}
+	m.Payload, err = AEADSeal(plaintext, key, m.associatedData())
+	if err != nil {
+		return nil, err
 	}
 
 	return
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestTextTampering(t *testing.T) {
+	key, route, header := fill(1, 32), []byte("route"), []byte("header")
+	text := &Text{Message: "hi\x00\x00", Seq: 1, TimeStamp: Now()}
+	sealed, err := PackageText(text, key, header, route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// trailing zeros are kept
+	got, err := sealed.GetText(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Message != text.Message || got.Seq != text.Seq {
+		t.Fatalf("opened %q, seq %d", got.Message, got.Seq)
+	}
+
+	tamper := map[string]func(m *Message){
+		"payload": func(m *Message) { m.Payload[len(m.Payload)-1] ^= 1 },
+		"nonce":   func(m *Message) { m.Payload[0] ^= 1 },
+		"short":   func(m *Message) { m.Payload = m.Payload[:20] },
+		"route":   func(m *Message) { m.Route = []byte("rout") },
+		"header":  func(m *Message) { m.Header = append(m.Header, 0) },
+		"moved":   func(m *Message) { m.Route, m.Header = []byte("routeh"), []byte("eader") },
+		"type":    func(m *Message) { m.Type = PayloadAck },
+		"version": func(m *Message) { m.Version-- },
+	}
+	for name, change := range tamper {
+		m := *sealed
+		m.Payload = append([]byte(nil), sealed.Payload...)
+		change(&m)
+		if _, err := m.GetText(key); err == nil {
+			t.Errorf("opened a Text with a tampered %s", name)
+		}
+	}
+
+	if _, err := sealed.GetText(fill(2, 32)); err == nil {
+		t.Error("opened a Text with the wrong key")
+	}
+}
+
+func TestSignedProfiles(t *testing.T) {
+	priv, pub, err := Ed25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := &Profile{Name: "alice", Address: "a", Port: "1", PublicSigningKey: pub, Seq: 1}
+	if err := valid.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	tampered := *valid
+	tampered.Address = "mallory"
+
+	for name, p := range map[string]*Profile{
+		"no profile":       nil,
+		"short key":        {Name: "alice", PublicSigningKey: pub[:3]},
+		"unsigned profile": {Name: "alice", PublicSigningKey: pub},
+		"bad signature":    &tampered,
+		"valid":            valid,
+	} {
+		req, err := PackageRequest(&Request{Profile: p, PublicSessionKey: fill(1, 32), TimeStamp: Now()}, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := PackageResponse(&Response{Profile: p, PublicSessionKey: fill(1, 32), TimeStamp: Now()}, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, reqErr := req.GetRequest()
+		_, respErr := resp.GetResponse()
+		if ok := p == valid; ok != (reqErr == nil) || ok != (respErr == nil) {
+			t.Errorf("%s: request: %v, response: %v", name, reqErr, respErr)
+		}
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"log"
+	"time"
 )
 
 // MessageProcessor runs a loop consuming, decoding, and processing
-// Messages received from Listener().
+// Messages received from Listener(). Resulting state changes are
+// reported to the UI on Events.
 func (eng *ChatEngine) MessageProcessor(ctx context.Context) {
 	var done bool
 	for !done {
@@ -20,39 +22,37 @@ func (eng *ChatEngine) MessageProcessor(ctx context.Context) {
 			case PayloadRequest:
 				request, err := m.GetRequest()
 				if err != nil {
-					log.Println(err)
+					eng.emit(DecodeError, "", m, "request from %s: %s", m.addr, err)
 					continue
 				}
 
-				eng.AddRequest(request)
-				// TODO: event to UI
-				log.Printf("got request from %s whose true address is %s\n", request.Profile, m.addr)
+				eng.receiveRequest(request, m.addr)
 
 			case PayloadResponse:
 				resp, err := m.GetResponse()
 				if err != nil {
-					log.Println(err)
+					eng.emit(DecodeError, "", m, "response from %s: %s", m.addr, err)
 					continue
 				}
 
 				// when get response:
 				// 1. find session with matching session ID
-				// 2. "upgrade" session to Active. fill in SharedKey and OtherPubKey
-				var sess *Session
-				for _, s := range eng.Sessions {
-					if s != nil && s.ID == resp.SessionID {
-						sess = s // found correct session
-						break
+				// 2. "upgrade" session to Active. derive its keys and fill in OtherPubKey
+				sess, ok := eng.sessionByID(resp.SessionID)
+				if ok {
+					if !eng.checkResponder(resp.Profile, sess.Handle(), resp) {
+						continue
 					}
-				}
 
-				if sess != nil {
 					// TODO: ?? modify contact list with (potentially) updated Profile?
-					// TODO: event to UI
 					if err := sess.Upgrade(resp); err == nil {
-						log.Printf("began session with %s\n", sess.Other)
+						eng.AddRoute(sess)
+						eng.emit(SessionUpgraded, sess.Handle(), sess,
+							"began session with %s", sess.Peer())
+						eng.deliverPending(sess)
 					} else {
-						log.Printf("couldn't upgrade session %d with response from %s: %s\n",
+						eng.emit(Error, sess.Handle(), sess,
+							"couldn't upgrade session %d with response from %s: %s",
 							sess.ID, resp.Profile, err)
 					}
 				} else {
@@ -60,37 +60,144 @@ func (eng *ChatEngine) MessageProcessor(ctx context.Context) {
 				}
 
 			case PayloadText:
+				// the routing tag identifies the session, so unknown tags are
+				// dropped before doing any decryption.
+				sess, ok := eng.routeSession(m.Route)
+				if !ok {
+					log.Println("got non-sessioned message")
+					continue
+				}
 
-				// only way to match a Message containing Text to a Session is to
-				// try decrypting the message with each session shared key until
-				// one works... =/
-				var sess *Session
-				var sessNumber int
-				var text *Text
-				for i, s := range eng.Sessions {
-					if s == nil || s.Status != Active {
-						continue
+				text, err := sess.OpenText(m)
+				if re, ok := err.(*replayError); ok {
+					// ack again, since the earlier ack may have been lost
+					if re.Seq != 0 {
+						if err := sess.SendAck(re.Seq); err != nil {
+							eng.emit(SendFailed, sess.Handle(), nil, "ack to %s: %s", sess.Peer(), err)
+						}
 					}
+					log.Printf("dropped replayed message %d for session %s\n", re.Seq, sess.Handle())
+					continue
+				}
+				if err != nil {
+					eng.emit(DecodeError, "", m, "text from %s: %s", m.addr, err)
+					continue
+				}
 
-					t, err := m.GetText(s.SharedKey)
-					if err == nil {
-						sess = s
-						sessNumber = i
-						text = t
-						break
-					}
+				accepted := sess.PushIn(text)
+
+				// the text is authentic and new, so its source is where the
+				// other client can now be reached
+				if accepted && eng.Roaming && sess.Roam(m.addr, text.Seq, time.Now()) {
+					eng.emit(PeerMoved, sess.Handle(), sess, "%s moved to %s", sess.Peer(), m.addr)
 				}
+				eng.deliverPending(sess)
 
-				if sess != nil {
-					sess.PushIn(text)
-					// TODO: event to UI
-					log.Printf("new message for session %d\n", sessNumber)
-				} else {
-					log.Println("got non-sessioned message")
+				// ack even duplicates, since the earlier ack may have been lost
+				if err := sess.SendAck(text.Seq); err != nil {
+					eng.emit(SendFailed, sess.Handle(), nil, "ack to %s: %s", sess.Peer(), err)
+				}
+
+				if !accepted {
+					log.Printf("dropped replayed message %d for session %s\n",
+						text.Seq, sess.Handle())
+					continue
+				}
+				eng.emit(TextReceived, sess.Handle(), text, "new message from %s", text.From())
+
+			case PayloadAck:
+				sess, ok := eng.routeSession(m.Route)
+				if !ok {
+					log.Println("got non-sessioned ack")
+					continue
 				}
+
+				ack, err := sess.OpenAck(m)
+				if err != nil {
+					eng.emit(DecodeError, "", m, "ack from %s: %s", m.addr, err)
+					continue
+				}
+
+				sess.Acknowledge(ack.Seq)
+				eng.deliverPending(sess)
+
+			case PayloadClose:
+				sess, ok := eng.routeSession(m.Route)
+				if !ok {
+					log.Println("got non-sessioned close")
+					continue
+				}
+
+				if _, err := sess.OpenClose(m); err != nil {
+					eng.emit(DecodeError, "", m, "close from %s: %s", m.addr, err)
+					continue
+				}
+
+				if eng.RemoveSession(sess.Handle()) {
+					sess.Close()
+					eng.emit(SessionClosed, sess.Handle(), sess, "%s ended the session", sess.Peer())
+				}
+
+			case PayloadHandshake:
+				eng.processHandshake(m)
+
+			case PayloadRendezvous:
+				eng.processRendezvous(m)
+
+			case PayloadPunch:
+				log.Printf("punch from %s\n", m.addr)
+
+			case PayloadProfile:
+				sess, ok := eng.routeSession(m.Route)
+				if !ok {
+					log.Println("got non-sessioned profile")
+					continue
+				}
+
+				p, err := sess.OpenProfile(m)
+				if err != nil {
+					eng.emit(DecodeError, "", m, "profile from %s: %s", m.addr, err)
+					continue
+				}
+				if err := eng.acceptProfile(p); err != nil {
+					eng.emit(Error, sess.Handle(), p, "profile rejected: %s", err)
+					continue
+				}
+				sess.SetPeer(p)
+				eng.deliverPending(sess)
 			}
 		}
 	}
 
 	log.Println("exiting message processor")
 }
+
+// receiveRequest adds a Request from the client at addr, unless the key
+// change policy says otherwise.
+func (eng *ChatEngine) receiveRequest(request *Request, addr string) {
+	request.addr = addr
+	if c, changed := eng.checkIdentity(request.Profile); changed {
+		switch eng.KeyPolicy {
+		case AcceptKeyChange:
+			eng.pinKey(c, request.Profile.PublicSigningKey)
+			eng.emit(KeyChanged, "", request, "%s has a new key. accepted new key", request.Profile)
+		case QuarantineKeyChange:
+			request.quarantined = true
+			h := eng.AddRequest(request)
+			eng.emit(KeyChanged, h, request, "%s has a new key. request quarantined", request.Profile)
+			return
+		default:
+			eng.emit(KeyChanged, "", request, "%s has a new key. request rejected", request.Profile)
+			return
+		}
+	}
+
+	if err := eng.acceptProfile(request.Profile); err != nil {
+		eng.emit(Error, "", request, "request rejected: %s", err)
+		return
+	}
+
+	h := eng.AddRequest(request)
+	eng.emit(RequestReceived, h, request, "got request from %s whose true address is %s",
+		request.Profile, addr)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// This file implements port mapping with PCP (RFC 6887), falling back to its
+// predecessor NAT-PMP (RFC 6886) for gateways which only speak that. Both are
+// spoken over UDP to port 5351 of the gateway.
+//
+// A PCP MAP request is a 24 byte header followed by 36 bytes of MAP data:
+//
+//	version   1 byte    2
+//	opcode    1 byte    1 (MAP). responses set the high bit
+//	reserved  2 bytes   responses: reserved byte, then result code
+//	lifetime  4 bytes   seconds. 0 deletes the mapping
+//	client    16 bytes  requests: client IP. responses: epoch, reserved
+//	nonce     12 bytes  random. repeated to renew or delete the mapping
+//	protocol  1 byte    IANA protocol number
+//	reserved  3 bytes
+//	internal  2 bytes   internal port
+//	external  2 bytes   suggested or assigned external port
+//	address   16 bytes  suggested or assigned external IP
+const (
+	PMPPort        = "5351"
+	pmpVersion     = 0
+	pcpVersion     = 2
+	pcpOpAnnounce  = 0
+	pcpOpMap       = 1
+	pcpHeaderSize  = 24
+	pcpMapSize     = 36
+	pmpOpAddress   = 0
+	pmpOpMapUDP    = 1
+	pmpOpMapTCP    = 2
+	pmpResponseBit = 0x80
+	pmpRetries     = 4                      // attempts for each request
+	pmpRetryDelay  = 250 * time.Millisecond // doubles after each attempt
+)
+
+// PMPMapper maps ports on a gateway with PCP or NAT-PMP.
+type PMPMapper struct {
+	gateway string // host:port
+	pmp     bool   // gateway only speaks NAT-PMP
+	nonce   [12]byte
+}
+
+// NewPMPMapper makes a PMPMapper for the gateway at full address gateway.
+func NewPMPMapper(gateway string) (*PMPMapper, error) {
+	m := &PMPMapper{gateway: gateway}
+	if _, err := rand.Read(m.nonce[:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *PMPMapper) String() string {
+	if m.pmp {
+		return "NAT-PMP gateway " + m.gateway
+	}
+	return "PCP gateway " + m.gateway
+}
+
+// Map asks the gateway to map an external port to internal port for
+// lifetime. A lifetime of 0 deletes the mapping.
+func (m *PMPMapper) Map(protocol string, internal int, lifetime time.Duration) (*PortMapping, error) {
+	if !m.pmp {
+		pm, err := m.mapPCP(protocol, internal, lifetime)
+		if err != errUnsupportedVersion {
+			return pm, err
+		}
+		m.pmp = true
+	}
+	return m.mapPMP(protocol, internal, lifetime)
+}
+
+// Unmap deletes a mapping made by Map.
+func (m *PMPMapper) Unmap(pm *PortMapping) error {
+	_, err := m.Map(pm.Protocol, pm.InternalPort, 0)
+	return err
+}
+
+// probe determines if the gateway speaks PCP or NAT-PMP, with a PCP ANNOUNCE
+// request which changes nothing.
+func (m *PMPMapper) probe() error {
+	conn, err := net.Dial("udp", m.gateway)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := make([]byte, pcpHeaderSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpAnnounce
+	copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+
+	resp, err := pmpExchange(conn, req, func(b []byte) bool {
+		return len(b) >= 4 && (b[0] == pmpVersion || b[0] == pcpVersion && b[1] == pmpResponseBit|pcpOpAnnounce)
+	})
+	if err != nil {
+		return err
+	}
+	m.pmp = resp[0] == pmpVersion
+	return nil
+}
+
+// errUnsupportedVersion is returned by a PCP request to a NAT-PMP gateway.
+var errUnsupportedVersion = fmt.Errorf("unsupported version")
+
+// mapPCP makes a PCP MAP request.
+func (m *PMPMapper) mapPCP(protocol string, internal int, lifetime time.Duration) (*PortMapping, error) {
+	proto, err := protocolNumber(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", m.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	client := conn.LocalAddr().(*net.UDPAddr).IP.To16()
+
+	req := make([]byte, pcpHeaderSize+pcpMapSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], client)
+	copy(req[24:36], m.nonce[:])
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:42], uint16(internal))
+	binary.BigEndian.PutUint16(req[42:44], uint16(internal)) // suggest the same port
+	copy(req[44:60], net.IPv6zero)
+
+	resp, err := pmpExchange(conn, req, func(b []byte) bool {
+		if len(b) >= 4 && b[0] == pmpVersion {
+			return true // NAT-PMP gateway
+		}
+		return len(b) >= pcpHeaderSize+pcpMapSize && b[0] == pcpVersion &&
+			b[1] == pmpResponseBit|pcpOpMap && bytes.Equal(b[24:36], m.nonce[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] == pmpVersion {
+		return nil, errUnsupportedVersion
+	}
+	if result := resp[3]; result != 0 {
+		return nil, fmt.Errorf("PCP result code %d", result)
+	}
+
+	return &PortMapping{
+		Protocol:     protocol,
+		InternalPort: internal,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[42:44])),
+		ExternalIP:   net.IP(append([]byte(nil), resp[44:60]...)),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second,
+	}, nil
+}
+
+// mapPMP makes a NAT-PMP mapping request, and asks for the external
+// address which NAT-PMP does not include in its response.
+func (m *PMPMapper) mapPMP(protocol string, internal int, lifetime time.Duration) (*PortMapping, error) {
+	op := byte(pmpOpMapUDP)
+	if protocol == "tcp" {
+		op = pmpOpMapTCP
+	}
+
+	conn, err := net.Dial("udp", m.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internal))
+	if lifetime > 0 {
+		binary.BigEndian.PutUint16(req[6:8], uint16(internal))
+	}
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	resp, err := pmpExchange(conn, req, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == pmpVersion && b[1] == pmpResponseBit|op
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result := binary.BigEndian.Uint16(resp[2:4]); result != 0 {
+		return nil, fmt.Errorf("NAT-PMP result code %d", result)
+	}
+
+	pm := &PortMapping{
+		Protocol:     protocol,
+		InternalPort: internal,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:12])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second,
+	}
+	if lifetime == 0 {
+		return pm, nil
+	}
+
+	resp, err = pmpExchange(conn, []byte{pmpVersion, pmpOpAddress}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == pmpVersion && b[1] == pmpResponseBit|pmpOpAddress
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result := binary.BigEndian.Uint16(resp[2:4]); result != 0 {
+		return nil, fmt.Errorf("NAT-PMP result code %d", result)
+	}
+	pm.ExternalIP = net.IP(append([]byte(nil), resp[8:12]...))
+
+	return pm, nil
+}
+
+// pmpExchange sends req until a response accepted by ok arrives, doubling
+// the wait after each attempt.
+func pmpExchange(conn net.Conn, req []byte, ok func([]byte) bool) ([]byte, error) {
+	buf := make([]byte, 1100) // max PCP message size
+	delay := pmpRetryDelay
+	for i := 0; i < pmpRetries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(delay)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if e, isNet := err.(net.Error); isNet && e.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if ok(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		delay *= 2
+	}
+	return nil, fmt.Errorf("no response from gateway")
+}
+
+// protocolNumber gets the IANA protocol number of "udp" or "tcp".
+func protocolNumber(protocol string) (byte, error) {
+	switch protocol {
+	case "udp":
+		return 17, nil
+	case "tcp":
+		return 6, nil
+	}
+	return 0, fmt.Errorf("unknown protocol %q", protocol)
+}
+
+// DefaultGateway finds the IPv4 address of the default gateway from the
+// routing table, or otherwise guesses it is the first address in the
+// network of a local address.
+func DefaultGateway() (net.IP, error) {
+	if ip, err := routeGateway("/proc/net/route"); err == nil {
+		return ip, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil && isPrivate(ip) {
+			gw := ip.Mask(ipnet.Mask)
+			gw[3]++
+			return gw, nil
+		}
+	}
+	return nil, fmt.Errorf("no default gateway found")
+}
+
+// routeGateway reads the default gateway from a Linux routing table.
+func routeGateway(filename string) (net.IP, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != net.IPv4len {
+			continue
+		}
+		return net.IPv4(b[3], b[2], b[1], b[0]), nil // little endian
+	}
+	return nil, fmt.Errorf("no default route")
+}
+
+// isPrivate determines if an IPv4 address is in a private network.
+func isPrivate(ip net.IP) bool {
+	return ip[0] == 10 ||
+		ip[0] == 172 && ip[1]&0xF0 == 16 ||
+		ip[0] == 192 && ip[1] == 168
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// This file implements the Noise_XX_25519_ChaChaPoly_SHA256 handshake, as
+// specified by revision 34 of the Noise Protocol Framework. The static keys
+// are the clients' Ed25519 identity keys converted to X25519.
+//
+// XX:
+//   -> e
+//   <- e, ee, s, es
+//   -> s, se
+//
+// See: https://noiseprotocol.org/noise.html
+
+// noiseProtocolName is the Noise protocol name, which is hashed into the
+// handshake so both clients must agree on it.
+const noiseProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+// noiseXX are the tokens of each message of the XX handshake pattern.
+var noiseXX = [][]string{
+	{"e"},
+	{"e", "ee", "s", "es"},
+	{"s", "se"},
+}
+
+// Sizes of Noise DH public keys and of ChaChaPoly authentication tags.
+const (
+	noiseKeySize = 32
+	noiseTagSize = 16
+)
+
+// cipherState encrypts with a key and incrementing nonce.
+type cipherState struct {
+	k []byte // nil until a key is mixed in
+	n uint64
+}
+
+func (c *cipherState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	return nonce
+}
+
+// encrypt plaintext with associated data ad. Without a key the plaintext is
+// returned as is.
+func (c *cipherState) encrypt(ad, plaintext []byte) ([]byte, error) {
+	if c.k == nil {
+		return plaintext, nil
+	}
+
+	aead, err := chacha20poly1305.New(c.k)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, c.nonce(), plaintext, ad)
+	c.n++
+	return ciphertext, nil
+}
+
+// decrypt ciphertext with associated data ad. Without a key the ciphertext
+// is returned as is.
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if c.k == nil {
+		return ciphertext, nil
+	}
+
+	aead, err := chacha20poly1305.New(c.k)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, c.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	c.n++
+	return plaintext, nil
+}
+
+// overhead gets the length added by encrypt.
+func (c *cipherState) overhead() int {
+	if c.k == nil {
+		return 0
+	}
+	return noiseTagSize
+}
+
+// symmetricState holds the chaining key and handshake hash.
+type symmetricState struct {
+	cs cipherState
+	ck []byte // chaining key
+	h  []byte // handshake hash
+}
+
+func (ss *symmetricState) initialize(protocolName string) {
+	if len(protocolName) <= sha256.Size {
+		ss.h = make([]byte, sha256.Size)
+		copy(ss.h, protocolName)
+	} else {
+		sum := sha256.Sum256([]byte(protocolName))
+		ss.h = sum[:]
+	}
+	ss.ck = ss.h
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	var k []byte
+	ss.ck, k = noiseHKDF(ss.ck, ikm)
+	ss.cs = cipherState{k: k}
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := ss.cs.encrypt(ss.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decrypt(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the cipher states for the initiator's and the responder's
+// transport messages.
+func (ss *symmetricState) split() (c1, c2 *cipherState) {
+	k1, k2 := noiseHKDF(ss.ck, nil)
+	return &cipherState{k: k1}, &cipherState{k: k2}
+}
+
+// noiseHKDF is the two output HKDF of the Noise specification.
+func noiseHKDF(ck, ikm []byte) (out1, out2 []byte) {
+	temp := SignHS256(ikm, ck)
+	out1 = SignHS256([]byte{1}, temp)
+	out2 = SignHS256(append(append([]byte(nil), out1...), 2), temp)
+	return
+}
+
+// noiseHandshake is the state of one client's side of a Noise handshake.
+type noiseHandshake struct {
+	ss        symmetricState
+	s, sPub   []byte // local static key pair
+	e, ePub   []byte // local ephemeral key pair
+	rs, re    []byte // remote static and ephemeral public keys
+	initiator bool
+	msg       int // index of the next handshake message
+
+	// set once the handshake is complete
+	send, recv *cipherState
+	chaining   []byte // final chaining key
+}
+
+// newNoiseHandshake begins a handshake with the static X25519 private key.
+// Prologue is data both clients must agree on, which is authenticated by
+// the handshake.
+func newNoiseHandshake(initiator bool, staticKey, prologue []byte) (*noiseHandshake, error) {
+	pub, err := curve25519.X25519(staticKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &noiseHandshake{s: staticKey, sPub: pub, initiator: initiator}
+	hs.ss.initialize(noiseProtocolName)
+	hs.ss.mixHash(prologue)
+	return hs, nil
+}
+
+// Complete determines if all handshake messages have been exchanged.
+func (hs *noiseHandshake) Complete() bool { return hs.msg == len(noiseXX) }
+
+// myTurn determines if the next handshake message is written by this client.
+func (hs *noiseHandshake) myTurn() bool { return (hs.msg%2 == 0) == hs.initiator }
+
+// WriteMessage writes the next handshake message, with an optional payload.
+func (hs *noiseHandshake) WriteMessage(payload []byte) ([]byte, error) {
+	if hs.Complete() || !hs.myTurn() {
+		return nil, fmt.Errorf("handshake message out of order")
+	}
+
+	var out []byte
+	for _, token := range noiseXX[hs.msg] {
+		switch token {
+		case "e":
+			var err error
+			hs.e, hs.ePub, err = Curve25519KeyPair()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, hs.ePub...)
+			hs.ss.mixHash(hs.ePub)
+
+		case "s":
+			ciphertext, err := hs.ss.encryptAndHash(hs.sPub)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, ciphertext...)
+
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ciphertext, err := hs.ss.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, ciphertext...)
+
+	hs.advance()
+	return out, nil
+}
+
+// ReadMessage reads the next handshake message, returning its payload. If
+// the message is not authentic the handshake is left unchanged.
+func (hs *noiseHandshake) ReadMessage(message []byte) (payload []byte, err error) {
+	if hs.Complete() || hs.myTurn() {
+		return nil, fmt.Errorf("handshake message out of order")
+	}
+
+	next := *hs
+	for _, token := range noiseXX[next.msg] {
+		switch token {
+		case "e":
+			if len(message) < noiseKeySize {
+				return nil, fmt.Errorf("handshake message too short")
+			}
+			next.re = append([]byte(nil), message[:noiseKeySize]...)
+			message = message[noiseKeySize:]
+			next.ss.mixHash(next.re)
+
+		case "s":
+			n := noiseKeySize + next.ss.cs.overhead()
+			if len(message) < n {
+				return nil, fmt.Errorf("handshake message too short")
+			}
+			next.rs, err = next.ss.decryptAndHash(message[:n])
+			if err != nil {
+				return nil, err
+			}
+			message = message[n:]
+
+		default:
+			if err = next.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err = next.ss.decryptAndHash(message)
+	if err != nil {
+		return nil, err
+	}
+
+	next.advance()
+	*hs = next
+	return payload, nil
+}
+
+// mixDH performs the Diffie-Hellman for a token ("ee", "es" or "se")
+// and mixes the result into the chaining key.
+func (hs *noiseHandshake) mixDH(token string) error {
+	var priv, pub []byte
+	switch token {
+	case "ee":
+		priv, pub = hs.e, hs.re
+	case "es":
+		if hs.initiator {
+			priv, pub = hs.e, hs.rs
+		} else {
+			priv, pub = hs.s, hs.re
+		}
+	case "se":
+		if hs.initiator {
+			priv, pub = hs.s, hs.re
+		} else {
+			priv, pub = hs.e, hs.rs
+		}
+	default:
+		return fmt.Errorf("unknown handshake token %q", token)
+	}
+
+	dh, err := EDHSharedKey(priv, pub)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(dh)
+	wipe(dh)
+	return nil
+}
+
+// advance moves to the next handshake message, splitting the transport
+// cipher states once the handshake is complete.
+func (hs *noiseHandshake) advance() {
+	hs.msg++
+	if !hs.Complete() {
+		return
+	}
+
+	c1, c2 := hs.ss.split()
+	if hs.initiator {
+		hs.send, hs.recv = c1, c2
+	} else {
+		hs.send, hs.recv = c2, c1
+	}
+	hs.chaining = hs.ss.ck
+}
+
+// Hash gets the handshake hash, which uniquely identifies the handshake.
+func (hs *noiseHandshake) Hash() []byte { return hs.ss.h }
+
+// PeerStatic gets the remote static public key, once it has been received.
+func (hs *noiseHandshake) PeerStatic() []byte { return hs.rs }
+
+// SessionKey derives the key a Session uses in place of the shared key of a
+// Request/Response exchange. The handshake must be complete.
+func (hs *noiseHandshake) SessionKey() ([]byte, error) {
+	if !hs.Complete() {
+		return nil, fmt.Errorf("handshake not complete")
+	}
+	return DeriveKey(hs.chaining, hs.Hash(), "chat noise session", 32)
+}
+
+// wipe erases the handshake's private keys and secrets.
+func (hs *noiseHandshake) wipe() {
+	for _, k := range [][]byte{hs.s, hs.e, hs.ss.ck, hs.ss.cs.k, hs.chaining} {
+		wipe(k)
+	}
+	for _, c := range []*cipherState{hs.send, hs.recv} {
+		if c != nil {
+			wipe(c.k)
+		}
+	}
+}
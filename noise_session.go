@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Steps of a NoiseXXHandshake. The first three carry the messages of the
+// Noise XX pattern, the second and third with the Profile of the responder
+// and the initiator respectively. NoiseAccept tells the initiator that the
+// user accepted its request, and is sealed by the handshake's transport
+// cipher.
+//
+// The responder answers a NoiseInit without a valid cookie with a
+// NoiseCookie, which is smaller, and the initiator repeats its NoiseInit
+// with the cookie. So the responder only does a DH, keeps state or sends its
+// Profile for clients which receive at the address they send from, and is
+// of no use for reflecting traffic at others.
+const (
+	NoiseInit byte = iota + 1
+	NoiseReply
+	NoiseFinal
+	NoiseAccept
+	NoiseCookie
+)
+
+// Limits on handshakes begun by other clients which await their final
+// message. Beyond them, the oldest from the same address, or else the
+// oldest of all, is dropped.
+const (
+	MaxPendingHandshakes = 64
+	MaxSourceHandshakes  = 4 // per address
+)
+
+// Handshake cookies are valid for the interval they were made in and the
+// next.
+const (
+	cookieInterval = time.Minute
+	cookieSize     = 16
+)
+
+// noiseSession is a Noise handshake between this client and another, along
+// with what is known of the session it establishes.
+type noiseSession struct {
+	*noiseHandshake
+	id      uint64
+	peer    *Profile  // authenticated profile of the other client
+	expires time.Time // when a handshake awaiting its final message is dropped
+	addr    string    // of the other client, when it began the handshake
+	init    []byte    // first handshake message, repeated with a cookie
+	retried bool      // init was repeated with a cookie
+}
+
+// noisePrologue binds a handshake to this chat protocol and session.
+func noisePrologue(sessionID uint64) []byte {
+	p := append([]byte("chat"), WireVersion)
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], sessionID)
+	return append(p, id[:]...)
+}
+
+// noisePeer decodes the Profile sent in a handshake payload, and checks
+// that its key is the static key the other client proved it holds.
+func noisePeer(payload, static []byte) (*Profile, error) {
+	p := &Profile{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(p); err != nil {
+		return nil, err
+	}
+	if err := p.Verify(); err != nil {
+		return nil, err
+	}
+
+	key, err := Ed25519PublicKeyToCurve25519(p.PublicSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(key, static) {
+		return nil, fmt.Errorf("profile key does not match handshake key")
+	}
+	return p, nil
+}
+
+// InitiateNoiseSession creates a session based on intention to begin a
+// Noise handshake with other, returning the first handshake message.
+func InitiateNoiseSession(me, other *Profile, identity ed25519.PrivateKey) (*Session, *Handshake, error) {
+	if other == nil {
+		return nil, nil, fmt.Errorf("nil Profile")
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, nil, err
+	}
+	sessionID := binary.LittleEndian.Uint64(id[:])
+
+	hs, err := newNoiseHandshake(true, Ed25519PrivateKeyToCurve25519(identity), noisePrologue(sessionID))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := hs.WriteMessage(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &Session{
+		Status:   Pending,
+		ID:       sessionID,
+		Me:       me,
+		Other:    other,
+		Expires:  time.Now().Add(PendingTimeout),
+		Msgs:     make([]*Text, 0),
+		inflight: make(map[uint64]*delivery),
+		noise:    &noiseSession{noiseHandshake: hs, id: sessionID, init: data},
+	}
+	h := &Handshake{Protocol: NoiseXXHandshake, SessionID: sessionID, Step: NoiseInit, Data: data}
+
+	return s, h, nil
+}
+
+// RetryNoise makes the first handshake message again with the responder's
+// cookie, which shows this client receives at its address. It is only
+// repeated once, and not after the responder replied.
+func (s *Session) RetryNoise(h *Handshake) (*Handshake, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Status != Pending || s.noise == nil || s.noise.msg != 1 {
+		return nil, fmt.Errorf("session is not awaiting a Noise reply")
+	}
+	if s.noise.retried {
+		return nil, fmt.Errorf("handshake was already repeated with a cookie")
+	}
+	if len(h.Data) != cookieSize {
+		return nil, fmt.Errorf("invalid cookie")
+	}
+
+	s.noise.retried = true
+	return &Handshake{Protocol: NoiseXXHandshake, SessionID: s.ID, Step: NoiseInit, Data: s.noise.init, Cookie: h.Data}, nil
+}
+
+// ContinueNoise reads the responder's reply to the session's handshake. It
+// returns the responder's Profile, and the final handshake message which
+// should be sent if the Profile is acceptable.
+func (s *Session) ContinueNoise(h *Handshake) (peer *Profile, final *Handshake, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Status != Pending || s.noise == nil {
+		return nil, nil, fmt.Errorf("session has no Noise handshake in progress")
+	}
+
+	payload, err := s.noise.ReadMessage(h.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, err = noisePeer(payload, s.noise.PeerStatic())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	me, err := gobEncode(s.Me)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := s.noise.WriteMessage(me)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.noise.peer = peer
+	final = &Handshake{Protocol: NoiseXXHandshake, SessionID: s.ID, Step: NoiseFinal, Data: data}
+	return peer, final, nil
+}
+
+// UpgradeNoise changes a Pending session into an Active one when the other
+// client accepts its completed Noise handshake. Any error results in a
+// failure to upgrade and the session is not modified.
+func (s *Session) UpgradeNoise(h *Handshake) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Status != Pending || s.noise == nil || !s.noise.Complete() {
+		return fmt.Errorf("session has no completed Noise handshake")
+	}
+
+	if _, err := s.noise.recv.decrypt(nil, h.Data); err != nil {
+		return err
+	}
+
+	sharedKey, err := s.noise.SessionKey()
+	if err != nil {
+		return err
+	}
+	defer wipe(sharedKey) // only the keys derived from it are kept
+	r, err := newInitiatorRatchet(sharedKey, s.noise.re)
+	if err != nil {
+		return err
+	}
+	sendKey, recvKey, err := controlKeys(sharedKey)
+	if err != nil {
+		return err
+	}
+
+	s.keepAddress(s.noise.peer)
+	s.Status = Active
+	s.Other = s.noise.peer
+	s.route = RouteTag(sharedKey, s.ID)
+	s.ratchet = r
+	s.sendControlKey, s.recvControlKey = sendKey, recvKey
+
+	s.noise.wipe()
+	s.noise = nil
+
+	s.extendExpiration()
+	return nil
+}
+
+// BeginNoiseSession creates an Active session from an accepted Request which
+// was received by a Noise handshake. The returned Handshake tells the other
+// client that it was accepted.
+func BeginNoiseSession(me *Profile, req *Request) (*Session, *Handshake, error) {
+	hs := req.noise
+	if hs == nil || !hs.Complete() {
+		return nil, nil, fmt.Errorf("request has no completed Noise handshake")
+	}
+
+	sharedKey, err := hs.SessionKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(sharedKey) // only the keys derived from it are kept
+	// the ratchet begins with the ephemeral key pair of the handshake
+	r, err := newResponderRatchet(sharedKey, append([]byte(nil), hs.e...), hs.ePub)
+	if err != nil {
+		return nil, nil, err
+	}
+	recvKey, sendKey, err := controlKeys(sharedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := hs.send.encrypt(nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	accept := &Handshake{Protocol: NoiseXXHandshake, SessionID: hs.id, Step: NoiseAccept, Data: data}
+
+	s := &Session{
+		Status:         Active,
+		ID:             hs.id,
+		Me:             me,
+		Other:          req.Profile,
+		Expires:        time.Now().Add(SessionIdleTimeout),
+		Msgs:           make([]*Text, 0),
+		inflight:       make(map[uint64]*delivery),
+		route:          RouteTag(sharedKey, hs.id),
+		ratchet:        r,
+		sendControlKey: sendKey,
+		recvControlKey: recvKey,
+	}
+
+	hs.wipe()
+	return s, accept, nil
+}
+
+// SendHandshake sends a Handshake to the other client.
+func (s *Session) SendHandshake(h *Handshake) error {
+	m, err := PackageHandshake(h)
+	if err != nil {
+		return err
+	}
+
+	return Send(s.transport, s.Address(), m)
+}
+
+// handshakeKey identifies a handshake begun by another client.
+func handshakeKey(addr string, sessionID uint64) string {
+	return fmt.Sprintf("%s/%d", addr, sessionID)
+}
+
+// handshakeCookie makes the cookie a client at addr must send to begin the
+// handshake with the session ID, during the cookieInterval including t.
+func (eng *ChatEngine) handshakeCookie(addr string, sessionID uint64, t time.Time) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint64(b, sessionID)
+	binary.LittleEndian.PutUint64(b[8:], uint64(t.Unix()/int64(cookieInterval/time.Second)))
+	return SignHS256(append(b, addr...), eng.cookieSecret)[:cookieSize]
+}
+
+// validCookie determines if a NoiseInit carries a cookie made for addr
+// recently.
+func (eng *ChatEngine) validCookie(h *Handshake, addr string) bool {
+	now := time.Now()
+	return hmac.Equal(h.Cookie, eng.handshakeCookie(addr, h.SessionID, now)) ||
+		hmac.Equal(h.Cookie, eng.handshakeCookie(addr, h.SessionID, now.Add(-cookieInterval)))
+}
+
+// respondNoise replies to the first message of a Noise handshake begun by
+// another client at addr, and waits for its final message. Unless the
+// message has a valid cookie, only a NoiseCookie is sent.
+func (eng *ChatEngine) respondNoise(h *Handshake, addr string) error {
+	if !eng.validCookie(h, addr) {
+		cookie := eng.handshakeCookie(addr, h.SessionID, time.Now())
+		m, err := PackageHandshake(&Handshake{Protocol: NoiseXXHandshake, SessionID: h.SessionID, Step: NoiseCookie, Data: cookie})
+		if err != nil {
+			return err
+		}
+		return Send(eng.transport, addr, m)
+	}
+
+	hs, err := newNoiseHandshake(false, Ed25519PrivateKeyToCurve25519(eng.PrivSignKey), noisePrologue(h.SessionID))
+	if err != nil {
+		return err
+	}
+	if _, err = hs.ReadMessage(h.Data); err != nil {
+		return err
+	}
+
+	me, err := gobEncode(eng.Me())
+	if err != nil {
+		return err
+	}
+	data, err := hs.WriteMessage(me)
+	if err != nil {
+		return err
+	}
+
+	eng.mu.Lock()
+	eng.addHandshake(&noiseSession{
+		noiseHandshake: hs,
+		id:             h.SessionID,
+		expires:        time.Now().Add(PendingTimeout),
+		addr:           addr,
+	})
+	eng.mu.Unlock()
+
+	m, err := PackageHandshake(&Handshake{Protocol: NoiseXXHandshake, SessionID: h.SessionID, Step: NoiseReply, Data: data})
+	if err != nil {
+		return err
+	}
+	return Send(eng.transport, addr, m)
+}
+
+// addHandshake keeps a handshake begun by another client until its final
+// message arrives. The oldest handshake from the same address is dropped if
+// it has MaxSourceHandshakes, or else the oldest of all if there are
+// MaxPendingHandshakes. The caller must hold eng.mu.
+func (eng *ChatEngine) addHandshake(hs *noiseSession) {
+	key := handshakeKey(hs.addr, hs.id)
+	if old, ok := eng.handshakes[key]; ok { // begun again
+		old.wipe()
+		delete(eng.handshakes, key)
+	}
+
+	var fromAddr int
+	var oldest, oldestFromAddr string
+	for k, other := range eng.handshakes {
+		if oldest == "" || other.expires.Before(eng.handshakes[oldest].expires) {
+			oldest = k
+		}
+		if other.addr == hs.addr {
+			fromAddr++
+			if oldestFromAddr == "" || other.expires.Before(eng.handshakes[oldestFromAddr].expires) {
+				oldestFromAddr = k
+			}
+		}
+	}
+
+	var evict string
+	switch {
+	case fromAddr >= MaxSourceHandshakes:
+		evict = oldestFromAddr
+	case len(eng.handshakes) >= MaxPendingHandshakes:
+		evict = oldest
+	}
+	if old, ok := eng.handshakes[evict]; ok {
+		old.wipe()
+		delete(eng.handshakes, evict)
+	}
+	eng.handshakes[key] = hs
+}
+
+// finishNoise reads the final message of a Noise handshake begun by another
+// client at addr, returning a Request from the authenticated client.
+func (eng *ChatEngine) finishNoise(h *Handshake, addr string) (*Request, error) {
+	key := handshakeKey(addr, h.SessionID)
+	eng.mu.Lock()
+	hs, ok := eng.handshakes[key]
+	delete(eng.handshakes, key) // one attempt only
+	eng.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no handshake in progress")
+	}
+
+	payload, err := hs.ReadMessage(h.Data)
+	if err != nil {
+		hs.wipe()
+		return nil, err
+	}
+	hs.peer, err = noisePeer(payload, hs.PeerStatic())
+	if err != nil {
+		hs.wipe()
+		return nil, err
+	}
+
+	return &Request{
+		Profile:          hs.peer,
+		PublicSessionKey: hs.re,
+		TimeStamp:        Now(),
+		noise:            hs,
+	}, nil
+}
+
+// expireHandshakes drops handshakes begun by other clients which did not
+// finish in time.
+func (eng *ChatEngine) expireHandshakes(now time.Time) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	for key, hs := range eng.handshakes {
+		if now.After(hs.expires) {
+			hs.wipe()
+			delete(eng.handshakes, key)
+		}
+	}
+}
+
+// processHandshake handles a Message containing a Handshake.
+func (eng *ChatEngine) processHandshake(m *Message) {
+	h, err := m.GetHandshake()
+	if err != nil {
+		eng.emit(DecodeError, "", m, "handshake from %s: %s", m.addr, err)
+		return
+	}
+	if h.Protocol != NoiseXXHandshake {
+		eng.emit(DecodeError, "", m, "handshake from %s: unsupported protocol %d", m.addr, h.Protocol)
+		return
+	}
+
+	switch h.Step {
+	case NoiseInit:
+		if err := eng.respondNoise(h, m.addr); err != nil {
+			eng.emit(Error, "", nil, "handshake from %s: %s", m.addr, err)
+		}
+
+	case NoiseCookie:
+		sess, ok := eng.sessionByID(h.SessionID)
+		if !ok {
+			log.Printf("no session found for handshake from %s\n", m.addr)
+			return
+		}
+		// the cookie may come from another address than the one the init
+		// was sent to, from behind a NAT or for a Profile with a DNS name.
+		// Clients off the path can't know the session ID to forge one
+		init, err := sess.RetryNoise(h)
+		if err != nil {
+			eng.emit(Error, sess.Handle(), sess, "handshake with %s: %s", m.addr, err)
+			return
+		}
+		if err := sess.SendHandshake(init); err != nil {
+			eng.emit(SendFailed, sess.Handle(), nil, "handshake to %s: %s", sess.Peer(), err)
+		}
+
+	case NoiseReply:
+		sess, ok := eng.sessionByID(h.SessionID)
+		if !ok {
+			log.Printf("no session found for handshake from %s\n", m.addr)
+			return
+		}
+
+		peer, final, err := sess.ContinueNoise(h)
+		if err != nil {
+			eng.emit(Error, sess.Handle(), sess, "handshake with %s: %s", m.addr, err)
+			return
+		}
+		if !eng.checkResponder(peer, sess.Handle(), h) {
+			return
+		}
+		if err := sess.SendHandshake(final); err != nil {
+			eng.emit(SendFailed, sess.Handle(), nil, "handshake to %s: %s", peer, err)
+		}
+
+	case NoiseFinal:
+		request, err := eng.finishNoise(h, m.addr)
+		if err != nil {
+			eng.emit(DecodeError, "", m, "handshake from %s: %s", m.addr, err)
+			return
+		}
+		eng.receiveRequest(request, m.addr)
+
+	case NoiseAccept:
+		sess, ok := eng.sessionByID(h.SessionID)
+		if !ok {
+			log.Printf("no session found for handshake from %s\n", m.addr)
+			return
+		}
+
+		if err := sess.UpgradeNoise(h); err == nil {
+			eng.AddRoute(sess)
+			eng.emit(SessionUpgraded, sess.Handle(), sess, "began session with %s", sess.Peer())
+			eng.deliverPending(sess)
+		} else {
+			eng.emit(Error, sess.Handle(), sess,
+				"couldn't upgrade session %d with handshake from %s: %s", sess.ID, m.addr, err)
+		}
+
+	default:
+		eng.emit(DecodeError, "", m, "handshake from %s: unknown step %d", m.addr, h.Step)
+	}
+}
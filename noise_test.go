@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestCurve25519Conversion checks the conversion of the RFC 8032 test 1 key
+// pair against values computed from the birational map and RFC 7748.
+func TestCurve25519Conversion(t *testing.T) {
+	seed := mustHex(t, "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	if want := mustHex(t, "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"); !bytes.Equal(pub, want) {
+		t.Fatalf("public key = %x", pub)
+	}
+
+	x := Ed25519PrivateKeyToCurve25519(priv)
+	if want := mustHex(t, "307c83864f2833cb427a2ef1c00a013cfdff2768d980c0a3a520f006904de94f"); !bytes.Equal(x, want) {
+		t.Errorf("private key = %x, want %x", x, want)
+	}
+	xPub, err := Ed25519PublicKeyToCurve25519(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, "d85e07ec22b0ad881537c2f44d662d1a143cf830c57aca4305d85c7a90f6b62e"); !bytes.Equal(xPub, want) {
+		t.Errorf("public key = %x, want %x", xPub, want)
+	}
+
+	if _, err := Ed25519PublicKeyToCurve25519(pub[:31]); err == nil {
+		t.Error("converted a short public key")
+	}
+}
+
+func TestNoiseSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := NewMemoryNetwork()
+	a := newTestEngine(t, n, "alice")
+	b := newTestEngine(t, n, "bob")
+	a.Noise = true
+	a.Start(ctx)
+	b.Start(ctx)
+
+	sa, sb := connect(t, a, b)
+	if !bytes.Equal(sa.Peer().PublicSigningKey, b.Me().PublicSigningKey) ||
+		!bytes.Equal(sb.Peer().PublicSigningKey, a.Me().PublicSigningKey) {
+		t.Fatal("sessions are not with the authenticated peers")
+	}
+	if !sa.Equal(sb) {
+		t.Fatal("sessions have different IDs or routes")
+	}
+
+	if err := sb.SendText("hi alice"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitEvent(t, a, TextReceived); ev.Data.(*Text).Message != "hi alice" {
+		t.Fatalf("alice received %q", ev.Data.(*Text).Message)
+	}
+	if err := sa.SendText("hi bob"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitEvent(t, b, TextReceived); ev.Data.(*Text).Message != "hi bob" {
+		t.Fatalf("bob received %q", ev.Data.(*Text).Message)
+	}
+	waitFor(t, "acks", func() bool {
+		return sa.Messages(0)[1].State() == Acked && sb.Messages(0)[0].State() == Acked
+	})
+}
+
+func TestNoiseKeyChanged(t *testing.T) {
+	_, otherKey, err := Ed25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor := func(name string) *Contact {
+		return &Contact{Profile: &Profile{Name: name, Address: name, Port: "1", PublicSigningKey: otherKey}}
+	}
+
+	t.Run("responder", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		n := NewMemoryNetwork()
+		a := newTestEngine(t, n, "alice")
+		b := newTestEngine(t, n, "bob", impostor("alice"))
+		a.Noise = true
+		b.KeyPolicy = RejectKeyChange
+		a.Start(ctx)
+		b.Start(ctx)
+
+		if err := a.SendRequest(b.Me()); err != nil {
+			t.Fatal(err)
+		}
+		waitEvent(t, b, KeyChanged)
+		if len(b.Requests()) != 0 {
+			t.Fatal("request from changed key was kept")
+		}
+	})
+
+	t.Run("initiator", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		n := NewMemoryNetwork()
+		a := newTestEngine(t, n, "alice", impostor("bob"))
+		b := newTestEngine(t, n, "bob")
+		a.Noise = true
+		a.Start(ctx)
+		b.Start(ctx)
+
+		if err := a.SendRequest(b.Me()); err != nil {
+			t.Fatal(err)
+		}
+		waitEvent(t, a, KeyChanged)
+		time.Sleep(100 * time.Millisecond) // a final message would arrive by now
+		if len(b.Requests()) != 0 {
+			t.Fatal("handshake finished with changed key")
+		}
+	})
+}
+
+// noiseInit makes the first message of a handshake.
+func noiseInit(t *testing.T, sessionID uint64) *Handshake {
+	t.Helper()
+	priv, _, err := Curve25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := newNoiseHandshake(true, priv, noisePrologue(sessionID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hs.WriteMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handshake{Protocol: NoiseXXHandshake, SessionID: sessionID, Step: NoiseInit, Data: data}
+}
+
+func TestNoiseHandshakeLimits(t *testing.T) {
+	n := NewMemoryNetwork()
+	b := newTestEngine(t, n, "bob")
+	spoofed := n.Transport("victim:1")
+
+	// without a cookie, only a smaller NoiseCookie is sent
+	init := noiseInit(t, 1)
+	sent, err := PackageHandshake(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.respondNoise(init, "victim:1"); err != nil {
+		t.Fatal(err)
+	}
+	p := <-spoofed.Receive()
+	reply, err := decodeMessage(p.Data[fragmentHeaderSize:], p.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := reply.GetHandshake(); err != nil || h.Step != NoiseCookie {
+		t.Fatalf("reply is not a cookie: %v", err)
+	}
+	if len(reply.Payload) > len(sent.Payload) {
+		t.Errorf("cookie of %d bytes is larger than init of %d", len(reply.Payload), len(sent.Payload))
+	}
+	if len(b.handshakes) != 0 {
+		t.Fatal("handshake kept without a cookie")
+	}
+
+	begin := func(addr string, id uint64) {
+		t.Helper()
+		h := noiseInit(t, id)
+		h.Cookie = b.handshakeCookie(addr, id, time.Now())
+		if err := b.respondNoise(h, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one address only holds MaxSourceHandshakes, evicting its oldest
+	for id := uint64(1); id <= MaxSourceHandshakes+2; id++ {
+		begin("victim:1", id)
+	}
+	if len(b.handshakes) != MaxSourceHandshakes {
+		t.Fatalf("%d handshakes from one address", len(b.handshakes))
+	}
+	if _, ok := b.handshakes[handshakeKey("victim:1", 1)]; ok {
+		t.Error("oldest handshake from the address was kept")
+	}
+
+	// many addresses evict the oldest of all, rather than refusing more
+	for i := 0; i < MaxPendingHandshakes; i++ {
+		begin(fmt.Sprintf("other%d:1", i), 1)
+	}
+	if len(b.handshakes) != MaxPendingHandshakes {
+		t.Fatalf("%d handshakes", len(b.handshakes))
+	}
+	if _, ok := b.handshakes[handshakeKey(fmt.Sprintf("other%d:1", MaxPendingHandshakes-1), 1)]; !ok {
+		t.Error("newest handshake was refused")
+	}
+}
+
+func TestNoiseCookieAddress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// bob's Profile names an address which reaches him, but he replies
+	// from another, like a DNS name or a NAT
+	n := NewMemoryNetwork()
+	a := newTestEngine(t, n, "alice")
+	b := newTestEngine(t, n, "bob")
+	n.nodes["bob.example:1"] = n.nodes["bob:1"]
+	a.Noise = true
+	a.Start(ctx)
+	b.Start(ctx)
+
+	p := *b.Me()
+	p.Address = "bob.example"
+	if err := a.SendRequest(&p); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitEvent(t, b, RequestReceived)
+	if err := b.AcceptRequest(ev.Data.(*Request)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "session", func() bool {
+		ss := a.Sessions()
+		return len(ss) == 1 && ss[0].IsActive()
+	})
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// Messages to a contact who cannot be reached wait in an outbox, which is
+// saved to OutboxFile so they survive a restart. A message is put in the
+// outbox when it is sent to a contact without an Active session, or when a
+// Text sent to a contact is never acknowledged.
+//
+// Messages are sent when a session with the contact becomes Active or
+// receives an authentic message, and the Courier periodically retries them,
+// requesting a session with contacts which have none. A message leaves the
+// outbox once the contact acknowledges it, the Relay server accepts it as a
+// Letter, or it is cancelled.
+
+// Outbox parameters.
+const (
+	OutboxRetryInterval = time.Minute     // how often the Courier looks for pending messages
+	OutboxProbeInterval = 5 * time.Minute // min time between the Courier's attempts to reach a contact
+)
+
+// OutboxEntry is a message in the outbox waiting for delivery to a contact.
+type OutboxEntry struct {
+	To       ed25519.PublicKey // key of the contact
+	Name     string            // name of the contact when queued
+	Message  string
+	Queued   TimeStamp
+	Attempts int      `json:",omitempty"` // times sent without being acknowledged
+	sess     *Session // session sending the message, if any
+	text     *Text    // the Text sent by sess, once sent
+	relaying bool     // being left with the relay server
+	handle   Handle
+}
+
+// Handle gets the entry's handle, such as "o2".
+func (e *OutboxEntry) Handle() Handle { return e.handle }
+
+// InFlight determines if the message was sent and awaits acknowledgement.
+func (e *OutboxEntry) InFlight() bool { return e.sess != nil || e.relaying }
+
+// ReadOutbox reads pending messages in JSON format from filename.
+func ReadOutbox(filename string) (pending []*OutboxEntry, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &pending)
+	return
+}
+
+// WriteOutbox writes pending messages in JSON format to filename, readable
+// only by the user.
+func WriteOutbox(pending []OutboxEntry, filename string) error {
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// LoadOutbox adds pending messages, such as those read by ReadOutbox(), to
+// the outbox.
+func (eng *ChatEngine) LoadOutbox(pending []*OutboxEntry) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	for _, p := range pending {
+		if p != nil && len(p.To) == ed25519.PublicKeySize {
+			p.handle = eng.nextHandle("o")
+			eng.outbox = append(eng.outbox, p)
+		}
+	}
+}
+
+// SaveOutbox writes the outbox to OutboxFile, if set.
+func (eng *ChatEngine) SaveOutbox() error {
+	if eng.OutboxFile == "" {
+		return nil
+	}
+
+	return WriteOutbox(eng.Outbox(), eng.OutboxFile)
+}
+
+// Outbox gets a copy of the pending messages.
+func (eng *ChatEngine) Outbox() []OutboxEntry {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
+	pending := make([]OutboxEntry, 0, len(eng.outbox))
+	for _, p := range eng.outbox {
+		pending = append(pending, *p)
+	}
+	return pending
+}
+
+// QueueText puts a message to the contact in the outbox. It is sent at once
+// if there is an Active session with the contact. Otherwise it is left with
+// the Relay server, if any, or a session is requested, unless one is already
+// Pending.
+func (eng *ChatEngine) QueueText(c *Contact, message string) (Handle, error) {
+	if len(c.PublicSigningKey) == 0 {
+		return "", fmt.Errorf("%s has no key", c)
+	}
+
+	p := &OutboxEntry{To: c.PublicSigningKey, Name: c.Name, Message: message, Queued: Now()}
+	eng.mu.Lock()
+	p.handle = eng.nextHandle("o")
+	eng.outbox = append(eng.outbox, p)
+	eng.mu.Unlock()
+
+	if err := eng.SaveOutbox(); err != nil {
+		log.Println(err)
+	}
+
+	sess, found := eng.sessionWith(c.PublicSigningKey)
+	switch {
+	case sess != nil:
+		eng.deliverPending(sess)
+	case eng.Relay != "":
+		if err := eng.relayPending(c.PublicSigningKey); err == nil {
+			return p.handle, nil
+		} else if !found {
+			log.Printf("relaying to %s: %s\n", c, err)
+			return p.handle, eng.SendRequest(c.Profile)
+		}
+	case !found:
+		return p.handle, eng.SendRequest(c.Profile)
+	}
+	return p.handle, nil
+}
+
+// CancelOutboxEntry removes the pending message with the handle from the
+// outbox. A message already sent may still be delivered.
+// Return value indicates if there was a message to remove.
+func (eng *ChatEngine) CancelOutboxEntry(h Handle) bool {
+	eng.mu.Lock()
+	var removed bool
+	for i, p := range eng.outbox {
+		if p.handle == h {
+			eng.outbox = append(eng.outbox[:i], eng.outbox[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	eng.mu.Unlock()
+
+	if removed {
+		if err := eng.SaveOutbox(); err != nil {
+			log.Println(err)
+		}
+	}
+	return removed
+}
+
+// LookupOutboxEntry finds a pending message by handle.
+func (eng *ChatEngine) LookupOutboxEntry(h string) (*OutboxEntry, error) {
+	for _, p := range eng.Outbox() {
+		if p.handle == Handle(h) {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found", h)
+}
+
+// sessionWith finds an Active session with the client having the key. found
+// reports if there is any session with it, such as a Pending one.
+func (eng *ChatEngine) sessionWith(key ed25519.PublicKey) (active *Session, found bool) {
+	for _, s := range eng.Sessions() {
+		peer := s.Peer()
+		if peer == nil || !bytes.Equal(peer.PublicSigningKey, key) {
+			continue
+		}
+		found = true
+		if s.IsActive() {
+			return s, true
+		}
+	}
+	return nil, found
+}
+
+// deliverPending sends the pending messages for the other client of an
+// Active session, after removing those it acknowledged.
+func (eng *ChatEngine) deliverPending(sess *Session) {
+	eng.sweepOutbox()
+
+	peer := sess.Peer()
+	if peer == nil || !sess.IsActive() {
+		return
+	}
+
+	// claim the messages, so they are not sent twice
+	eng.mu.Lock()
+	var send []*OutboxEntry
+	for _, p := range eng.outbox {
+		if p.sess == nil && !p.relaying && bytes.Equal(p.To, peer.PublicSigningKey) {
+			p.sess = sess
+			send = append(send, p)
+		}
+	}
+	eng.mu.Unlock()
+	if len(send) == 0 {
+		return
+	}
+
+	var n int
+	for _, p := range send {
+		t, err := sess.sendText(p.Message)
+		if err != nil {
+			log.Printf("sending queued messages to %s: %s\n", peer, err)
+			break
+		}
+		eng.mu.Lock()
+		p.text = t
+		p.Attempts++
+		eng.mu.Unlock()
+		n++
+	}
+	eng.mu.Lock()
+	for _, p := range send[n:] {
+		p.sess = nil
+	}
+	eng.mu.Unlock()
+	if n == 0 {
+		return
+	}
+	log.Printf("sent %d queued messages to %s\n", n, peer)
+
+	if err := eng.SaveOutbox(); err != nil {
+		log.Println(err)
+	}
+}
+
+// sweepOutbox removes pending messages which were acknowledged, and
+// releases those whose session ended before they were.
+func (eng *ChatEngine) sweepOutbox() {
+	type sent struct {
+		p    *OutboxEntry
+		sess *Session
+		text *Text
+	}
+	var inflight []sent
+	eng.mu.RLock()
+	for _, p := range eng.outbox {
+		if p.text != nil {
+			inflight = append(inflight, sent{p, p.sess, p.text})
+		}
+	}
+	eng.mu.RUnlock()
+	if len(inflight) == 0 {
+		return
+	}
+
+	// session state is read without holding the engine's lock
+	acked := make(map[*OutboxEntry]bool)
+	released := make(map[*OutboxEntry]*Text)
+	for _, s := range inflight {
+		switch state := s.sess.textState(s.text); {
+		case state == Acked:
+			acked[s.p] = true
+		case state == Failed || !s.sess.IsActive():
+			released[s.p] = s.text
+		}
+	}
+
+	eng.mu.Lock()
+	kept := eng.outbox[:0]
+	for _, p := range eng.outbox {
+		if acked[p] {
+			log.Printf("delivered queued message %s to %s\n", p.handle, p.Name)
+			continue
+		}
+		if t, ok := released[p]; ok && p.text == t { // unless sent again since
+			p.sess, p.text = nil, nil
+		}
+		kept = append(kept, p)
+	}
+	eng.outbox = kept
+	eng.mu.Unlock()
+
+	if len(acked) > 0 {
+		if err := eng.SaveOutbox(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// requeue returns a Text of the session which was never acknowledged to the
+// outbox, if the other client is a contact. Return value is the handle of
+// the entry and whether there is one.
+func (eng *ChatEngine) requeue(sess *Session, t *Text) (Handle, bool) {
+	eng.mu.Lock()
+	for _, p := range eng.outbox {
+		if p.text == t {
+			p.sess, p.text = nil, nil
+			eng.mu.Unlock()
+			return p.handle, true
+		}
+	}
+	eng.mu.Unlock()
+
+	peer := sess.Peer()
+	if peer == nil {
+		return "", false
+	}
+	c, ok := eng.contactByKey(peer.PublicSigningKey)
+	if !ok {
+		return "", false
+	}
+
+	p := &OutboxEntry{To: c.PublicSigningKey, Name: c.Name, Message: t.Message, Queued: t.TimeStamp, Attempts: 1}
+	eng.mu.Lock()
+	p.handle = eng.nextHandle("o")
+	eng.outbox = append(eng.outbox, p)
+	eng.mu.Unlock()
+
+	if err := eng.SaveOutbox(); err != nil {
+		log.Println(err)
+	}
+	return p.handle, true
+}
+
+// Courier runs a loop which periodically retries pending messages, at most
+// once per OutboxProbeInterval for each contact. Messages to contacts
+// without a session are left with the Relay server, if any, or otherwise
+// the contacts are sent a Request.
+func (eng *ChatEngine) Courier(ctx context.Context) {
+	ticker := time.NewTicker(OutboxRetryInterval)
+	defer ticker.Stop()
+	probed := make(map[string]time.Time) // when contacts were last retried, by key
+
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case now := <-ticker.C:
+			eng.sweepOutbox()
+
+			for _, key := range eng.pendingKeys() {
+				if now.Before(probed[string(key)].Add(OutboxProbeInterval)) {
+					continue
+				}
+
+				sess, found := eng.sessionWith(key)
+				if sess != nil {
+					probed[string(key)] = now
+					eng.deliverPending(sess)
+					continue
+				}
+				if found {
+					continue // wait for the Pending session
+				}
+
+				c, ok := eng.contactByKey(key)
+				if !ok {
+					continue // contact was deleted. kept until cancelled
+				}
+				probed[string(key)] = now
+				if eng.Relay != "" {
+					err := eng.relayPending(key)
+					if err == nil {
+						continue
+					}
+					log.Printf("relaying to %s: %s\n", c, err)
+				}
+				if err := eng.SendRequest(c.Profile); err != nil {
+					log.Printf("requesting session with %s: %s\n", c, err)
+				}
+			}
+		}
+	}
+
+	log.Println("exiting courier")
+}
+
+// pendingKeys gets the keys of contacts with messages waiting to be sent.
+func (eng *ChatEngine) pendingKeys() []ed25519.PublicKey {
+	eng.mu.RLock()
+	defer eng.mu.RUnlock()
+
+	var keys []ed25519.PublicKey
+	seen := make(map[string]bool)
+	for _, p := range eng.outbox {
+		if p.sess == nil && !p.relaying && !seen[string(p.To)] {
+			seen[string(p.To)] = true
+			keys = append(keys, p.To)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outboxFile := filepath.Join(dir, "outbox")
+
+	// bob can't be reached, so messages to him wait
+	n := NewMemoryNetwork()
+	b := newTestEngine(t, n, "bob")
+	bob := *b.Me()
+	a := newTestEngine(t, NewMemoryNetwork(), "alice", &Contact{Profile: &bob})
+	a.OutboxFile = outboxFile
+	c := a.Contacts()[0]
+	first, err := a.QueueText(c, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.QueueText(c, "two"); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := ReadOutbox(outboxFile); err != nil || len(pending) != 2 {
+		t.Fatalf("saved %d messages: %v", len(pending), err)
+	}
+
+	// and may be cancelled
+	if !a.CancelOutboxEntry(first) {
+		t.Fatal("didn't cancel the message")
+	}
+	if a.CancelOutboxEntry(first) {
+		t.Fatal("cancelled the message twice")
+	}
+	pending, err := ReadOutbox(outboxFile)
+	if err != nil || len(pending) != 1 || pending[0].Message != "two" {
+		t.Fatalf("saved %d messages after cancelling: %v", len(pending), err)
+	}
+
+	// after a restart, they are sent once bob can be reached
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted, err := NewChatEngine(n.Transport("alice:1"), a.PrivSignKey, a.Me(), a.Contacts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.OutboxFile = outboxFile
+	restarted.LoadOutbox(pending)
+	if p := restarted.Outbox(); len(p) != 1 || p[0].Handle() == "" {
+		t.Fatalf("loaded %d messages", len(p))
+	}
+	restarted.Start(ctx)
+	b.Start(ctx)
+
+	connect(t, restarted, b)
+	if ev := waitEvent(t, b, TextReceived); ev.Data.(*Text).Message != "two" {
+		t.Fatalf("bob received %q", ev.Data.(*Text).Message)
+	}
+	waitFor(t, "delivery", func() bool {
+		pending, err := ReadOutbox(outboxFile)
+		return len(restarted.Outbox()) == 0 && err == nil && len(pending) == 0
+	})
+}
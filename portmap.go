@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Port mapping parameters.
+const (
+	PortMapLifetime = 2 * time.Hour    // lifetime asked for mappings
+	PortMapRetry    = 5 * time.Minute  // time between attempts after a failure
+	PortMapRenewMin = 30 * time.Second // shortest time between renewals
+)
+
+// PortMapper asks a NAT gateway to forward an external port to this host,
+// so that other clients may reach it. see PMPMapper, UPnPMapper
+type PortMapper interface {
+	// Map maps an external port to internal port for lifetime, or renews
+	// the mapping if it exists.
+	Map(protocol string, internal int, lifetime time.Duration) (*PortMapping, error)
+	Unmap(pm *PortMapping) error
+	String() string
+}
+
+// PortMapping is a port mapped by a PortMapper.
+type PortMapping struct {
+	Protocol     string // "udp" or "tcp"
+	InternalPort int
+	ExternalPort int
+	ExternalIP   net.IP
+	Lifetime     time.Duration // granted by the gateway. 0 if permanent
+}
+
+// External gets the full external address of the mapping.
+func (pm *PortMapping) External() string {
+	return net.JoinHostPort(pm.ExternalIP.String(), strconv.Itoa(pm.ExternalPort))
+}
+
+// DiscoverPortMapper finds a gateway which maps ports, trying PCP and NAT-PMP
+// at the default gateway before searching for a UPnP gateway.
+func DiscoverPortMapper() (PortMapper, error) {
+	if gw, err := DefaultGateway(); err == nil {
+		m, err := NewPMPMapper(net.JoinHostPort(gw.String(), PMPPort))
+		if err != nil {
+			return nil, err
+		}
+		if err = m.probe(); err == nil {
+			return m, nil
+		}
+	}
+
+	m, err := DiscoverUPnP()
+	if err != nil {
+		return nil, fmt.Errorf("no gateway with PCP, NAT-PMP or UPnP found")
+	}
+	return m, nil
+}
+
+// Mapper runs a loop which maps the listening port on the NAT gateway, and
+// changes Me's address and port to the external ones. The mapping is renewed
+// at half its lifetime and deleted when ctx is done. If the engine has no
+// Gateway, one is found by DiscoverPortMapper().
+func (eng *ChatEngine) Mapper(ctx context.Context) {
+	eng.mapper(ctx, PortMapRenewMin)
+}
+
+// mapper is the loop of Mapper, renewing mappings no sooner than renewMin.
+func (eng *ChatEngine) mapper(ctx context.Context, renewMin time.Duration) {
+	protocol := "udp"
+	if _, ok := eng.transport.(*TCPTransport); ok {
+		protocol = "tcp"
+	}
+	internal, err := eng.listenPort()
+	if err != nil {
+		log.Printf("port mapping: %s\n", err)
+		return
+	}
+
+	var pm *PortMapping
+	mapPort := func() time.Duration {
+		if eng.Gateway == nil {
+			if eng.Gateway, err = DiscoverPortMapper(); err != nil {
+				log.Printf("port mapping: %s\n", err)
+				return PortMapRetry
+			}
+		}
+
+		m, err := eng.Gateway.Map(protocol, internal, PortMapLifetime)
+		if err != nil {
+			log.Printf("port mapping with %s: %s\n", eng.Gateway, err)
+			return PortMapRetry
+		}
+		pm = m
+		eng.useMapping(pm)
+
+		if pm.Lifetime == 0 {
+			return PortMapLifetime / 2 // permanent. check it remains
+		}
+		if renew := pm.Lifetime / 2; renew > renewMin {
+			return renew
+		}
+		return renewMin
+	}
+
+	timer := time.NewTimer(mapPort())
+	defer timer.Stop()
+
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case <-timer.C:
+			timer.Reset(mapPort())
+		}
+	}
+
+	if pm != nil {
+		if err := eng.Gateway.Unmap(pm); err != nil {
+			log.Printf("releasing port mapping: %s\n", err)
+		}
+	}
+	log.Println("exiting port mapper")
+}
+
+// useMapping changes Me's address and port to the external ones of pm.
+func (eng *ChatEngine) useMapping(pm *PortMapping) {
+	address, port, err := splitEndpoint(pm.External())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	me := *eng.Me()
+	if me.Address == address && me.Port == port {
+		return
+	}
+	me.Address, me.Port = address, port
+	if err = eng.SetMe(&me); err != nil {
+		log.Printf("port mapping: %s\n", err)
+		return
+	}
+	log.Printf("mapped %s port %d to %s by %s\n", pm.Protocol, pm.InternalPort, pm.External(), eng.Gateway)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatewayIP is the external address of the fake gateways.
+var gatewayIP = net.ParseIP("203.0.113.9")
+
+// fakeGateway answers PCP and NAT-PMP requests on loopback, giving each
+// mapping request a new external port from 40001. A pmpOnly gateway answers
+// PCP requests with NAT-PMP's unsupported version result.
+type fakeGateway struct {
+	addr     string
+	pmpOnly  bool
+	lifetime uint32 // seconds granted to mappings
+
+	mu      sync.Mutex
+	mapped  int // mapping requests, including renewals
+	deleted int // deletion requests
+}
+
+func newFakeGateway(t *testing.T, pmpOnly bool, lifetime uint32) *fakeGateway {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	gw := &fakeGateway{addr: conn.LocalAddr().String(), pmpOnly: pmpOnly, lifetime: lifetime}
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := gw.answer(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return gw
+}
+
+// answer makes the response to a request, or nil to ignore it.
+func (gw *fakeGateway) answer(req []byte) []byte {
+	switch {
+	case len(req) < 2:
+		return nil
+
+	case req[0] == pcpVersion && gw.pmpOnly:
+		return []byte{pmpVersion, pmpResponseBit | req[1], 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	case req[0] == pcpVersion && req[1] == pcpOpAnnounce:
+		resp := make([]byte, pcpHeaderSize)
+		resp[0], resp[1] = pcpVersion, pmpResponseBit|pcpOpAnnounce
+		return resp
+
+	case req[0] == pcpVersion && req[1] == pcpOpMap && len(req) >= pcpHeaderSize+pcpMapSize:
+		lifetime := gw.grant(binary.BigEndian.Uint32(req[4:8]))
+		resp := append([]byte(nil), req...)
+		resp[1] = pmpResponseBit | pcpOpMap
+		binary.BigEndian.PutUint32(resp[4:8], lifetime)
+		binary.BigEndian.PutUint16(resp[42:44], gw.mapping(lifetime))
+		copy(resp[44:60], gatewayIP.To16())
+		return resp
+
+	case req[0] == pmpVersion && req[1] == pmpOpAddress:
+		resp := make([]byte, 12)
+		resp[1] = pmpResponseBit | pmpOpAddress
+		copy(resp[8:12], gatewayIP.To4())
+		return resp
+
+	case req[0] == pmpVersion && len(req) >= 12:
+		lifetime := gw.grant(binary.BigEndian.Uint32(req[8:12]))
+		resp := make([]byte, 16)
+		resp[1] = pmpResponseBit | req[1]
+		copy(resp[8:10], req[4:6])
+		binary.BigEndian.PutUint16(resp[10:12], gw.mapping(lifetime))
+		binary.BigEndian.PutUint32(resp[12:16], lifetime)
+		return resp
+	}
+	return nil
+}
+
+// grant gets the lifetime given for a requested lifetime.
+func (gw *fakeGateway) grant(requested uint32) uint32 {
+	if requested == 0 {
+		return 0
+	}
+	return gw.lifetime
+}
+
+// mapping counts a request for lifetime, returning the external port it
+// gets, or 0 for a deletion.
+func (gw *fakeGateway) mapping(lifetime uint32) uint16 {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if lifetime == 0 {
+		gw.deleted++
+		return 0
+	}
+	gw.mapped++
+	return uint16(40000 + gw.mapped)
+}
+
+func (gw *fakeGateway) counts() (mapped, deleted int) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.mapped, gw.deleted
+}
+
+// newMappedEngine makes an engine listening on port 5190 of a private
+// address, which maps its port with gateway. Its profile has another port,
+// as it would after a previous mapping.
+func newMappedEngine(t *testing.T, gateway PortMapper) *ChatEngine {
+	t.Helper()
+	n := NewMemoryNetwork()
+	eng, err := NewChatEngine(n.Transport("10.0.0.2:5190"), nil,
+		&Profile{Name: "alice", Address: "203.0.113.9", Port: "40000"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng.PortMap, eng.Gateway = true, gateway
+	return eng
+}
+
+func TestMapperPMP(t *testing.T) {
+	for name, pmpOnly := range map[string]bool{"PCP": false, "NAT-PMP": true} {
+		t.Run(name, func(t *testing.T) {
+			gw := newFakeGateway(t, pmpOnly, 3600)
+			m, err := NewPMPMapper(gw.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			eng := newMappedEngine(t, m)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := eng.Start(ctx)
+			waitFor(t, "mapped address", func() bool {
+				return eng.Me().FullAddress() == "203.0.113.9:40001"
+			})
+			if err := eng.Me().Verify(); err != nil {
+				t.Fatalf("mapped profile: %s", err)
+			}
+			if m.pmp != pmpOnly {
+				t.Errorf("spoke NAT-PMP %t, want %t", m.pmp, pmpOnly)
+			}
+
+			// the mapping is released before the engine finishes stopping
+			cancel()
+			stopped.Wait()
+			if mapped, deleted := gw.counts(); mapped != 1 || deleted != 1 {
+				t.Fatalf("%d mappings and %d deletions, want 1 of each", mapped, deleted)
+			}
+		})
+	}
+}
+
+func TestMapperRenew(t *testing.T) {
+	// a lifetime of 1s is renewed after 500ms
+	gw := newFakeGateway(t, false, 1)
+	m, err := NewPMPMapper(gw.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng := newMappedEngine(t, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		eng.mapper(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	// the renewal got another port, which Me follows
+	waitFor(t, "renewed mapping", func() bool {
+		return eng.Me().FullAddress() == "203.0.113.9:40002"
+	})
+	cancel()
+	<-done
+	if _, deleted := gw.counts(); deleted != 1 {
+		t.Fatalf("%d deletions", deleted)
+	}
+}
+
+// igdDescription describes an Internet Gateway Device with its WAN
+// connection service nested the way real devices do.
+const igdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device><deviceList><device><deviceList><device>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList></device></deviceList></device>
+</root>`
+
+// fakeIGD serves igdDescription and the SOAP actions used by UPnPMapper,
+// recording the arguments of each action. Like many routers, it only
+// supports permanent mappings.
+type fakeIGD struct {
+	mu    sync.Mutex
+	calls map[string][]string // action name: request bodies
+}
+
+func (igd *fakeIGD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		fmt.Fprint(w, igdDescription)
+		return
+	}
+
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	name := soapAction[strings.Index(soapAction, "#")+1:]
+	body, _ := ioutil.ReadAll(r.Body)
+	igd.mu.Lock()
+	igd.calls[name] = append(igd.calls[name], string(body))
+	igd.mu.Unlock()
+
+	const envelope = `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>%s</s:Body></s:Envelope>`
+	switch name {
+	case "AddPortMapping":
+		if !strings.Contains(string(body), "<NewLeaseDuration>0<") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, envelope, `<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+				`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode>`+
+				`<errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault>`)
+			return
+		}
+		fmt.Fprintf(w, envelope, `<u:AddPortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/>`)
+	case "GetExternalIPAddress":
+		fmt.Fprintf(w, envelope, `<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewExternalIPAddress>198.51.100.4</NewExternalIPAddress></u:GetExternalIPAddressResponse>`)
+	case "DeletePortMapping":
+		fmt.Fprintf(w, envelope, `<u:DeletePortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/>`)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, envelope, `<s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+			`<errorCode>401</errorCode><errorDescription>Invalid Action</errorDescription></UPnPError></detail></s:Fault>`)
+	}
+}
+
+func (igd *fakeIGD) called(name string) []string {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	return igd.calls[name]
+}
+
+func TestMapperUPnP(t *testing.T) {
+	igd := &fakeIGD{calls: make(map[string][]string)}
+	srv := httptest.NewServer(igd)
+	defer srv.Close()
+
+	m, err := NewUPnPMapper(srv.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/ctl/IPConn"; m.controlURL != want {
+		t.Fatalf("control URL = %s, want %s", m.controlURL, want)
+	}
+	eng := newMappedEngine(t, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := eng.Start(ctx)
+	waitFor(t, "mapped address", func() bool {
+		return eng.Me().FullAddress() == "198.51.100.4:5190"
+	})
+
+	// a lease was asked for, then a permanent mapping
+	adds := igd.called("AddPortMapping")
+	lease := fmt.Sprintf("<NewLeaseDuration>%d<", int(PortMapLifetime/time.Second))
+	if len(adds) != 2 || !strings.Contains(adds[0], lease) {
+		t.Fatalf("AddPortMapping requests: %q", adds)
+	}
+	for _, arg := range []string{"<NewExternalPort>5190<", "<NewInternalPort>5190<",
+		"<NewProtocol>UDP<", "<NewInternalClient>127.0.0.1<"} {
+		if !strings.Contains(adds[1], arg) {
+			t.Errorf("AddPortMapping is missing %s", arg)
+		}
+	}
+	if n := len(igd.called("GetExternalIPAddress")); n != 1 {
+		t.Errorf("%d GetExternalIPAddress requests", n)
+	}
+
+	cancel()
+	stopped.Wait()
+	deletes := igd.called("DeletePortMapping")
+	if len(deletes) != 1 || !strings.Contains(deletes[0], "<NewExternalPort>5190<") {
+		t.Fatalf("DeletePortMapping requests: %q", deletes)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// This file implements a QR code encoder (ISO/IEC 18004) for versions 1 to
+// 10 at error correction level L, which is enough for an invite. Text is
+// encoded in alphanumeric mode when possible, otherwise as bytes.
+
+// qrAlphanumeric is the character set of alphanumeric mode, in order.
+const qrAlphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// QR code parameters for level L, indexed by version-1.
+var (
+	qrCodewords  = []int{26, 44, 70, 100, 134, 172, 196, 242, 292, 346} // total
+	qrECPerBlock = []int{7, 10, 15, 20, 26, 18, 20, 24, 30, 18}
+	qrBlocks     = []int{1, 1, 1, 1, 1, 2, 2, 2, 2, 4}
+	qrAlignment  = [][]int{
+		nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+		{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+	}
+)
+
+// QRMaxVersion is the largest QR code version QRCode makes.
+const QRMaxVersion = 10
+
+// qrBits accumulates a bit stream.
+type qrBits []bool
+
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>uint(i))&1 == 1)
+	}
+}
+
+// qrSymbol is a QR code being drawn.
+type qrSymbol struct {
+	size     int
+	modules  [][]bool // [y][x]. true is dark
+	function [][]bool // modules which are not data
+}
+
+// QRCode encodes text into the smallest QR code which holds it. The result
+// is indexed [y][x], and true modules are dark. It has no quiet zone.
+func QRCode(text string) ([][]bool, error) {
+	alnum := text != "" && strings.Trim(text, qrAlphanumeric) == ""
+
+	var version int
+	var bits qrBits
+	for version = 1; version <= QRMaxVersion; version++ {
+		bits = qrSegment(text, alnum, version)
+		if len(bits) <= qrDataCodewords(version)*8 {
+			break
+		}
+	}
+	if version > QRMaxVersion {
+		return nil, fmt.Errorf("too long for a QR code")
+	}
+
+	// terminator, byte alignment, then alternating pad bytes
+	capacity := qrDataCodewords(version) * 8
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	data := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			data[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	s := newQRSymbol(version)
+	s.drawCodewords(qrInterleave(data, version))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		s.applyMask(mask)
+		s.drawFormat(mask)
+		if p := s.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		s.applyMask(mask) // undo
+	}
+	s.applyMask(best)
+	s.drawFormat(best)
+
+	return s.modules, nil
+}
+
+// qrSegment encodes text as a single segment for version.
+func qrSegment(text string, alnum bool, version int) qrBits {
+	var bits qrBits
+	if alnum {
+		count := 9
+		if version >= 10 {
+			count = 11
+		}
+		bits.append(0x2, 4)
+		bits.append(len(text), count)
+		for i := 0; i+1 < len(text); i += 2 {
+			a := strings.IndexByte(qrAlphanumeric, text[i])
+			b := strings.IndexByte(qrAlphanumeric, text[i+1])
+			bits.append(a*45+b, 11)
+		}
+		if len(text)%2 == 1 {
+			bits.append(strings.IndexByte(qrAlphanumeric, text[len(text)-1]), 6)
+		}
+		return bits
+	}
+
+	count := 8
+	if version >= 10 {
+		count = 16
+	}
+	bits.append(0x4, 4)
+	bits.append(len(text), count)
+	for i := 0; i < len(text); i++ {
+		bits.append(int(text[i]), 8)
+	}
+	return bits
+}
+
+// qrDataCodewords gets the number of data codewords of version.
+func qrDataCodewords(version int) int {
+	return qrCodewords[version-1] - qrECPerBlock[version-1]*qrBlocks[version-1]
+}
+
+// qrInterleave splits data into blocks, adds the error correction codewords
+// of each, and interleaves them.
+func qrInterleave(data []byte, version int) []byte {
+	numBlocks := qrBlocks[version-1]
+	ecLen := qrECPerBlock[version-1]
+	shortLen := len(data) / numBlocks
+	numShort := numBlocks - len(data)%numBlocks
+	gen := rsGenerator(ecLen)
+
+	var blocks, ecs [][]byte
+	for i, off := 0, 0; i < numBlocks; i++ {
+		n := shortLen
+		if i >= numShort {
+			n++
+		}
+		blocks = append(blocks, data[off:off+n])
+		ecs = append(ecs, rsRemainder(data[off:off+n], gen))
+		off += n
+	}
+
+	var out []byte
+	for i := 0; i <= shortLen; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsGenerator gets the Reed-Solomon generator polynomial of degree, without
+// its leading term, highest power first.
+func rsGenerator(degree int) []byte {
+	g := make([]byte, degree)
+	g[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range g {
+			g[j] = gfMul(g[j], root)
+			if j+1 < len(g) {
+				g[j] ^= g[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return g
+}
+
+// rsRemainder gets the Reed-Solomon error correction codewords of data.
+func rsRemainder(data, gen []byte) []byte {
+	r := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i := range r {
+			r[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return r
+}
+
+// newQRSymbol makes a symbol of version with its function patterns drawn.
+func newQRSymbol(version int) *qrSymbol {
+	size := 17 + 4*version
+	s := &qrSymbol{size: size}
+	for y := 0; y < size; y++ {
+		s.modules = append(s.modules, make([]bool, size))
+		s.function = append(s.function, make([]bool, size))
+	}
+
+	// timing patterns
+	for i := 0; i < size; i++ {
+		s.set(6, i, i%2 == 0)
+		s.set(i, 6, i%2 == 0)
+	}
+
+	// finder patterns and separators
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				s.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	// alignment patterns, except where they overlap finders
+	pos := qrAlignment[version-1]
+	for i, cx := range pos {
+		for j, cy := range pos {
+			if i == 0 && j == 0 || i == 0 && j == len(pos)-1 || i == len(pos)-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					s.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format areas; drawn after masking
+	s.drawFormat(0)
+
+	// version information
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := (bits>>uint(i))&1 == 1
+			a, b := size-11+i%3, i/3
+			s.set(a, b, bit)
+			s.set(b, a, bit)
+		}
+	}
+
+	return s
+}
+
+// set draws a function module.
+func (s *qrSymbol) set(x, y int, dark bool) {
+	s.modules[y][x] = dark
+	s.function[y][x] = true
+}
+
+// drawFormat draws both copies of the format information for level L and
+// mask, and the dark module.
+func (s *qrSymbol) drawFormat(mask int) {
+	data := 1<<3 | mask // level L
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		s.set(8, i, bit(i))
+	}
+	s.set(8, 7, bit(6))
+	s.set(8, 8, bit(7))
+	s.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		s.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		s.set(s.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		s.set(8, s.size-15+i, bit(i))
+	}
+	s.set(8, s.size-8, true)
+}
+
+// drawCodewords places data in the zigzag order of the standard.
+func (s *qrSymbol) drawCodewords(data []byte) {
+	i := 0
+	for right := s.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < s.size; vert++ {
+			y := vert
+			if upward {
+				y = s.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if s.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+				s.modules[y][x] = data[i/8]&(0x80>>uint(i%8)) != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by mask. Applying it twice
+// undoes it.
+func (s *qrSymbol) applyMask(mask int) {
+	for y := 0; y < s.size; y++ {
+		for x := 0; x < s.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !s.function[y][x] {
+				s.modules[y][x] = !s.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol may be to read, by the rules of the
+// standard. The mask with the lowest penalty is used.
+func (s *qrSymbol) penalty() int {
+	var p, dark int
+	at := func(x, y int, columns bool) bool {
+		if columns {
+			return s.modules[x][y]
+		}
+		return s.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+
+	for _, columns := range []bool{false, true} {
+		for y := 0; y < s.size; y++ {
+			run := 0
+			for x := 0; x < s.size; x++ {
+				// runs of five or more
+				if x > 0 && at(x, y, columns) == at(x-1, y, columns) {
+					run++
+					if run == 5 {
+						p += 3
+					} else if run > 5 {
+						p++
+					}
+				} else {
+					run = 1
+				}
+
+				// finder-like patterns with four light modules on a side
+				if x+7 <= s.size {
+					match := true
+					for k, f := range finder {
+						if at(x+k, y, columns) != f {
+							match = false
+							break
+						}
+					}
+					if match && (s.light(x-4, x, y, columns) || s.light(x+7, x+11, y, columns)) {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+
+	for y := 0; y < s.size; y++ {
+		for x := 0; x < s.size; x++ {
+			if s.modules[y][x] {
+				dark++
+			}
+			if x+1 < s.size && y+1 < s.size {
+				c := s.modules[y][x]
+				if s.modules[y][x+1] == c && s.modules[y+1][x] == c && s.modules[y+1][x+1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+
+	total := s.size * s.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return p + k*10
+}
+
+// light determines if modules from a to b (exclusive) of a row or column
+// are light. Modules outside the symbol are light.
+func (s *qrSymbol) light(a, b, line int, columns bool) bool {
+	for i := a; i < b; i++ {
+		if i < 0 || i >= s.size {
+			continue
+		}
+		if columns && s.modules[i][line] || !columns && s.modules[line][i] {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteQR draws a QR code to a terminal with half block characters, two
+// rows of modules per line, with a quiet zone. Dark modules are drawn as
+// spaces, so it reads on a terminal with light text on a dark background.
+func WriteQR(w io.Writer, modules [][]bool) error {
+	const quiet = 2
+	size := len(modules)
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && y >= 0 && x < size && y < size && modules[y][x]
+	}
+
+	var b strings.Builder
+	for y := 0; y < size+2*quiet; y += 2 {
+		for x := 0; x < size+2*quiet; x++ {
+			top, bottom := !dark(x, y), !dark(x, y+1) && y+1 < size+2*quiet
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
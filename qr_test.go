@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// qrString draws modules as rows of # (dark) and . (light).
+func qrString(modules [][]bool) string {
+	var b strings.Builder
+	for _, row := range modules {
+		for _, dark := range row {
+			if dark {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// TestQRCode checks symbols against those made by other encoders for the
+// same text at level L: in alphanumeric mode, byte mode, and at version 7,
+// the first with version information. The last is compared by its SHA-256.
+func TestQRCode(t *testing.T) {
+	for _, ref := range []struct {
+		text string
+		rows []string
+	}{
+		{"HELLO WORLD", []string{
+			"#######...#.#.#######",
+			"#.....#.....#.#.....#",
+			"#.###.#.#.#...#.###.#",
+			"#.###.#.....#.#.###.#",
+			"#.###.#..#.##.#.###.#",
+			"#.....#..###..#.....#",
+			"#######.#.#.#.#######",
+			"........#.#..........",
+			"###.#####.#.###...#..",
+			"###.##..#.##....#...#",
+			"###.#.##.###..#.##...",
+			"#..##..#.#.###.#.###.",
+			"...#####.###..###.#.#",
+			"........#.#...#...#.#",
+			"#######.#...#..#.##..",
+			"#.....#.#.#...##.#...",
+			"#.###.#.##..#.#######",
+			"#.###.#...##.#.#...#.",
+			"#.###.#.#.##.###.#..#",
+			"#.....#.#..###...#.##",
+			"#######.#.##.###....#",
+		}},
+		{"alice@example", []string{
+			"#######..#.##.#######",
+			"#.....#.##.#..#.....#",
+			"#.###.#.##..#.#.###.#",
+			"#.###.#..#.#..#.###.#",
+			"#.###.#.#...#.#.###.#",
+			"#.....#.#..##.#.....#",
+			"#######.#.#.#.#######",
+			"........#####........",
+			"##.#..##.##...###.##.",
+			"..#.##...###.##.#.###",
+			".#.#####....####..#.#",
+			"#.#.##..#.##..#..#..#",
+			".##..#####.##..##...#",
+			"........#..##..#.##.#",
+			"#######.###.##.##.##.",
+			"#.....#..#.#...#.....",
+			"#.###.#..#.#.#.......",
+			"#.###.#.#.#.#..#...##",
+			"#.###.#..#.#######..#",
+			"#.....#.#..#.#..#....",
+			"#######.#.########.#.",
+		}},
+	} {
+		modules, err := QRCode(ref.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := qrString(modules), strings.Join(ref.rows, "\n")+"\n"; got != want {
+			t.Errorf("QR code of %q is\n%swant\n%s", ref.text, got, want)
+		}
+	}
+
+	modules, err := QRCode(strings.Repeat("ABCDEFGHIJKLMNOPQRSTUVWXYZ234567", 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modules) != 45 {
+		t.Fatalf("version 7 symbol is %d modules wide", len(modules))
+	}
+	sum := sha256.Sum256([]byte(qrString(modules)))
+	if got := hex.EncodeToString(sum[:]); got != "ebf36494a42a402f8ae54984329e31e0d98145ae05fa7d8da1ddb0aacb51c6b5" {
+		t.Errorf("version 7 symbol has SHA-256 %s", got)
+	}
+
+	if _, err := QRCode(strings.Repeat("a", 500)); err == nil {
+		t.Error("encoded text too long for version 10")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ratchet implements the Double Ratchet algorithm, which derives a new key
+// for every Text so that compromise of a session's current state does not
+// expose earlier Texts (forward secrecy), and a new Diffie-Hellman exchange
+// each time the conversation changes direction so that it does not expose
+// later ones either (break-in recovery).
+//
+// The responder (who accepted the Request) starts with its session key pair
+// as the ratchet key pair. The initiator starts by ratcheting against the
+// responder's session public key, so the first Text it sends begins a new
+// DH ratchet step. Until then the responder sends on a chain derived
+// directly from the shared key.
+//
+// A ratchet is not safe for concurrent use; Session guards it with its lock.
+//
+// See: https://signal.org/docs/specifications/doubleratchet/
+type ratchet struct {
+	dhPriv  []byte // our current ratchet private key
+	dhPub   []byte // our current ratchet public key
+	dhr     []byte // their current ratchet public key
+	rootKey []byte
+	sendCK  []byte // sending chain key
+	recvCK  []byte // receiving chain key
+	ns, nr  uint32 // number of keys taken from the sending/receiving chain
+	pn      uint32 // length of the previous sending chain
+	skipped map[skippedKey][]byte
+	order   []skippedKey // skipped keys, oldest first
+	retired []string     // their previous ratchet public keys, oldest first
+}
+
+// skippedKey identifies the message key of a Text not yet received.
+type skippedKey struct {
+	dh string
+	n  uint32
+}
+
+// Limits on skipped message keys. Each lost or retransmitted Text leaves a
+// skipped key behind, so the oldest are discarded beyond MaxSkippedKeys.
+const (
+	MaxSkip        = 1000 // max keys skipped in a single receiving chain step
+	MaxSkippedKeys = 2000 // max skipped keys stored per Session
+	MaxRetiredKeys = 64   // max previous ratchet keys of the other client remembered
+)
+
+// errUsedKey is returned by Decrypt when the message key for the header was
+// already used or discarded, such as for a replayed Text.
+var errUsedKey = errors.New("message key already used")
+
+// ratchetHeaderSize is the size of an encoded ratchet header: the sender's
+// 32 byte ratchet public key, then the previous chain length and message
+// number as 4 byte little endian integers.
+const ratchetHeaderSize = 40
+
+// newResponderRatchet creates the ratchet of the client which accepted the
+// Request, using its session key pair as the first ratchet key pair.
+func newResponderRatchet(sharedKey, sessPrivKey, sessPubKey []byte) (*ratchet, error) {
+	rk, ck, err := initialRatchetKeys(sharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ratchet{
+		dhPriv:  sessPrivKey,
+		dhPub:   sessPubKey,
+		rootKey: rk,
+		sendCK:  ck,
+		skipped: make(map[skippedKey][]byte),
+	}, nil
+}
+
+// newInitiatorRatchet creates the ratchet of the client which sent the
+// Request, where theirPubKey is the responder's session public key.
+func newInitiatorRatchet(sharedKey, theirPubKey []byte) (*ratchet, error) {
+	rk, ck, err := initialRatchetKeys(sharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ratchet{
+		dhr:     theirPubKey,
+		rootKey: rk,
+		recvCK:  ck,
+		skipped: make(map[skippedKey][]byte),
+	}
+
+	r.dhPriv, r.dhPub, err = Curve25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	r.rootKey, r.sendCK, err = kdfRoot(r.rootKey, r.dhPriv, r.dhr)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// initialRatchetKeys derives the first root key, and the chain key which the
+// responder uses until it receives a Text, from the session's shared key.
+func initialRatchetKeys(sharedKey []byte) (rootKey, chainKey []byte, err error) {
+	keys, err := DeriveKey(sharedKey, nil, "chat ratchet init", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// kdfRoot performs a DH ratchet step, deriving a new root key and chain key.
+func kdfRoot(rootKey, myPrivKey, theirPubKey []byte) (newRootKey, chainKey []byte, err error) {
+	dh, err := EDHSharedKey(myPrivKey, theirPubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(dh)
+
+	keys, err := DeriveKey(dh, rootKey, "chat ratchet root", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// kdfChain performs a symmetric ratchet step, deriving the next chain key
+// and a message key.
+func kdfChain(chainKey []byte) (nextChainKey, messageKey []byte) {
+	return SignHS256([]byte{2}, chainKey), SignHS256([]byte{1}, chainKey)
+}
+
+// Encrypt advances the sending chain, returning the encoded header and the
+// message key with which to seal a single Text.
+func (r *ratchet) Encrypt() (header, messageKey []byte, err error) {
+	if r.sendCK == nil {
+		return nil, nil, fmt.Errorf("ratchet cannot send")
+	}
+
+	header = make([]byte, ratchetHeaderSize)
+	copy(header, r.dhPub)
+	binary.LittleEndian.PutUint32(header[32:], r.pn)
+	binary.LittleEndian.PutUint32(header[36:], r.ns)
+
+	old := r.sendCK
+	r.sendCK, messageKey = kdfChain(r.sendCK)
+	r.ns++
+	wipe(old)
+	return header, messageKey, nil
+}
+
+// Decrypt finds the message key for the encoded header and passes it to
+// open, which should authenticate and decrypt a Text with it. The ratchet
+// is only changed if open succeeds, so forged or corrupted Texts cannot
+// disrupt it.
+func (r *ratchet) Decrypt(header []byte, open func(messageKey []byte) error) error {
+	if len(header) != ratchetHeaderSize {
+		return fmt.Errorf("bad ratchet header")
+	}
+	dh := header[:32]
+	pn := binary.LittleEndian.Uint32(header[32:])
+	n := binary.LittleEndian.Uint32(header[36:])
+
+	// a delayed or reordered Text
+	id := skippedKey{string(dh), n}
+	if mk, ok := r.skipped[id]; ok {
+		if err := open(mk); err != nil {
+			return err
+		}
+		delete(r.skipped, id)
+		wipe(mk)
+		return nil
+	}
+	if bytes.Equal(dh, r.dhr) && n < r.nr {
+		return errUsedKey
+	}
+	for _, old := range r.retired {
+		if old == string(dh) {
+			return errUsedKey
+		}
+	}
+
+	// work on a copy and commit it only if the Text is authentic
+	next := *r
+	var skipped []skippedMessageKey
+	var err error
+	if !bytes.Equal(dh, next.dhr) {
+		if skipped, err = next.skip(pn, skipped); err != nil {
+			return err
+		}
+		if err = next.step(dh); err != nil {
+			return err
+		}
+	}
+	if skipped, err = next.skip(n, skipped); err != nil {
+		return err
+	}
+
+	var mk []byte
+	next.recvCK, mk = kdfChain(next.recvCK)
+	next.nr++
+	defer wipe(mk)
+
+	if err = open(mk); err != nil {
+		return err
+	}
+
+	// keys replaced by the new state are no longer needed
+	old := *r
+	*r = next
+	for _, k := range [][2][]byte{
+		{old.dhPriv, r.dhPriv}, {old.rootKey, r.rootKey}, {old.recvCK, r.recvCK},
+		{old.sendCK, r.sendCK},
+	} {
+		if !bytes.Equal(k[0], k[1]) {
+			wipe(k[0])
+		}
+	}
+	for _, s := range skipped {
+		r.store(s.id, s.key)
+	}
+	return nil
+}
+
+// skippedMessageKey is a message key skipped in a Decrypt that has not yet
+// been committed to the ratchet.
+type skippedMessageKey struct {
+	id  skippedKey
+	key []byte
+}
+
+// skip advances the receiving chain up to message number until, collecting
+// the skipped message keys.
+func (r *ratchet) skip(until uint32, skipped []skippedMessageKey) ([]skippedMessageKey, error) {
+	if r.recvCK == nil {
+		return skipped, nil
+	}
+	if until > r.nr && until-r.nr > MaxSkip {
+		return skipped, fmt.Errorf("too many skipped messages")
+	}
+
+	for r.nr < until {
+		var mk []byte
+		r.recvCK, mk = kdfChain(r.recvCK)
+		skipped = append(skipped, skippedMessageKey{skippedKey{string(r.dhr), r.nr}, mk})
+		r.nr++
+	}
+	return skipped, nil
+}
+
+// step performs a DH ratchet step upon receiving a new ratchet public key.
+func (r *ratchet) step(theirPubKey []byte) (err error) {
+	if r.dhr != nil {
+		// copied, since r may be a copy of the ratchet which is discarded
+		r.retired = append(append([]string(nil), r.retired...), string(r.dhr))
+		if len(r.retired) > MaxRetiredKeys {
+			r.retired = r.retired[1:]
+		}
+	}
+	r.pn = r.ns
+	r.ns, r.nr = 0, 0
+	r.dhr = append([]byte(nil), theirPubKey...)
+
+	r.rootKey, r.recvCK, err = kdfRoot(r.rootKey, r.dhPriv, r.dhr)
+	if err != nil {
+		return
+	}
+
+	r.dhPriv, r.dhPub, err = Curve25519KeyPair()
+	if err != nil {
+		return
+	}
+	r.rootKey, r.sendCK, err = kdfRoot(r.rootKey, r.dhPriv, r.dhr)
+	return
+}
+
+// store remembers a skipped message key, discarding the oldest beyond
+// MaxSkippedKeys.
+func (r *ratchet) store(id skippedKey, mk []byte) {
+	r.skipped[id] = mk
+	r.order = append(r.order, id)
+
+	for len(r.order) > MaxSkippedKeys {
+		old := r.order[0]
+		r.order = r.order[1:]
+		if k, ok := r.skipped[old]; ok {
+			wipe(k)
+			delete(r.skipped, old)
+		}
+	}
+}
+
+// wipe erases all key material held by the ratchet.
+func (r *ratchet) wipe() {
+	for _, k := range [][]byte{r.dhPriv, r.rootKey, r.sendCK, r.recvCK} {
+		wipe(k)
+	}
+	for id, k := range r.skipped {
+		wipe(k)
+		delete(r.skipped, id)
+	}
+	r.order = nil
+	r.retired = nil
+}
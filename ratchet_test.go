@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newRatchets makes the ratchets of the initiator and responder of a session.
+func newRatchets(t *testing.T) (initiator, responder *ratchet) {
+	t.Helper()
+	priv, pub, err := Curve25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err = newResponderRatchet(fill(7, 32), priv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiator, err = newInitiatorRatchet(fill(7, 32), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+// ratchetText is a Text sealed with a message key from a ratchet.
+type ratchetText struct {
+	header, data []byte
+}
+
+func sealRatchet(t *testing.T, r *ratchet, msg string) ratchetText {
+	t.Helper()
+	header, mk, err := r.Encrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := AEADSeal([]byte(msg), mk, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ratchetText{header, data}
+}
+
+func openRatchet(r *ratchet, rt ratchetText) (msg string, err error) {
+	err = r.Decrypt(rt.header, func(mk []byte) error {
+		plaintext, err := AEADOpen(rt.data, mk, rt.header)
+		msg = string(plaintext)
+		return err
+	})
+	return
+}
+
+func TestRatchetConversation(t *testing.T) {
+	a, b := newRatchets(t)
+
+	// the responder can send before it receives anything
+	if msg, err := openRatchet(a, sealRatchet(t, b, "first")); err != nil || msg != "first" {
+		t.Fatalf("opened %q: %v", msg, err)
+	}
+
+	// each change of direction is a DH ratchet step with a new key
+	keys := map[string]bool{}
+	from, to := a, b
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 3; j++ {
+			rt := sealRatchet(t, from, "hi")
+			keys[string(rt.header[:32])] = true
+			if msg, err := openRatchet(to, rt); err != nil || msg != "hi" {
+				t.Fatalf("turn %d: opened %q: %v", i, msg, err)
+			}
+		}
+		if !bytes.Equal(to.dhr, from.dhPub) {
+			t.Fatalf("turn %d: receiver doesn't have the sender's ratchet key", i)
+		}
+		from, to = to, from
+	}
+	if len(keys) != 6 {
+		t.Fatalf("%d ratchet keys used in 6 turns", len(keys))
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	a, b := newRatchets(t)
+
+	var sent []ratchetText
+	for i := 0; i < 5; i++ {
+		sent = append(sent, sealRatchet(t, a, string(rune('0'+i))))
+	}
+	for _, i := range []int{4, 0, 2, 1, 3} {
+		if msg, err := openRatchet(b, sent[i]); err != nil || msg != string(rune('0'+i)) {
+			t.Fatalf("opened %q for Text %d: %v", msg, i, err)
+		}
+	}
+	if len(b.skipped) != 0 {
+		t.Fatalf("%d skipped keys left", len(b.skipped))
+	}
+
+	// a Text from a previous chain arrives after the next DH ratchet step
+	late := sealRatchet(t, a, "late")
+	if _, err := openRatchet(a, sealRatchet(t, b, "reply")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRatchet(b, sealRatchet(t, a, "next")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := openRatchet(b, late); err != nil || msg != "late" {
+		t.Fatalf("opened %q: %v", msg, err)
+	}
+}
+
+func TestRatchetReplay(t *testing.T) {
+	a, b := newRatchets(t)
+
+	one, two := sealRatchet(t, a, "one"), sealRatchet(t, a, "two")
+	for _, rt := range []ratchetText{two, one} {
+		if _, err := openRatchet(b, rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rt := range []ratchetText{one, two} {
+		if _, err := openRatchet(b, rt); !errors.Is(err, errUsedKey) {
+			t.Fatalf("replay: %v", err)
+		}
+	}
+
+	// and once the chain is retired
+	if _, err := openRatchet(a, sealRatchet(t, b, "reply")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRatchet(b, sealRatchet(t, a, "next")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRatchet(b, two); !errors.Is(err, errUsedKey) {
+		t.Fatalf("replay from a retired chain: %v", err)
+	}
+}
+
+func TestRatchetSkipLimit(t *testing.T) {
+	a, b := newRatchets(t)
+
+	// up to MaxSkip keys may be skipped in one step
+	for i := 0; i < MaxSkip; i++ {
+		a.Encrypt()
+	}
+	if _, err := openRatchet(b, sealRatchet(t, a, "hi")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxSkip+1; i++ {
+		a.Encrypt()
+	}
+	if _, err := openRatchet(b, sealRatchet(t, a, "hi")); err == nil {
+		t.Fatal("skipped more than MaxSkip keys")
+	}
+
+	// the oldest skipped keys are discarded beyond MaxSkippedKeys
+	a, b = newRatchets(t)
+	first := sealRatchet(t, a, "first")
+	for len(b.order) < MaxSkippedKeys {
+		for i := 0; i < MaxSkip-1; i++ {
+			a.Encrypt()
+		}
+		if _, err := openRatchet(b, sealRatchet(t, a, "hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(b.skipped) != MaxSkippedKeys {
+		t.Fatalf("%d skipped keys stored", len(b.skipped))
+	}
+	if _, err := openRatchet(b, first); !errors.Is(err, errUsedKey) {
+		t.Fatalf("opened a Text whose key was discarded: %v", err)
+	}
+}
+
+func TestRatchetFailedDecrypt(t *testing.T) {
+	a, b := newRatchets(t)
+	if _, err := openRatchet(b, sealRatchet(t, a, "hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRatchet(a, sealRatchet(t, b, "reply")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a Text which would skip keys and step the DH ratchet fails to open
+	a.Encrypt()
+	rt := sealRatchet(t, a, "next")
+	before := struct {
+		dhPriv, dhr, rootKey, recvCK, sendCK []byte
+		nr, ns, pn                           uint32
+		skipped                              int
+	}{
+		append([]byte(nil), b.dhPriv...), append([]byte(nil), b.dhr...),
+		append([]byte(nil), b.rootKey...), append([]byte(nil), b.recvCK...),
+		append([]byte(nil), b.sendCK...), b.nr, b.ns, b.pn, len(b.skipped),
+	}
+	forged := ratchetText{rt.header, append([]byte(nil), rt.data...)}
+	forged.data[len(forged.data)-1] ^= 1
+	if _, err := openRatchet(b, forged); err == nil {
+		t.Fatal("opened a forged Text")
+	}
+
+	// and leaves the ratchet as it was
+	for name, v := range map[string][2][]byte{
+		"private key": {before.dhPriv, b.dhPriv}, "their key": {before.dhr, b.dhr},
+		"root key": {before.rootKey, b.rootKey}, "receiving chain": {before.recvCK, b.recvCK},
+		"sending chain": {before.sendCK, b.sendCK},
+	} {
+		if !bytes.Equal(v[0], v[1]) {
+			t.Errorf("%s changed", name)
+		}
+	}
+	if b.nr != before.nr || b.ns != before.ns || b.pn != before.pn || len(b.skipped) != before.skipped {
+		t.Error("counters changed")
+	}
+	if msg, err := openRatchet(b, rt); err != nil || msg != "next" {
+		t.Fatalf("opened %q after a forgery: %v", msg, err)
+	}
+}
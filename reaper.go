@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ReapInterval is how often the Reaper looks for expired sessions.
+const ReapInterval = 10 * time.Second
+
+// Reaper runs a loop which removes expired sessions: Active sessions which
+// have been idle longer than SessionIdleTimeout and Pending sessions which
+// received no Response within PendingTimeout. Handshakes begun by other
+// clients which did not finish within PendingTimeout are also dropped.
+func (eng *ChatEngine) Reaper(ctx context.Context) {
+	ticker := time.NewTicker(ReapInterval)
+	defer ticker.Stop()
+
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case now := <-ticker.C:
+			eng.expireHandshakes(now)
+
+			for _, s := range eng.Sessions() {
+				if !s.IsExpired() {
+					continue
+				}
+
+				if eng.RemoveSession(s.Handle()) {
+					s.Close()
+					eng.emit(SessionExpired, s.Handle(), s, "session with %s expired", s.Peer())
+				}
+			}
+		}
+	}
+
+	log.Println("exiting reaper")
+}
+
+// DropSession ends the session with the handle. If the session is Active,
+// the other client is notified so it can end the session too.
+func (eng *ChatEngine) DropSession(h Handle) error {
+	s, ok := eng.GetSession(h)
+	if !ok {
+		return fmt.Errorf("%s not found", h)
+	}
+
+	var err error
+	if s.IsActive() {
+		err = s.SendClose() // drop locally regardless
+	}
+
+	eng.RemoveSession(h)
+	s.Close()
+	return err
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Relay server parameters.
+const (
+	RelayTTL               = 7 * 24 * time.Hour // how long Envelopes are held
+	MaxRelayEnvelope       = MaxMessageSize     // max size of an Envelope
+	MaxRelayEnvelopes      = 512                // max Envelopes held for a client
+	MaxRelayQuota          = 4 << 20            // max bytes held for a client
+	MaxRelayStorage        = 256 << 20          // max bytes held for all clients
+	MaxRelayFrame          = 1 << 20            // max size of a Relay message
+	MaxRelayConnDeposits   = 64                 // Envelopes deposited on a connection before it is closed
+	MaxRelaySourceDeposits = 1024               // Envelopes deposited from an IP address per RelaySourceWindow
+	RelaySourceWindow      = time.Hour
+	RelayConnectTimeout    = 10 * time.Second
+	RelayIdleTimeout       = 30 * time.Second // connections idle this long are closed
+)
+
+// RelayServer holds Envelopes for clients which may be offline, until they
+// fetch and acknowledge them. Clients connect over TCP and exchange Relay
+// messages, gob encoded in frames written by WriteFrame().
+//
+// Anyone may deposit Envelopes for a client's key, within the quotas and
+// the limits on deposits by connection and by source address. A client
+// fetching its Envelopes proves it holds the key by signing the challenge
+// the server sent when it connected. Envelopes are sealed to their
+// recipient, so the server never sees the Letters within, or who sent them.
+//
+// Envelopes are only kept in memory, and are lost if the server restarts.
+type RelayServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	boxes    map[string]*mailbox        // keyed by string(key)
+	sources  map[string]*sourceDeposits // keyed by IP address
+	stored   int                        // bytes held for all clients
+	lastID   uint64
+}
+
+// mailbox holds the Envelopes for a client.
+type mailbox struct {
+	envelopes []heldEnvelope
+	size      int
+}
+
+type heldEnvelope struct {
+	Envelope
+	expires time.Time
+}
+
+// sourceDeposits counts the Envelopes deposited from an IP address since
+// the start of its RelaySourceWindow.
+type sourceDeposits struct {
+	count int
+	reset time.Time // end of the window
+}
+
+// NewRelayServer makes a RelayServer listening on port.
+func NewRelayServer(port string) (*RelayServer, error) {
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	return newRelayServer(l), nil
+}
+
+func newRelayServer(l net.Listener) *RelayServer {
+	return &RelayServer{
+		listener: l,
+		boxes:    make(map[string]*mailbox),
+		sources:  make(map[string]*sourceDeposits),
+	}
+}
+
+// Addr gets the address the server listens on.
+func (rs *RelayServer) Addr() net.Addr { return rs.listener.Addr() }
+
+// Run serves clients until ctx is done, when the listener is closed.
+func (rs *RelayServer) Run(ctx context.Context) {
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := rs.listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return // closed
+				}
+				if delay = retryDelay(err, delay); delay == 0 {
+					log.Printf("relay server: %s\n", err)
+					return
+				}
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			go rs.serve(conn)
+		}
+	}()
+
+	expire := time.NewTicker(time.Minute)
+	defer expire.Stop()
+
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case now := <-expire.C:
+			rs.expire(now)
+		}
+	}
+
+	rs.listener.Close()
+	log.Println("exiting relay server")
+}
+
+// serve a client's connection until it closes, is idle, or made
+// MaxRelayConnDeposits deposits.
+func (rs *RelayServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Println(err)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(RelayIdleTimeout))
+	if err := writeRelay(conn, &Relay{Op: RelayChallenge, Nonce: nonce}); err != nil {
+		return
+	}
+
+	var client ed25519.PublicKey // once it signed the challenge
+	var deposits int
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(RelayIdleTimeout))
+		req, err := readRelay(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("relay from %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var resp *Relay
+		if req.Op == RelayDeposit {
+			deposits += len(req.Envelopes)
+		}
+		if deposits > MaxRelayConnDeposits {
+			err = fmt.Errorf("too many deposits")
+		} else {
+			resp, err = rs.process(req, nonce, ip, &client)
+		}
+		if err != nil {
+			resp = &Relay{Op: RelayError, Error: err.Error()}
+		}
+		if err = writeRelay(conn, resp); err != nil {
+			return
+		}
+		if deposits >= MaxRelayConnDeposits {
+			return // the client connects again to deposit more
+		}
+	}
+}
+
+// process handles a Relay message from a client at the IP address, which
+// was sent the nonce. client is set once it signs the challenge.
+func (rs *RelayServer) process(req *Relay, nonce []byte, ip string, client *ed25519.PublicKey) (*Relay, error) {
+	switch req.Op {
+	case RelayDeposit:
+		if len(req.Key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key")
+		}
+		if !rs.allowDeposits(ip, len(req.Envelopes), time.Now()) {
+			return nil, fmt.Errorf("too many deposits from %s", ip)
+		}
+		var envelopes [][]byte
+		for _, e := range req.Envelopes {
+			envelopes = append(envelopes, e.Data)
+		}
+		if err := rs.deposit(req.Key, envelopes...); err != nil {
+			return nil, err
+		}
+		return &Relay{Op: RelayOK}, nil
+
+	case RelayFetch:
+		if len(req.Key) != ed25519.PublicKeySize ||
+			!ValidSignatureEd25519(req.Signature, relayChallenge(nonce), req.Key) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+		*client = req.Key
+		return &Relay{Op: RelayDelivery, Envelopes: rs.held(req.Key)}, nil
+
+	case RelayAck:
+		if *client == nil {
+			return nil, fmt.Errorf("fetch before acknowledging")
+		}
+		rs.remove(*client, req.IDs)
+		return &Relay{Op: RelayOK}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected operation %d", req.Op)
+}
+
+// deposit holds Envelopes for the client with the key. Either all of them
+// are held, or none if any is invalid or they don't fit in the quotas, so
+// that a client repeating a failed deposit doesn't duplicate Envelopes.
+func (rs *RelayServer) deposit(key ed25519.PublicKey, envelopes ...[]byte) error {
+	var size int
+	for _, data := range envelopes {
+		if len(data) == 0 || len(data) > MaxRelayEnvelope {
+			return fmt.Errorf("invalid envelope size")
+		}
+		size += len(data)
+	}
+	if len(envelopes) == 0 {
+		return nil
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	box, ok := rs.boxes[string(key)]
+	if !ok {
+		box = &mailbox{}
+	}
+	switch {
+	case len(box.envelopes)+len(envelopes) > MaxRelayEnvelopes || box.size+size > MaxRelayQuota:
+		return fmt.Errorf("mailbox full")
+	case rs.stored+size > MaxRelayStorage:
+		return fmt.Errorf("relay full")
+	}
+
+	expires := time.Now().Add(RelayTTL)
+	for _, data := range envelopes {
+		rs.lastID++
+		box.envelopes = append(box.envelopes, heldEnvelope{
+			Envelope: Envelope{ID: rs.lastID, Data: append([]byte(nil), data...)},
+			expires:  expires,
+		})
+	}
+	box.size += size
+	rs.stored += size
+	rs.boxes[string(key)] = box
+	return nil
+}
+
+// allowDeposits counts n deposits from the IP address, unless that would
+// exceed MaxRelaySourceDeposits in its current window.
+func (rs *RelayServer) allowDeposits(ip string, n int, now time.Time) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	src, ok := rs.sources[ip]
+	if !ok || now.After(src.reset) {
+		src = &sourceDeposits{reset: now.Add(RelaySourceWindow)}
+		rs.sources[ip] = src
+	}
+	if src.count+n > MaxRelaySourceDeposits {
+		return false
+	}
+	src.count += n
+	return true
+}
+
+// held gets the oldest Envelopes held for the client with the key, as many
+// as fit in a Relay message.
+func (rs *RelayServer) held(key ed25519.PublicKey) []Envelope {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	box, ok := rs.boxes[string(key)]
+	if !ok {
+		return nil
+	}
+
+	var envelopes []Envelope
+	size := 1024 // allowance for the rest of the message
+	for _, e := range box.envelopes {
+		if size += len(e.Data) + 16; size > MaxRelayFrame {
+			break
+		}
+		envelopes = append(envelopes, e.Envelope)
+	}
+	return envelopes
+}
+
+// remove the Envelopes with the IDs held for the client with the key.
+func (rs *RelayServer) remove(key ed25519.PublicKey, ids []uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	box, ok := rs.boxes[string(key)]
+	if !ok {
+		return
+	}
+	acked := make(map[uint64]bool)
+	for _, id := range ids {
+		acked[id] = true
+	}
+
+	kept := box.envelopes[:0]
+	for _, e := range box.envelopes {
+		if acked[e.ID] {
+			box.size -= len(e.Data)
+			rs.stored -= len(e.Data)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	box.envelopes = kept
+	if len(kept) == 0 {
+		delete(rs.boxes, string(key))
+	}
+}
+
+// expire drops Envelopes held longer than RelayTTL, and the deposit counts
+// of finished windows.
+func (rs *RelayServer) expire(now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for ip, src := range rs.sources {
+		if now.After(src.reset) {
+			delete(rs.sources, ip)
+		}
+	}
+
+	for key, box := range rs.boxes {
+		kept := box.envelopes[:0]
+		for _, e := range box.envelopes {
+			if now.After(e.expires) {
+				box.size -= len(e.Data)
+				rs.stored -= len(e.Data)
+				continue
+			}
+			kept = append(kept, e)
+		}
+		box.envelopes = kept
+		if len(kept) == 0 {
+			delete(rs.boxes, key)
+		}
+	}
+}
+
+// relayChallenge gets the data a client signs to fetch its Envelopes. It
+// is prefixed so the signature is of no use elsewhere.
+func relayChallenge(nonce []byte) []byte {
+	return append([]byte("chat relay fetch\x00"), nonce...)
+}
+
+// writeRelay writes a Relay message in a frame.
+func writeRelay(w io.Writer, r *Relay) error {
+	data, err := gobEncode(r)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, data)
+}
+
+// readRelay reads a Relay message from a frame.
+func readRelay(r io.Reader) (*Relay, error) {
+	data, err := ReadFrame(r, MaxRelayFrame)
+	if err != nil {
+		return nil, err
+	}
+
+	relay := &Relay{}
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(relay); err != nil {
+		return nil, err
+	}
+	return relay, nil
+}
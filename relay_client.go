@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+// Letters are sealed into Envelopes with the recipient's identity key, much
+// like a sealed box. The sender makes an ephemeral X25519 key pair, and the
+// Envelope's data is:
+//
+//	ephemeral  32 bytes  ephemeral X25519 public key
+//	sealed     the rest  AEADSeal() of the sender's signature (64 bytes)
+//	                     followed by the gob encoded Letter
+//
+// The sealing key is derived from the X25519 shared secret of the ephemeral
+// key and the recipient's Ed25519 key converted to X25519, with the two
+// public keys as salt. Only the recipient can open the Envelope, and the
+// signature inside shows who sent it.
+
+// RelayPollInterval is how often the Collector fetches Letters.
+const RelayPollInterval = 30 * time.Second
+
+// letterInfo distinguishes keys derived for sealing Letters.
+const letterInfo = "chat relay letter"
+
+// sealLetter signs a Letter from this client and seals it to its recipient.
+func (eng *ChatEngine) sealLetter(l *Letter) ([]byte, error) {
+	recipient, err := Ed25519PublicKeyToCurve25519(l.To)
+	if err != nil {
+		return nil, err
+	}
+	body, err := gobEncode(l)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := append(SignEd25519(eng.PrivSignKey, body), body...)
+
+	private, public, err := Curve25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(private)
+	secret, err := EDHSharedKey(private, recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(secret)
+	key, err := DeriveKey(secret, append(append([]byte(nil), public...), recipient...), letterInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+
+	sealed, err := AEADSeal(plaintext, key, public)
+	if err != nil {
+		return nil, err
+	}
+	return append(public, sealed...), nil
+}
+
+// openLetter opens an Envelope sealed to this client, returning the Letter
+// and the sender's signature.
+func (eng *ChatEngine) openLetter(data []byte) (*Letter, []byte, error) {
+	if len(data) < 32 {
+		return nil, nil, fmt.Errorf("envelope too short")
+	}
+	public, sealed := data[:32], data[32:]
+
+	private := Ed25519PrivateKeyToCurve25519(eng.PrivSignKey)
+	defer wipe(private)
+	recipient, err := Ed25519PublicKeyToCurve25519(eng.PrivSignKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := EDHSharedKey(private, public)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(secret)
+	key, err := DeriveKey(secret, append(append([]byte(nil), public...), recipient...), letterInfo, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(key)
+
+	plaintext, err := AEADOpen(sealed, key, public)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plaintext) < ed25519.SignatureSize {
+		return nil, nil, fmt.Errorf("letter too short")
+	}
+	signature, body := plaintext[:ed25519.SignatureSize], plaintext[ed25519.SignatureSize:]
+
+	l := &Letter{}
+	if err = gob.NewDecoder(bytes.NewReader(body)).Decode(l); err != nil {
+		return nil, nil, err
+	}
+	if l.From == nil || len(l.From.PublicSigningKey) != ed25519.PublicKeySize {
+		return nil, nil, fmt.Errorf("letter has no valid sender")
+	}
+	if !ValidSignatureEd25519(signature, body, l.From.PublicSigningKey) {
+		return nil, nil, fmt.Errorf("invalid signature")
+	}
+	if err = l.From.Verify(); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(l.To, eng.PrivSignKey.Public().(ed25519.PublicKey)) {
+		return nil, nil, fmt.Errorf("letter is for someone else")
+	}
+	return l, signature, nil
+}
+
+// relayConn is a connection to the Relay server.
+type relayConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	nonce []byte // challenge sent by the server
+}
+
+// dialRelay connects to the Relay server.
+func (eng *ChatEngine) dialRelay() (*relayConn, error) {
+	if eng.Relay == "" {
+		return nil, fmt.Errorf("no relay server")
+	}
+	conn, err := net.DialTimeout("tcp", eng.Relay, RelayConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &relayConn{conn: conn, r: bufio.NewReader(conn)}
+	resp, err := rc.receive()
+	if err == nil && resp.Op != RelayChallenge {
+		err = fmt.Errorf("unexpected operation %d", resp.Op)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rc.nonce = resp.Nonce
+	return rc, nil
+}
+
+// exchange sends a request and receives the response, which is an error if
+// it is a RelayError.
+func (rc *relayConn) exchange(req *Relay) (*Relay, error) {
+	rc.conn.SetDeadline(time.Now().Add(RelayIdleTimeout))
+	if err := writeRelay(rc.conn, req); err != nil {
+		return nil, err
+	}
+	resp, err := rc.receive()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Op == RelayError {
+		return nil, fmt.Errorf("relay server: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+func (rc *relayConn) receive() (*Relay, error) {
+	rc.conn.SetDeadline(time.Now().Add(RelayIdleTimeout))
+	return readRelay(rc.r)
+}
+
+// deposit Letters with the Relay server, returning how many it accepted.
+func (eng *ChatEngine) deposit(letters []*Letter) (int, error) {
+	rc, err := eng.dialRelay()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { rc.conn.Close() }()
+
+	for i, l := range letters {
+		if i > 0 && i%MaxRelayConnDeposits == 0 {
+			// the server closed the connection after as many deposits
+			rc.conn.Close()
+			if rc, err = eng.dialRelay(); err != nil {
+				return i, err
+			}
+		}
+		data, err := eng.sealLetter(l)
+		if err != nil {
+			return i, err
+		}
+		_, err = rc.exchange(&Relay{Op: RelayDeposit, Key: l.To, Envelopes: []Envelope{{Data: data}}})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(letters), nil
+}
+
+// relayPending deposits the pending messages for the contact with the key
+// with the Relay server, removing those it accepted from the outbox.
+func (eng *ChatEngine) relayPending(key ed25519.PublicKey) error {
+	if eng.Relay == "" {
+		return fmt.Errorf("no relay server")
+	}
+
+	// claim the messages, so they are not sent by a session meanwhile
+	eng.mu.Lock()
+	var send []*OutboxEntry
+	var letters []*Letter
+	for _, p := range eng.outbox {
+		if p.sess == nil && !p.relaying && bytes.Equal(p.To, key) {
+			p.relaying = true
+			send = append(send, p)
+			letters = append(letters, &Letter{From: eng.me, To: p.To, Message: p.Message, TimeStamp: p.Queued})
+		}
+	}
+	eng.mu.Unlock()
+	if len(send) == 0 {
+		return nil
+	}
+
+	n, err := eng.deposit(letters)
+
+	eng.mu.Lock()
+	relayed := make(map[*OutboxEntry]bool)
+	for _, p := range send[:n] {
+		relayed[p] = true
+	}
+	kept := eng.outbox[:0]
+	for _, p := range eng.outbox {
+		if !relayed[p] {
+			kept = append(kept, p)
+		}
+	}
+	eng.outbox = kept
+	for _, p := range send[n:] {
+		p.relaying = false
+	}
+	eng.mu.Unlock()
+
+	if n > 0 {
+		log.Printf("left %d messages for %s with the relay server\n", n, send[0].Name)
+		if err := eng.SaveOutbox(); err != nil {
+			log.Println(err)
+		}
+	}
+	return err
+}
+
+// FetchLetters fetches the Letters held for this client by the Relay
+// server, reporting each with a LetterReceived event. Return value is how
+// many were received.
+func (eng *ChatEngine) FetchLetters() (int, error) {
+	rc, err := eng.dialRelay()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.conn.Close()
+
+	key := eng.PrivSignKey.Public().(ed25519.PublicKey)
+	signature := SignEd25519(eng.PrivSignKey, relayChallenge(rc.nonce))
+
+	var count int
+	for {
+		resp, err := rc.exchange(&Relay{Op: RelayFetch, Key: key, Signature: signature})
+		if err != nil {
+			return count, err
+		}
+		if len(resp.Envelopes) == 0 {
+			return count, nil
+		}
+
+		// all are acknowledged, since those which can't be read never will be
+		var ids []uint64
+		for _, e := range resp.Envelopes {
+			ids = append(ids, e.ID)
+			if eng.receiveLetter(e.Data) {
+				count++
+			}
+		}
+		// saved first, so the Letters can't be replayed after a restart
+		if err = eng.SaveLetters(); err != nil {
+			log.Println(err)
+		}
+		if _, err = rc.exchange(&Relay{Op: RelayAck, IDs: ids}); err != nil {
+			return count, err
+		}
+	}
+}
+
+// receiveLetter opens an Envelope and reports the Letter within, unless it
+// is a replay or from a contact whose key changed.
+func (eng *ChatEngine) receiveLetter(data []byte) bool {
+	l, signature, err := eng.openLetter(data)
+	if err != nil {
+		eng.emit(DecodeError, "", nil, "letter from relay server: %s", err)
+		return false
+	}
+
+	now := time.Now()
+	if age := now.Sub(l.TimeStamp.Time()); age > RelayTTL || age < -MaxRendezvousAge {
+		eng.emit(DecodeError, "", l, "letter from %s is too old", l.From)
+		return false
+	}
+	eng.mu.Lock()
+	for sig, expires := range eng.letters {
+		if now.After(expires) {
+			delete(eng.letters, sig)
+		}
+	}
+	_, replayed := eng.letters[string(signature)]
+	eng.letters[string(signature)] = l.TimeStamp.Time().Add(RelayTTL)
+	eng.mu.Unlock()
+	if replayed {
+		log.Printf("dropped replayed letter from %s\n", l.From)
+		return false
+	}
+
+	if _, changed := eng.checkIdentity(l.From); changed {
+		eng.emit(KeyChanged, "", l, "%s has a new key. letter rejected", l.From)
+		return false
+	}
+	if err := eng.acceptProfile(l.From); err != nil {
+		eng.emit(Error, "", l, "letter rejected: %s", err)
+		return false
+	}
+
+	var h Handle
+	if c, ok := eng.contactByKey(l.From.PublicSigningKey); ok {
+		h = c.Handle()
+	}
+	eng.emit(LetterReceived, h, l, "new letter from %s", l.From)
+	return true
+}
+
+// SeenLetter is a Letter received before, which is dropped if it is
+// replayed until it Expires.
+type SeenLetter struct {
+	Signature []byte // the sender's, which is unique to the Letter
+	Expires   time.Time
+}
+
+// ReadLetters reads the Letters received before in JSON format from
+// filename.
+func ReadLetters(filename string) (seen []SeenLetter, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &seen)
+	return
+}
+
+// WriteLetters writes the Letters received before in JSON format to
+// filename.
+func WriteLetters(seen []SeenLetter, filename string) error {
+	data, err := json.MarshalIndent(seen, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// LoadLetters adds Letters received before, such as those read by
+// ReadLetters(), to the Letters whose replays are dropped.
+func (eng *ChatEngine) LoadLetters(seen []SeenLetter) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+
+	for _, l := range seen {
+		if len(l.Signature) == ed25519.SignatureSize {
+			eng.letters[string(l.Signature)] = l.Expires
+		}
+	}
+}
+
+// SaveLetters writes the Letters received before to LettersFile, if set.
+func (eng *ChatEngine) SaveLetters() error {
+	if eng.LettersFile == "" {
+		return nil
+	}
+
+	eng.mu.RLock()
+	seen := make([]SeenLetter, 0, len(eng.letters))
+	for sig, expires := range eng.letters {
+		seen = append(seen, SeenLetter{Signature: []byte(sig), Expires: expires})
+	}
+	eng.mu.RUnlock()
+	return WriteLetters(seen, eng.LettersFile)
+}
+
+// Collector runs a loop which fetches Letters from the Relay server when
+// started and every RelayPollInterval.
+func (eng *ChatEngine) Collector(ctx context.Context) {
+	ticker := time.NewTicker(RelayPollInterval)
+	defer ticker.Stop()
+
+	collect := func() {
+		if _, err := eng.FetchLetters(); err != nil {
+			log.Printf("fetching letters from %s: %s\n", eng.Relay, err)
+		}
+	}
+
+	collect()
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case <-ticker.C:
+			collect()
+		}
+	}
+
+	log.Println("exiting collector")
+}
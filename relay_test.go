@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRelay runs a RelayServer on loopback.
+func newTestRelay(t *testing.T) *RelayServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := newRelayServer(l)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go rs.Run(ctx)
+	return rs
+}
+
+// relayEngine makes an engine using the relay server rs.
+func relayEngine(t *testing.T, rs *RelayServer, name string) *ChatEngine {
+	t.Helper()
+	eng := newTestEngine(t, NewMemoryNetwork(), name)
+	eng.Relay = rs.Addr().String()
+	return eng
+}
+
+func publicKey(eng *ChatEngine) ed25519.PublicKey {
+	return eng.PrivSignKey.Public().(ed25519.PublicKey)
+}
+
+func TestRelayServer(t *testing.T) {
+	rs := newTestRelay(t)
+	a, b := relayEngine(t, rs, "alice"), relayEngine(t, rs, "bob")
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b.LettersFile = filepath.Join(dir, "contacts.letters")
+
+	// deposit
+	letter := &Letter{From: a.Me(), To: publicKey(b), Message: "hi bob", TimeStamp: Now()}
+	sealed, err := a.sealLetter(letter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := a.dialRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.conn.Close()
+	deposit := &Relay{Op: RelayDeposit, Key: publicKey(b), Envelopes: []Envelope{{Data: sealed}}}
+	if _, err := rc.exchange(deposit); err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch and ack
+	n, err := b.FetchLetters()
+	if err != nil || n != 1 {
+		t.Fatalf("fetched %d letters: %v", n, err)
+	}
+	if ev := waitEvent(t, b, LetterReceived); ev.Data.(*Letter).Message != "hi bob" {
+		t.Fatalf("received %q", ev.Data.(*Letter).Message)
+	}
+	if held := rs.held(publicKey(b)); len(held) != 0 {
+		t.Fatalf("%d envelopes held after ack", len(held))
+	}
+
+	// a replay is dropped, even by an engine which restarted
+	if _, err := rc.exchange(deposit); err != nil {
+		t.Fatal(err)
+	}
+	seen, err := ReadLetters(b.LettersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewChatEngine(NewMemoryNetwork().Transport("bob:1"), b.PrivSignKey, b.Me(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.Relay = b.Relay
+	restarted.LoadLetters(seen)
+	if n, err := restarted.FetchLetters(); err != nil || n != 0 {
+		t.Fatalf("fetched %d replayed letters: %v", n, err)
+	}
+	if held := rs.held(publicKey(b)); len(held) != 0 {
+		t.Fatal("replayed letter was not fetched")
+	}
+
+	// fetching needs the challenge signed by the key
+	rc, err = b.dialRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.conn.Close()
+	if _, err := rc.exchange(&Relay{Op: RelayAck, IDs: []uint64{1}}); err == nil {
+		t.Error("acknowledged before fetching")
+	}
+	forged := SignEd25519(a.PrivSignKey, relayChallenge(rc.nonce))
+	_, err = rc.exchange(&Relay{Op: RelayFetch, Key: publicKey(b), Signature: forged})
+	if err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Fatalf("fetched with a bad signature: %v", err)
+	}
+}
+
+func TestRelayQuota(t *testing.T) {
+	rs := newRelayServer(nil)
+	_, key, err := Ed25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxRelayEnvelopes-1; i++ {
+		if err := rs.deposit(key, []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a deposit is refused whole, not partly held
+	if err := rs.deposit(key, []byte{1}, []byte{2}); err == nil {
+		t.Fatal("deposited beyond the quota")
+	}
+	if err := rs.deposit(key, []byte{1}, make([]byte, MaxRelayEnvelope+1)); err == nil {
+		t.Fatal("deposited an oversized envelope")
+	}
+	if held := rs.held(key); len(held) != MaxRelayEnvelopes-1 {
+		t.Fatalf("%d envelopes held after refused deposits", len(held))
+	}
+	if err := rs.deposit(key, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// deposits from an address are limited until its window ends
+	now := time.Now()
+	if !rs.allowDeposits("192.0.2.1", MaxRelaySourceDeposits, now) {
+		t.Fatal("refused deposits within the limit")
+	}
+	if rs.allowDeposits("192.0.2.1", 1, now) {
+		t.Fatal("allowed deposits beyond the limit")
+	}
+	if !rs.allowDeposits("192.0.2.2", 1, now) {
+		t.Fatal("limited another address")
+	}
+	if !rs.allowDeposits("192.0.2.1", 1, now.Add(RelaySourceWindow+time.Second)) {
+		t.Fatal("limited the address after its window")
+	}
+}
+
+func TestRelayConnDeposits(t *testing.T) {
+	rs := newTestRelay(t)
+	a, b := relayEngine(t, rs, "alice"), relayEngine(t, rs, "bob")
+
+	// more letters than a connection may deposit are sent on several
+	var letters []*Letter
+	for i := 0; i < MaxRelayConnDeposits+1; i++ {
+		letters = append(letters, &Letter{From: a.Me(), To: publicKey(b), Message: "hi", TimeStamp: Now()})
+	}
+	if n, err := a.deposit(letters); err != nil || n != len(letters) {
+		t.Fatalf("deposited %d letters: %v", n, err)
+	}
+
+	// but not on one
+	rc, err := a.dialRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.conn.Close()
+	envelopes := make([]Envelope, MaxRelayConnDeposits+1)
+	for i := range envelopes {
+		envelopes[i].Data = []byte{1}
+	}
+	if _, err := rc.exchange(&Relay{Op: RelayDeposit, Key: publicKey(b), Envelopes: envelopes}); err == nil {
+		t.Fatal("deposited too many envelopes on a connection")
+	}
+	if _, err := rc.exchange(&Relay{Op: RelayDeposit, Key: publicKey(b), Envelopes: envelopes[:1]}); err == nil {
+		t.Fatal("connection stayed open")
+	}
+}
+
+func TestRelayPoisonedLetter(t *testing.T) {
+	rs := newTestRelay(t)
+	a, b := relayEngine(t, rs, "alice"), relayEngine(t, rs, "bob")
+
+	// a Letter from a Profile with a short key is left with a good one
+	mallory := &Profile{Name: "mallory", Address: "m", Port: "1", PublicSigningKey: []byte{1, 2, 3}}
+	var envelopes []Envelope
+	for _, l := range []*Letter{
+		{From: mallory, To: publicKey(b), Message: "boom", TimeStamp: Now()},
+		{From: a.Me(), To: publicKey(b), Message: "hi bob", TimeStamp: Now()},
+	} {
+		sealed, err := a.sealLetter(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelopes = append(envelopes, Envelope{Data: sealed})
+	}
+	rc, err := a.dialRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.conn.Close()
+	if _, err := rc.exchange(&Relay{Op: RelayDeposit, Key: publicKey(b), Envelopes: envelopes}); err != nil {
+		t.Fatal(err)
+	}
+
+	// it is reported and acknowledged with the other
+	if n, err := b.FetchLetters(); err != nil || n != 1 {
+		t.Fatalf("fetched %d letters: %v", n, err)
+	}
+	if ev := waitEvent(t, b, DecodeError); !strings.Contains(ev.Message, "no valid sender") {
+		t.Errorf("decode error %q", ev.Message)
+	}
+	if ev := waitEvent(t, b, LetterReceived); ev.Data.(*Letter).Message != "hi bob" {
+		t.Fatalf("received %q", ev.Data.(*Letter).Message)
+	}
+	if held := rs.held(publicKey(b)); len(held) != 0 {
+		t.Fatalf("%d envelopes held after ack", len(held))
+	}
+}
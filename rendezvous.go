@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Rendezvous tuning parameters.
+const (
+	RegistrationTTL  = 2 * time.Minute  // how long the server remembers a registration
+	RegisterInterval = 25 * time.Second // how often clients register. keeps NAT mappings open
+	MaxRegistrations = 10000            // max clients registered with a server
+	MaxRendezvousAge = time.Minute      // max age of a signed Rendezvous message
+)
+
+// RendezvousServer helps clients behind NAT reach each other. Clients
+// register the key they are known by, and the server records the address
+// their registration came from. When a client asks to be introduced to
+// another by key fingerprint, the server tells each client the other's
+// address, and both send punch packets to open a path through their NATs.
+//
+// A client registering must sign a nonce the server challenged it with,
+// which the server makes from the client's address, so that a Register seen
+// by others cannot be replayed from their own address to take over the
+// registration. The nonce is valid for the MaxRendezvousAge in which it was
+// made and the next, and the server keeps no state for it.
+//
+// The server also answers STUN Binding requests, so clients may use it to
+// discover their mapped address.
+//
+// The server is never trusted with more than addresses: sessions are still
+// established by the usual handshake, which authenticates both clients.
+type RendezvousServer struct {
+	transport Transport
+	secret    []byte // keys challenge nonces. see nonce()
+	mu        sync.Mutex
+	clients   map[string]*registration // keyed by Fingerprint() of key
+}
+
+// registration is a client registered with a RendezvousServer.
+type registration struct {
+	key      ed25519.PublicKey
+	endpoint string
+	expires  time.Time
+}
+
+// NewRendezvousServer makes a RendezvousServer using transport.
+func NewRendezvousServer(transport Transport) (*RendezvousServer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &RendezvousServer{
+		transport: transport,
+		secret:    secret,
+		clients:   make(map[string]*registration),
+	}, nil
+}
+
+// Run serves clients until ctx is done. The Transport is closed when ctx
+// is done.
+func (rs *RendezvousServer) Run(ctx context.Context) {
+	defer rs.transport.Close()
+
+	reassembler := NewReassembler()
+	expire := time.NewTicker(time.Second)
+	defer expire.Stop()
+
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case now := <-expire.C:
+			reassembler.Expire(now)
+			rs.expire(now)
+
+		case p, ok := <-rs.transport.Receive():
+			if !ok {
+				done = true
+				break
+			}
+
+			if isSTUN(p.Data) {
+				rs.bind(p.Data, p.Addr)
+				break
+			}
+
+			data, err := reassembler.Add(p.Addr, p.Data)
+			if err != nil || data == nil {
+				continue
+			}
+
+			m, err := decodeMessage(data, p.Addr)
+			if err == nil {
+				err = rs.process(m)
+			}
+			if err != nil {
+				log.Printf("rendezvous from %s: %s\n", p.Addr, err)
+			}
+		}
+	}
+
+	log.Println("exiting rendezvous server")
+}
+
+// process handles a Message from a client.
+func (rs *RendezvousServer) process(m *Message) error {
+	if m.Type != PayloadRendezvous {
+		return fmt.Errorf("unexpected message type %d", m.Type)
+	}
+	r, err := m.GetRendezvous()
+	if err != nil {
+		return err
+	}
+	if m.Signature == nil {
+		return fmt.Errorf("unsigned")
+	}
+	if age := time.Since(r.TimeStamp.Time()); age > MaxRendezvousAge || age < -MaxRendezvousAge {
+		return fmt.Errorf("stale")
+	}
+
+	switch r.Op {
+	case RendezvousRegister:
+		if !rs.validNonce(r.Nonce, m.addr) {
+			return rs.send(m.addr, &Rendezvous{Op: RendezvousChallenge, Nonce: rs.nonce(m.addr, time.Now())})
+		}
+		if err := rs.register(r.Key, m.addr); err != nil {
+			return err
+		}
+		return rs.send(m.addr, &Rendezvous{Op: RendezvousRegistered, Key: r.Key, Endpoint: m.addr})
+
+	case RendezvousIntroduce:
+		from, ok := rs.lookup(Fingerprint(r.Key))
+		if !ok || from.endpoint != m.addr {
+			return fmt.Errorf("introduction requested by unregistered client")
+		}
+
+		to, ok := rs.lookup(r.Target)
+		if !ok {
+			return rs.send(m.addr, &Rendezvous{Op: RendezvousNotFound, Target: r.Target})
+		}
+
+		// tell both, so that they punch at the same time
+		err := rs.send(to.endpoint, &Rendezvous{Op: RendezvousIntroduction, Key: from.key, Endpoint: from.endpoint})
+		if err != nil {
+			return err
+		}
+		return rs.send(from.endpoint, &Rendezvous{Op: RendezvousIntroduction, Key: to.key, Endpoint: to.endpoint})
+	}
+
+	return fmt.Errorf("unexpected operation %d", r.Op)
+}
+
+// nonce makes the challenge for a client at addr, during the MaxRendezvousAge
+// including t.
+func (rs *RendezvousServer) nonce(addr string, t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.Unix()/int64(MaxRendezvousAge/time.Second)))
+	return SignHS256(append(b, addr...), rs.secret)[:16]
+}
+
+// validNonce determines if nonce is a recent challenge for a client at addr.
+func (rs *RendezvousServer) validNonce(nonce []byte, addr string) bool {
+	now := time.Now()
+	return hmac.Equal(nonce, rs.nonce(addr, now)) ||
+		hmac.Equal(nonce, rs.nonce(addr, now.Add(-MaxRendezvousAge)))
+}
+
+// register records that the client with the key is at endpoint.
+func (rs *RendezvousServer) register(key ed25519.PublicKey, endpoint string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	fp := Fingerprint(key)
+	if _, ok := rs.clients[fp]; !ok && len(rs.clients) >= MaxRegistrations {
+		return fmt.Errorf("too many registrations")
+	}
+
+	rs.clients[fp] = &registration{
+		key:      key,
+		endpoint: endpoint,
+		expires:  time.Now().Add(RegistrationTTL),
+	}
+	return nil
+}
+
+// lookup finds the registration with the fingerprint.
+func (rs *RendezvousServer) lookup(fingerprint string) (registration, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.clients[fingerprint]
+	if !ok || time.Now().After(r.expires) {
+		return registration{}, false
+	}
+	return *r, true
+}
+
+// expire forgets registrations which were not renewed.
+func (rs *RendezvousServer) expire(now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for fp, r := range rs.clients {
+		if now.After(r.expires) {
+			delete(rs.clients, fp)
+		}
+	}
+}
+
+// bind answers a STUN Binding request from addr.
+func (rs *RendezvousServer) bind(req []byte, addr string) {
+	resp, err := bindingResponse(req, addr)
+	if err == nil {
+		err = rs.transport.Send(addr, resp)
+	}
+	if err != nil {
+		log.Printf("STUN from %s: %s\n", addr, err)
+	}
+}
+
+// send a Rendezvous to a client.
+func (rs *RendezvousServer) send(to string, r *Rendezvous) error {
+	r.TimeStamp = Now()
+	m, err := PackageRendezvous(r, nil)
+	if err != nil {
+		return err
+	}
+	return Send(rs.transport, to, m)
+}
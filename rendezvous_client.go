@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Hole punching parameters.
+const (
+	PunchCount    = 5                      // punch packets sent to an introduced client
+	PunchInterval = 100 * time.Millisecond // time between punch packets
+)
+
+// Registrar runs a loop which registers this client with the Rendezvous
+// server every RegisterInterval, keeping the path through NAT to the server
+// open and allowing other clients to ask for an introduction. It also
+// resolves the server's address, which Messages from it are compared with.
+func (eng *ChatEngine) Registrar(ctx context.Context) {
+	ticker := time.NewTicker(RegisterInterval)
+	defer ticker.Stop()
+
+	register := func() {
+		eng.mu.RLock()
+		resolved := eng.rendezvous != nil
+		eng.mu.RUnlock()
+		if !resolved {
+			if addr, err := net.ResolveUDPAddr("udp", eng.Rendezvous); err == nil {
+				eng.mu.Lock()
+				eng.rendezvous = addr
+				eng.mu.Unlock()
+			}
+		}
+
+		// the server answers with a challenge, which is signed in a
+		// second Register
+		err := eng.sendRendezvous(&Rendezvous{Op: RendezvousRegister})
+		if err != nil {
+			log.Printf("registering with %s: %s\n", eng.Rendezvous, err)
+		}
+	}
+
+	register()
+	var done bool
+	for !done {
+		select {
+		case <-ctx.Done():
+			done = true
+
+		case <-ticker.C:
+			register()
+		}
+	}
+
+	log.Println("exiting registrar")
+}
+
+// Introduce asks the Rendezvous server to introduce this client to the one
+// whose key has the fingerprint. Once introduced, both clients punch a path
+// through NAT and a Request is sent to the other client.
+func (eng *ChatEngine) Introduce(fingerprint string) error {
+	if eng.Rendezvous == "" {
+		return fmt.Errorf("no rendezvous server")
+	}
+
+	now := time.Now()
+	eng.mu.Lock()
+	for fp, expires := range eng.introductions {
+		if now.After(expires) {
+			delete(eng.introductions, fp)
+		}
+	}
+	eng.introductions[fingerprint] = now.Add(PendingTimeout)
+	eng.mu.Unlock()
+
+	return eng.sendRendezvous(&Rendezvous{Op: RendezvousIntroduce, Target: fingerprint})
+}
+
+// sendRendezvous signs and sends a Rendezvous to the server.
+func (eng *ChatEngine) sendRendezvous(r *Rendezvous) error {
+	r.Key = eng.PrivSignKey.Public().(ed25519.PublicKey)
+	r.TimeStamp = Now()
+
+	m, err := PackageRendezvous(r, eng.PrivSignKey)
+	if err != nil {
+		return err
+	}
+	return Send(eng.transport, eng.Rendezvous, m)
+}
+
+// processRendezvous handles a Message from the Rendezvous server.
+func (eng *ChatEngine) processRendezvous(m *Message) {
+	if !eng.fromRendezvous(m.addr) {
+		eng.emit(DecodeError, "", m, "rendezvous from unexpected address %s", m.addr)
+		return
+	}
+
+	r, err := m.GetRendezvous()
+	if err != nil {
+		eng.emit(DecodeError, "", m, "rendezvous from %s: %s", m.addr, err)
+		return
+	}
+
+	switch r.Op {
+	case RendezvousChallenge:
+		if err := eng.sendRendezvous(&Rendezvous{Op: RendezvousRegister, Nonce: r.Nonce}); err != nil {
+			log.Printf("registering with %s: %s\n", eng.Rendezvous, err)
+		}
+
+	case RendezvousRegistered:
+		log.Printf("registered with rendezvous server as %s\n", r.Endpoint)
+
+	case RendezvousNotFound:
+		eng.mu.Lock()
+		delete(eng.introductions, r.Target)
+		eng.mu.Unlock()
+		eng.emit(Error, "", r, "%s is not registered with the rendezvous server", r.Target)
+
+	case RendezvousIntroduction:
+		fp := Fingerprint(r.Key)
+		eng.mu.Lock()
+		expires, requested := eng.introductions[fp]
+		delete(eng.introductions, fp)
+		eng.mu.Unlock()
+		requested = requested && time.Now().Before(expires)
+
+		log.Printf("introduced to %s at %s\n", fp, r.Endpoint)
+		go eng.punch(r.Key, r.Endpoint, requested)
+
+	default:
+		eng.emit(DecodeError, "", m, "rendezvous from %s: unexpected operation %d", m.addr, r.Op)
+	}
+}
+
+// punch sends punch packets to an introduced client at endpoint, so that
+// its packets can pass this client's NAT and vice versa. If this client
+// asked for the introduction, it then sends a Request.
+func (eng *ChatEngine) punch(key ed25519.PublicKey, endpoint string, request bool) {
+	for i := 0; i < PunchCount; i++ {
+		if err := Send(eng.transport, endpoint, PackagePunch()); err != nil {
+			log.Printf("punching %s: %s\n", endpoint, err)
+		}
+		time.Sleep(PunchInterval)
+	}
+
+	if !request {
+		return
+	}
+
+	p, err := introducedProfile(key, endpoint)
+	if err != nil {
+		eng.emit(Error, "", nil, "introduction to %s: %s", endpoint, err)
+		return
+	}
+	if c, ok := eng.contactByKey(key); ok {
+		p.Name = c.Name
+	}
+
+	if err := eng.SendRequest(p); err != nil {
+		eng.emit(Error, "", p, "request to %s: %s", p, err)
+	}
+}
+
+// introducedProfile makes a Profile to send a Request to an introduced
+// client. The client's own Profile arrives with its Response.
+func introducedProfile(key ed25519.PublicKey, endpoint string) (*Profile, error) {
+	host, port, err := splitEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Profile{
+		Name:             Fingerprint(key),
+		Address:          host,
+		Port:             port,
+		PublicSigningKey: key,
+	}, nil
+}
+
+// fromRendezvous determines if addr, where a Message came from, is the
+// Rendezvous server's address as resolved by the Registrar. Names are never
+// resolved here, since it is called for every Message from the server.
+func (eng *ChatEngine) fromRendezvous(addr string) bool {
+	if addr == eng.Rendezvous {
+		return true
+	}
+
+	eng.mu.RLock()
+	server := eng.rendezvous
+	eng.mu.RUnlock()
+	if server == nil {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(server.IP) && port == strconv.Itoa(server.Port)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+// registerMessage makes a Register signed by key, as sent from addr.
+func registerMessage(t *testing.T, key ed25519.PrivateKey, nonce []byte, addr string) *Message {
+	t.Helper()
+	r := &Rendezvous{
+		Op:        RendezvousRegister,
+		Key:       key.Public().(ed25519.PublicKey),
+		Nonce:     nonce,
+		TimeStamp: Now(),
+	}
+	m, err := PackageRendezvous(r, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.addr = addr
+	return m
+}
+
+// receiveRendezvous reads a Rendezvous sent to a MemoryTransport.
+func receiveRendezvous(t *testing.T, tr *MemoryTransport) *Rendezvous {
+	t.Helper()
+	p := <-tr.Receive()
+	m, err := decodeMessage(p.Data[fragmentHeaderSize:], p.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := m.GetRendezvous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRendezvousRegisterChallenge(t *testing.T) {
+	n := NewMemoryNetwork()
+	rs, err := NewRendezvousServer(n.Transport("rv:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim, attacker := n.Transport("victim:1"), n.Transport("attacker:1")
+	key, pub, err := Ed25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a Register without a nonce is only challenged
+	if err := rs.process(registerMessage(t, key, nil, "victim:1")); err != nil {
+		t.Fatal(err)
+	}
+	challenge := receiveRendezvous(t, victim)
+	if challenge.Op != RendezvousChallenge || len(challenge.Nonce) == 0 {
+		t.Fatalf("got operation %d, want a challenge", challenge.Op)
+	}
+	if _, ok := rs.lookup(Fingerprint(pub)); ok {
+		t.Fatal("registered without a nonce")
+	}
+
+	register := registerMessage(t, key, challenge.Nonce, "victim:1")
+	if err := rs.process(register); err != nil {
+		t.Fatal(err)
+	}
+	if r := receiveRendezvous(t, victim); r.Op != RendezvousRegistered || r.Endpoint != "victim:1" {
+		t.Fatalf("got operation %d for %s, want registered", r.Op, r.Endpoint)
+	}
+
+	// the signed Register replayed from elsewhere is challenged again,
+	// and does not move the registration
+	register.addr = "attacker:1"
+	if err := rs.process(register); err != nil {
+		t.Fatal(err)
+	}
+	if r := receiveRendezvous(t, attacker); r.Op != RendezvousChallenge {
+		t.Fatalf("replay got operation %d, want a challenge", r.Op)
+	}
+	if reg, ok := rs.lookup(Fingerprint(pub)); !ok || reg.endpoint != "victim:1" {
+		t.Fatalf("registration moved to %s", reg.endpoint)
+	}
+}
+
+func TestRendezvousKeySize(t *testing.T) {
+	n := NewMemoryNetwork()
+	rs, err := NewRendezvousServer(n.Transport("rv:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := Ed25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a key of the wrong size is an error, whether or not it is signed
+	for _, op := range []RendezvousOp{RendezvousRegister, RendezvousIntroduce} {
+		m, err := PackageRendezvous(&Rendezvous{Op: op, Key: []byte{1, 2, 3}, TimeStamp: Now()}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.addr = "client:1"
+		if err := rs.process(m); err == nil {
+			t.Errorf("operation %d with a 3 byte key", op)
+		}
+		m.Signature = nil
+		if _, err := m.GetRendezvous(); err == nil {
+			t.Errorf("decoded unsigned operation %d with a 3 byte key", op)
+		}
+	}
+	if ValidSignatureEd25519(SignEd25519(key, []byte("hi")), []byte("hi"), []byte{1, 2, 3}) {
+		t.Error("signature valid for a 3 byte key")
+	}
+}
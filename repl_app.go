@@ -1,14 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -25,23 +27,45 @@ type ReplApp struct {
 	engine         *ChatEngine
 	output         io.Writer
 	meProfileFile  string
-	contactsFile   string
 	privateKeyFile string
+	passphrase     []byte // protects the private key file
+	newProfile     bool   // no profile was read. see discoverAddress()
+}
+
+// ReplConfig is the configuration of a ReplApp, typically from command line flags.
+type ReplConfig struct {
+	ProfileFile  string // user's profile
+	ContactsFile string
+	OutboxFile   string   // messages waiting for delivery
+	KeyFile      string   // user's private key
+	Transport    string   // network transport. see NewTransport()
+	KeyPolicy    string   // see KeyChangePolicy
+	Noise        bool     // begin sessions with a Noise handshake
+	Rendezvous   string   // rendezvous server address, if any
+	Relay        string   // relay server address, if any
+	STUNServers  []string // servers which discover the external address
+	PortMap      bool     // map the listening port on the router
+	Advertise    bool     // advertise the profile on the local network
 }
 
 // NewReplApp creates a new App.
 // need config for:
-// profile/contacts input file
 // output & log config
 // prompt/console config
-func NewReplApp(meProfileFile, contactsFile, privateKeyFile string, output io.Writer) App {
+func NewReplApp(cfg ReplConfig, output io.Writer) App {
+	meProfileFile, contactsFile, privateKeyFile := cfg.ProfileFile, cfg.ContactsFile, cfg.KeyFile
+
 	ui := new(ReplApp)
 	ui.meProfileFile = meProfileFile
-	ui.contactsFile = contactsFile
 	ui.privateKeyFile = privateKeyFile
 	ui.output = output
 	ui.setupCommands()
 
+	// setup console
+	ui.console = NewConsole(os.Stdin)
+	ui.console.Format = func() string { return time.Now().Format("3:04:05 PM") + " > " }
+	// ui.console.Format = func() string { return ui.engine.Me.Name + " > " }
+
 	// read profile/contacts
 	me, err := ReadProfile(meProfileFile)
 	if err != nil {
@@ -53,21 +77,82 @@ func NewReplApp(meProfileFile, contactsFile, privateKeyFile string, output io.Wr
 		log.Println(err)
 	}
 
-	privKey, err := ReadPrivateKey(privateKeyFile)
-	if err != nil {
+	var outbox []*OutboxEntry
+	if cfg.OutboxFile != "" {
+		outbox, err = ReadOutbox(cfg.OutboxFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+
+	// Letters received from the relay server are remembered alongside the
+	// contacts, so that they can't be replayed
+	var lettersFile string
+	var letters []SeenLetter
+	if contactsFile != "" {
+		lettersFile = contactsFile + ".letters"
+		letters, err = ReadLetters(lettersFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+
+	const attempts = 3
+	var privKey ed25519.PrivateKey
+	for i := 0; i < attempts; i++ {
+		privKey, err = ReadPrivateKey(privateKeyFile, ui.askPassphrase)
+		if err == nil || os.IsNotExist(err) {
+			break
+		}
 		log.Println(err)
 	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln("unable to unlock private key")
+	}
 
-	// setup engine
-	ui.engine, err = NewChatEngine(privKey, me, contacts)
+	// setup network
+	ui.newProfile = me == nil
+	port := DefaultPort
+	if me != nil {
+		port = me.Port
+	}
+	transport, err := NewTransport(cfg.Transport, port)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	// setup console
-	ui.console = NewConsole(os.Stdin)
-	ui.console.Format = func() string { return time.Now().Format("3:04:05 PM") + " > " }
-	// ui.console.Format = func() string { return ui.engine.Me.Name + " > " }
+	// setup engine
+	var signature []byte
+	if me != nil {
+		signature = me.Signature
+	}
+	ui.engine, err = NewChatEngine(transport, privKey, me, contacts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if me != nil && !bytes.Equal(signature, me.Signature) { // engine signed the profile
+		if err = WriteProfile(me, meProfileFile); err != nil {
+			log.Println(err)
+		}
+	}
+	ui.engine.ContactsFile = contactsFile
+	ui.engine.OutboxFile = cfg.OutboxFile
+	ui.engine.LoadOutbox(outbox)
+	ui.engine.LettersFile = lettersFile
+	ui.engine.LoadLetters(letters)
+	ui.engine.Noise = cfg.Noise
+	ui.engine.Rendezvous = cfg.Rendezvous
+	ui.engine.Relay = cfg.Relay
+	ui.engine.STUNServers = cfg.STUNServers
+	ui.engine.PortMap = cfg.PortMap
+	ui.engine.Advertise = cfg.Advertise
+	ui.engine.Roaming = cfg.Transport != "tcp" // tcp packets come from ephemeral ports
+	if cfg.KeyPolicy != "" {
+		ui.engine.KeyPolicy, err = ParseKeyChangePolicy(cfg.KeyPolicy)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 
 	return ui
 }
@@ -75,14 +160,43 @@ func NewReplApp(meProfileFile, contactsFile, privateKeyFile string, output io.Wr
 // Run starts the app. It blocks until the app finishes.
 func (ui *ReplApp) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel() // stops engine
 
 	// start chat engine
-	ui.engine.Start(ctx)
+	engine := ui.engine.Start(ctx)
+	if ui.newProfile && !ui.engine.PortMap { // the port mapper sets the address
+		go ui.discoverAddress()
+	}
 	// start repl console
 	ui.console.Run(ctx)
 
 	ui.loop() // blocks until "quit"
+
+	cancel() // stops engine
+	engine.Wait()
+}
+
+// discoverAddress changes the address of a new profile, which the engine
+// took from a local interface, to the external address and port found by
+// STUN.
+func (ui *ReplApp) discoverAddress() {
+	addr, err := ui.engine.MappedAddress()
+	if err != nil {
+		log.Printf("using local address: %s\n", err)
+		return
+	}
+	host, port, err := splitEndpoint(addr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	p := *ui.engine.Me()
+	p.Address, p.Port = host, port
+	if err = ui.engine.SetMe(&p); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("using external address %s\n", addr)
 }
 
 // setupCommands defines the REPL commands used in the program.
@@ -100,7 +214,17 @@ func (ui *ReplApp) setupCommands() {
 
 		"ip": {
 			cmd:      "ip",
-			helptext: "display your current external IP and port chat client is using",
+			helptext: "display the local and external addresses chat client is using",
+		},
+
+		"discover": {
+			cmd:      "discover",
+			helptext: "find other users on the local network. start sessions with or add them by handle",
+		},
+
+		"fetch": {
+			cmd:      "fetch",
+			helptext: "fetch messages left for you with the relay server",
 		},
 
 		"me": {
@@ -119,6 +243,17 @@ func (ui *ReplApp) setupCommands() {
 						{"PROFILE", re(profile)},
 					},
 				},
+				"passphrase": {
+					cmd:      "passphrase",
+					helptext: "change the passphrase protecting your private key",
+				},
+				"invite": {
+					cmd:      "invite",
+					helptext: "display an invite others may add you with. qr also draws the code as a QR code",
+					args: []argdef{
+						{"[qr]", re(`(qr)?`)},
+					},
+				},
 			},
 		},
 
@@ -134,17 +269,26 @@ func (ui *ReplApp) setupCommands() {
 				},
 				"add": {
 					cmd:      "add",
-					helptext: "add a new contact from an existing session or profile",
+					helptext: "add a new contact from an existing session, discovered user, invite or profile",
 					args: []argdef{
 						{"PROFILE", re(profile)},
-						{"SESSION_NUMBER", re(integer)},
+						{"INVITE", re(name)},
+						{"SESSION", re(name)},
+						{"DISCOVERED", re(name)},
 					},
 				},
 				"delete": {
 					cmd:      "delete",
-					helptext: "delete a contacts",
+					helptext: "delete a contact by handle or name",
+					args: []argdef{
+						{"CONTACT", re(name)},
+					},
+				},
+				"verify": {
+					cmd:      "verify",
+					helptext: "compare safety numbers with a contact and mark it verified",
 					args: []argdef{
-						{"CONTACT_NUMBER", re(integer)},
+						{"CONTACT", re(name)},
 					},
 				},
 			},
@@ -163,14 +307,21 @@ func (ui *ReplApp) setupCommands() {
 					cmd:      "accept",
 					helptext: "accept chat request and begin a session",
 					args: []argdef{
-						{"REQUEST_NUMBER", re(integer)},
+						{"REQUEST", re(name)},
 					},
 				},
 				"reject": {
 					cmd:      "reject",
 					helptext: "refuse a chat request",
 					args: []argdef{
-						{"REQUEST_NUMBER", re(integer)},
+						{"REQUEST", re(name)},
+					},
+				},
+				"trust": {
+					cmd:      "trust",
+					helptext: "trust the new key of a quarantined request",
+					args: []argdef{
+						{"REQUEST", re(name)},
 					},
 				},
 			},
@@ -189,15 +340,44 @@ func (ui *ReplApp) setupCommands() {
 					cmd:      "start",
 					helptext: "ping another user to a session",
 					args: []argdef{
-						{"CONTACT_NUMBER", re(integer)},
 						{"PROFILE", re(profile)},
+						{"INVITE", re(name)},
+						{"CONTACT", re(name)},
+						{"DISCOVERED", re(name)},
+					},
+				},
+				"introduce": {
+					cmd:      "introduce",
+					helptext: "start a session through NAT via the rendezvous server",
+					args: []argdef{
+						{"CONTACT", re(name)},
+						{"FINGERPRINT", re(name)},
 					},
 				},
 				"drop": {
 					cmd:      "drop",
 					helptext: "end a session",
 					args: []argdef{
-						{"SESSION_NUMBER", re(integer)},
+						{"SESSION", re(name)},
+					},
+				},
+			},
+		},
+
+		"outbox": {
+			cmd:        "outbox",
+			helptext:   "manage messages waiting for delivery to contacts",
+			defaultSub: "list",
+			subcmds: commanddefs{
+				"list": {
+					cmd:      "list",
+					helptext: "display messages waiting for delivery",
+				},
+				"cancel": {
+					cmd:      "cancel",
+					helptext: "remove a message from the outbox",
+					args: []argdef{
+						{"PENDING", re(word)},
 					},
 				},
 			},
@@ -205,9 +385,10 @@ func (ui *ReplApp) setupCommands() {
 
 		"msg": {
 			cmd:      "msg",
-			helptext: "sends a message",
+			helptext: "sends a message. SESSION or CONTACT is a handle or single word name. messages to a contact without an active session wait in the outbox",
 			args: []argdef{
-				{"SESSION_NUMBER MESSAGE", re(integer, rest)},
+				{"SESSION MESSAGE", re(word, rest)},
+				{"CONTACT MESSAGE", re(word, rest)},
 			},
 		},
 
@@ -215,7 +396,7 @@ func (ui *ReplApp) setupCommands() {
 			cmd:      "show",
 			helptext: "show last few messages for a particular session",
 			args: []argdef{
-				{"SESSION_NUMBER", re(integer)},
+				{"SESSION", re(name)},
 			},
 		},
 	}
@@ -224,11 +405,11 @@ func (ui *ReplApp) setupCommands() {
 // loop performs the read and loop (RL) of the REPL. It also
 // responds to SIGINT and SIGTERM to close the app.
 func (ui *ReplApp) loop() {
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
 	for {
-		// get first input from sig, console, or bot
+		// get first input from sig, console, engine, or bot
 		var line string
 		select {
 		case <-sig:
@@ -239,8 +420,90 @@ func (ui *ReplApp) loop() {
 				return
 			}
 
+		case ev := <-ui.engine.Events:
+			ui.printEvent(ev)
+		}
+	}
+}
+
+// printEvent displays an engine event to the user.
+func (ui *ReplApp) printEvent(ev EngineEvent) {
+	switch ev.Type {
+	case TextReceived:
+		t := ev.Data.(*Text)
+		fmt.Fprintf(ui.output, "\n[%s] %s\t| %s > %s\n", ev.ID,
+			t.From().Name,
+			t.TimeStamp.Time().Format(time.Kitchen),
+			t.Message)
+
+	case LetterReceived:
+		l := ev.Data.(*Letter)
+		id := ev.ID
+		if id == "" {
+			id = "relay"
+		}
+		fmt.Fprintf(ui.output, "\n[%s] %s\t| %s > %s\n", id,
+			l.From.Name,
+			l.TimeStamp.Time().Format(time.Kitchen),
+			l.Message)
+
+	case RequestReceived, SessionUpgraded, SessionExpired, SessionClosed, ProfileUpdated, PeerMoved:
+		fmt.Fprintf(ui.output, "\n[%s] %s\n", ev.ID, ev.Message)
+
+	case KeyChanged:
+		fmt.Fprintf(Color(ui.output, BrightRed), "\n!!! WARNING: KEY CHANGED [%s] %s\n"+
+			"!!! someone may be impersonating this contact. verify the key before trusting it.\n",
+			ev.ID, ev.Message)
+
+	default:
+		log.Printf("%s: %s\n", ev.Type, ev.Message)
+	}
+}
+
+// askPassphrase prompts the user for a passphrase, remembering it so that
+// the private key can be saved again later. It is a PassphraseFunc.
+func (ui *ReplApp) askPassphrase(confirm bool) ([]byte, error) {
+	if !confirm {
+		pass, err := ui.console.ReadPassword("passphrase for private key: ")
+		if err == nil {
+			ui.passphrase = pass
 		}
+		return pass, err
+	}
+
+	pass, err := ui.console.ReadPassword("new passphrase for private key: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := ui.console.ReadPassword("repeat passphrase: ")
+	if err != nil {
+		return nil, err
 	}
+	if !bytes.Equal(pass, again) {
+		return nil, fmt.Errorf("passphrases did not match")
+	}
+	if len(pass) == 0 {
+		log.Println("warning: private key will be saved with an empty passphrase")
+	}
+
+	ui.passphrase = pass
+	return pass, nil
+}
+
+// changePassphrase asks for a new passphrase and saves the private key with it.
+func (ui *ReplApp) changePassphrase() {
+	pass, err := ui.askPassphrase(true)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = WritePrivateKey(ui.engine.PrivSignKey, ui.privateKeyFile, pass)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("saved private key")
 }
 
 // evalLine performs the eval and print (EP) of the REPL.
@@ -250,8 +513,6 @@ func (ui *ReplApp) evalLine(line string) (quit bool) {
 	cmds := ui.commands
 	output := ui.output
 	meProfileFile := ui.meProfileFile
-	contactsFile := ui.contactsFile
-	privateKeyFile := ui.privateKeyFile
 
 	// parse raw line into command struct
 	cmd := cmds.parse(line)
@@ -273,21 +534,54 @@ func (ui *ReplApp) evalLine(line string) (quit bool) {
 		fmt.Fprintln(output, cmds.help()) // uses commanddefs
 
 	case "ip":
-		fmt.Fprintln(output, "getting external ip...")
-		ip, err := GetIP()
+		fmt.Fprintln(output, "discovering addresses...")
+		e, err := engine.Endpoints()
+		for _, addr := range e.Local {
+			fmt.Fprintf(output, "local address:\t\t%s\n", addr)
+		}
+		if e.Mapped != "" {
+			fmt.Fprintf(output, "external address:\t%s\n", e.Mapped)
+		} else {
+			fmt.Fprintf(output, "external address:\tunknown (%s)\n", err)
+		}
+		fmt.Fprintf(output, "profile address:\t%s\n", engine.Me().FullAddress())
+
+	case "discover":
+		fmt.Fprintln(output, "discovering...")
+		peers, err := engine.Discover(DiscoverTimeout)
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		fmt.Fprintf(output, "external IP address:\t%s\nlistening on port:\t%s\n", ip, engine.Me.Port)
+		for _, p := range peers {
+			var note string
+			for _, c := range engine.Contacts() {
+				if bytes.Equal(c.PublicSigningKey, p.PublicSigningKey) {
+					note = " [contact " + string(c.Handle()) + "]"
+				}
+			}
+			fmt.Fprintf(output, "%s\t%s\t%s%s\n", p.Handle(), p.Local(), Fingerprint(p.PublicSigningKey), note)
+		}
+		if len(peers) == 0 {
+			fmt.Fprintln(output, "no one found")
+		}
+
+	case "fetch":
+		n, err := engine.FetchLetters()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Fprintf(output, "%d new messages\n", n)
 
 	case "me":
 		switch cmd = *cmd.leaf(); cmd.cmd {
 		case "show":
-			fmt.Fprintf(output, "I am \"%s\"\nPubKey:  %s\nPrivKey: %s\n",
-				engine.Me,
-				base64.RawStdEncoding.EncodeToString(engine.Me.PublicSigningKey),
-				base64.RawStdEncoding.EncodeToString(engine.PrivSignKey))
+			me := engine.Me()
+			fmt.Fprintf(output, "I am \"%s\"\nPubKey:  %s\nVersion: %d\n",
+				me,
+				base64.RawStdEncoding.EncodeToString(me.PublicSigningKey),
+				me.Seq)
 
 		case "edit":
 			p, err := ParseProfile(cmd.args[0])
@@ -296,53 +590,82 @@ func (ui *ReplApp) evalLine(line string) (quit bool) {
 				return
 			}
 
-			p.PublicSigningKey = engine.Me.PublicSigningKey // preserve key
+			p.PublicSigningKey = engine.Me().PublicSigningKey // preserve key
+			// signs p and sends it to active sessions
+			err = engine.SetMe(p)
+			if err != nil {
+				log.Println(err)
+				return
+			}
 			err = WriteProfile(p, meProfileFile)
 			if err != nil {
 				log.Println(err)
 				return
 			}
-			engine.Me = p
 
-			err = WritePrivateKey(engine.PrivSignKey, privateKeyFile)
+			if ui.passphrase == nil { // key not yet saved
+				ui.changePassphrase()
+			}
+
+		case "passphrase":
+			ui.changePassphrase()
+
+		case "invite":
+			me := engine.Me()
+			uri, err := me.InviteURI()
 			if err != nil {
 				log.Println(err)
 				return
 			}
+			code, err := me.InviteCode()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			fmt.Fprintf(output, "%s\n%s\n", uri, code)
+
+			if cmd.args[0] == "qr" {
+				modules, err := QRCode(code)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				WriteQR(output, modules)
+			}
 		}
 
 	case "contacts":
 
 		switch cmd = *cmd.leaf(); cmd.cmd {
 		case "list":
-			for i, c := range engine.Contacts {
-				if c != nil {
-					fmt.Fprintf(output, "%d\t%s\t%s\n", i, c,
-						base64.RawStdEncoding.EncodeToString(c.PublicSigningKey))
+			for _, c := range engine.Contacts() {
+				var note string
+				if c.Verified {
+					note = " [verified]"
 				}
+				fmt.Fprintf(output, "%s\t%s\t%s%s\n", c.Handle(), c,
+					Fingerprint(c.PublicSigningKey), note)
 			}
 
 		case "add":
-			var p *Profile
-			arg := cmd.args[0]
-			n, err := strconv.Atoi(arg)
-			if err == nil {
-				if sess, ok := engine.GetSession(n); ok {
-					p = sess.Other
+			p, err := ParseInvite(cmd.args[0])
+			if err != nil {
+				p, err = ParseProfile(cmd.args[0])
+			}
+			if err != nil {
+				if sess, err := engine.LookupSession(cmd.args[0]); err == nil {
+					p = sess.Peer()
 					if p == nil {
-						log.Printf("session %d had a nil Other", n)
+						log.Printf("session %s had a nil Other", sess.Handle())
 						return
 					}
 				} else {
-					log.Printf("%d not found\n", n)
-					return
-				}
-
-			} else {
-				p, err = ParseProfile(arg)
-				if err != nil {
-					log.Println(err)
-					return
+					peer, err := engine.LookupPeer(cmd.args[0])
+					if err != nil {
+						log.Println(err)
+						return
+					}
+					p = peer.Profile // as signed by the peer
 				}
 			}
 
@@ -350,68 +673,101 @@ func (ui *ReplApp) evalLine(line string) (quit bool) {
 			// TODO: do i really want to overwrite? what about having 2
 			// contacts with different names but the same address?
 			// i guess the question boils down to the definition of Profile
-			if index := engine.FindContact(p); index >= 0 {
-				old := engine.Contacts[index]
-				engine.Contacts[index] = p
-				log.Printf("overwrote #%d '%s' with '%s'\n", index, old, p)
+			if old, ok := engine.FindContact(p); ok {
+				engine.UpdateContact(old.Handle(), p)
+				log.Printf("overwrote %s '%s' with '%s'\n", old.Handle(), old, p)
 			} else {
-				engine.AddContact(p)
-				log.Printf("added %s\n", p)
+				h := engine.AddContact(p)
+				log.Printf("added %s %s\n", h, p)
 			}
 
-			err = WriteContacts(engine.Contacts, contactsFile)
+			err = engine.SaveContacts()
 			if err != nil {
 				log.Println(err)
 				log.Println("did not save changes to disk")
 			}
 
 		case "delete":
-			arg := cmd.args[0]
-			n, err := strconv.Atoi(arg)
+			c, err := engine.LookupContact(cmd.args[0])
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			removed := engine.Contacts[n]
-			if engine.RemoveContact(n) {
-				log.Printf("deleted %s\n", removed)
+			if engine.RemoveContact(c.Handle()) {
+				log.Printf("deleted %s\n", c)
 
-				err = WriteContacts(engine.Contacts, contactsFile)
+				err = engine.SaveContacts()
 				if err != nil {
 					log.Println(err)
 					log.Println("did not save changes to disk")
 				}
 			} else {
-				log.Printf("%d not found\n", n)
+				log.Printf("%s not found\n", c.Handle())
+			}
+
+		case "verify":
+			c, err := engine.LookupContact(cmd.args[0])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if len(c.PublicSigningKey) == 0 {
+				log.Printf("%s has no key to verify\n", c)
+				return
+			}
+
+			mine := engine.PrivSignKey.Public().(ed25519.PublicKey)
+			fmt.Fprintf(output, "safety number with %s:\n", c)
+			groups := strings.Fields(SafetyNumber(mine, c.PublicSigningKey))
+			for i := 0; i < len(groups); i += 4 {
+				fmt.Fprintf(output, "  %s\n", strings.Join(groups[i:i+4], " "))
+			}
+			fmt.Fprintf(output, "words: %s\n", strings.Join(SafetyWords(mine, c.PublicSigningKey), " "))
+			fmt.Fprintln(output, "compare these with your contact in person or over a trusted channel.")
+
+			answer, err := ui.console.ReadLine("do they match? [y/N] ")
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			verified := strings.EqualFold(strings.TrimSpace(answer), "y")
+			engine.VerifyContact(c.Handle(), verified)
+			if verified {
+				log.Printf("marked %s as verified\n", c)
+			} else {
+				log.Printf("%s is not verified\n", c)
+			}
+
+			err = engine.SaveContacts()
+			if err != nil {
+				log.Println(err)
+				log.Println("did not save changes to disk")
 			}
 		}
 
 	case "requests":
 		switch cmd = *cmd.leaf(); cmd.cmd {
 		case "list":
-			for i, r := range engine.Requests {
-				if r != nil {
-					fmt.Fprintf(output, "%d\t%s at %s (%s ago)\n", i,
-						r.Profile,
-						r.Time().Format(time.Kitchen),
-						time.Since(r.Time()))
+			for _, r := range engine.Requests() {
+				var note string
+				if r.Quarantined() {
+					note = " [quarantined: key changed]"
 				}
+				fmt.Fprintf(output, "%s\t%s at %s (%s ago)%s\n", r.Handle(),
+					r.Profile,
+					r.Time().Format(time.Kitchen),
+					time.Since(r.Time()), note)
 			}
 
 		case "accept":
-			arg := cmd.args[0]
-			n, err := strconv.Atoi(arg)
+			r, err := engine.LookupRequest(cmd.args[0])
 			if err != nil {
 				log.Println(err)
 				return
 			}
-			if _, ok := engine.GetRequest(n); !ok {
-				log.Printf("%d not found\n", n)
-				return
-			}
 
-			err = engine.AcceptRequest(engine.Requests[n])
+			err = engine.AcceptRequest(r)
 			if err != nil {
 				log.Println(err)
 				return
@@ -419,48 +775,62 @@ func (ui *ReplApp) evalLine(line string) (quit bool) {
 			log.Println("request accepted")
 
 		case "reject":
-			arg := cmd.args[0]
-			n, err := strconv.Atoi(arg)
+			r, err := engine.LookupRequest(cmd.args[0])
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			if engine.RemoveRequest(n) {
+			if engine.RemoveRequest(r.Handle()) {
 				log.Println("removed request")
 			} else {
-				log.Printf("%d not found\n", n)
+				log.Printf("%s not found\n", r.Handle())
 			}
+
+		case "trust":
+			r, err := engine.LookupRequest(cmd.args[0])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			err = engine.TrustRequest(r.Handle())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			log.Printf("trusted new key of %s\n", r.Profile)
 		}
 
 	case "sessions":
 		switch cmd = *cmd.leaf(); cmd.cmd {
 		case "list":
-			for i, s := range engine.Sessions {
-				if s != nil {
-					fmt.Fprintf(output, "%d\t%s\n", i, s)
+			for _, s := range engine.Sessions() {
+				var note string
+				if engine.IsVerified(s.Peer()) {
+					note = " [verified]"
 				}
+				fmt.Fprintf(output, "%s\t%s%s\n", s.Handle(), s, note)
 			}
 
 		case "start":
-			var p *Profile
-			arg := cmd.args[0]
-			n, err := strconv.Atoi(arg)
+			p, err := ParseInvite(cmd.args[0])
+			if err != nil {
+				p, err = ParseProfile(cmd.args[0])
+			}
 			if err == nil {
-				if p, _ = engine.GetContact(n); p == nil {
-					log.Printf("%d not found\n", n)
-					return
+				if c, ok := engine.FindContact(p); ok {
+					p = c.Profile // use profile from contacts if available
 				}
+			} else if c, err := engine.LookupContact(cmd.args[0]); err == nil {
+				p = c.Profile
 			} else {
-				p, err = ParseProfile(arg)
+				peer, err := engine.LookupPeer(cmd.args[0])
 				if err != nil {
 					log.Println(err)
 					return
 				}
-				if i := engine.FindContact(p); i >= 0 {
-					p = engine.Contacts[i] // use profile from contacts if available
-				}
-
+				p = peer.Local() // reached on the local network
 			}
 
 			err = engine.SendRequest(p)
@@ -470,62 +840,115 @@ func (ui *ReplApp) evalLine(line string) (quit bool) {
 			}
 			log.Println("request sent")
 
+		case "introduce":
+			fingerprint := cmd.args[0]
+			if c, err := engine.LookupContact(cmd.args[0]); err == nil {
+				fingerprint = Fingerprint(c.PublicSigningKey)
+			}
+
+			err := engine.Introduce(fingerprint)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			log.Println("introduction requested")
+
 		case "drop":
-			arg := cmd.args[0]
-			n, err := strconv.Atoi(arg)
+			s, err := engine.LookupSession(cmd.args[0])
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			if engine.RemoveSession(n) {
-				log.Println("dropped session")
-			} else {
-				log.Printf("%d not found\n", n)
+			err = engine.DropSession(s.Handle())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			log.Println("dropped session")
+		}
+
+	case "outbox":
+		switch cmd = *cmd.leaf(); cmd.cmd {
+		case "list":
+			for _, e := range engine.Outbox() {
+				to := e.Name
+				for _, c := range engine.Contacts() {
+					if bytes.Equal(c.PublicSigningKey, e.To) {
+						to = c.String()
+					}
+				}
+				state := "waiting"
+				if e.InFlight() {
+					state = "sending"
+				}
+				fmt.Fprintf(output, "%s\t%s\t| %s > %s [%s, %d attempts]\n", e.Handle(), to,
+					e.Queued.Time().Format(time.Kitchen), e.Message, state, e.Attempts)
+			}
+
+		case "cancel":
+			e, err := engine.LookupOutboxEntry(cmd.args[0])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if engine.CancelOutboxEntry(e.Handle()) {
+				log.Printf("cancelled message to %s\n", e.Name)
 			}
 		}
 
 	case "msg":
-		n, err := strconv.Atoi(cmd.args[0])
-		if err != nil {
+		s, err := engine.LookupSession(cmd.args[0])
+		if err == nil && s.IsActive() {
+			err = s.SendText(cmd.args[1])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			log.Println("queued")
+			return
+		}
+
+		// a contact without an Active session
+		c, cerr := engine.LookupContact(cmd.args[0])
+		if cerr != nil {
+			if err == nil {
+				err = fmt.Errorf("session %s not Active", s.Handle())
+			}
 			log.Println(err)
 			return
 		}
-		if _, ok := engine.GetSession(n); !ok {
-			log.Printf("%d not found\n", n)
+		h, err := engine.QueueText(c, cmd.args[1])
+		if h == "" {
+			log.Println(err)
 			return
 		}
-
-		err = engine.Sessions[n].SendText(cmd.args[1])
 		if err != nil {
-			log.Println(err)
+			log.Printf("requesting session with %s: %s\n", c, err)
+		}
+		if _, err := engine.LookupOutboxEntry(string(h)); err != nil {
+			log.Printf("left with the relay server for %s\n", c)
 			return
 		}
-		log.Println("sent")
+		log.Printf("kept in outbox as %s until %s can be reached\n", h, c)
 
 	case "show":
-		n, err := strconv.Atoi(cmd.args[0])
+		s, err := engine.LookupSession(cmd.args[0])
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		s, ok := engine.GetSession(n)
-		if !ok {
-			log.Printf("%d not found\n", n)
-			return
-		}
 
 		const num = 5
-		start := len(s.Msgs) - num
-		if start < 0 {
-			start = 0
-		} // clamp
-		show := s.Msgs[start:]
-		for i, t := range show {
-			fmt.Fprintf(output, "%d %s\t| %s > %s\n", i,
+		for i, t := range s.Messages(num) {
+			var state string
+			if t.State() != "" {
+				state = " [" + string(t.State()) + "]"
+			}
+			fmt.Fprintf(output, "%d %s\t| %s > %s%s\n", i,
 				t.From().Name,
 				t.TimeStamp.Time().Format(time.Kitchen),
-				t.Message)
+				t.Message, state)
 		}
 
 	}
@@ -0,0 +1,45 @@
+package main
+
+// replayWindowSize is the number of sequence numbers behind the highest seen
+// which can still be accepted (if not already seen). Older ones are dropped.
+const replayWindowSize = 64
+
+// replayWindow is a sliding window used to detect duplicated or replayed
+// sequence numbers, while tolerating some reordering of received Messages.
+// Sequence numbers start at 1.
+type replayWindow struct {
+	highest uint64 // highest sequence number accepted
+	seen    uint64 // bit i set if (highest - i) was accepted
+}
+
+// Accept marks seq as seen and returns true if it was not previously seen
+// and is not too old to be tracked by the window.
+func (w *replayWindow) Accept(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+
+	if seq > w.highest {
+		shift := seq - w.highest
+		if shift >= replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.highest = seq
+		return true
+	}
+
+	offset := w.highest - seq
+	if offset >= replayWindowSize {
+		return false // too old
+	}
+
+	bit := uint64(1) << offset
+	if w.seen&bit != 0 {
+		return false // duplicate
+	}
+	w.seen |= bit
+	return true
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, step := range []struct {
+		seq  uint64
+		want bool
+	}{
+		{0, false}, // sequence numbers start at 1
+		{1, true},
+		{1, false},
+		{100, true},
+		{100 - replayWindowSize + 1, true}, // oldest in the window
+		{100 - replayWindowSize + 1, false},
+		{100 - replayWindowSize, false}, // just behind it
+		{99, true},                      // reordered
+		{99, false},
+		{101, true},
+		{100, false},
+		{101 + replayWindowSize, true}, // shifts everything out
+		{101, false},                   // behind the window now
+		{102, true},
+		{101 + replayWindowSize - 1, true},
+		{^uint64(0), true},
+		{^uint64(0), false},
+	} {
+		if got := w.Accept(step.seq); got != step.want {
+			t.Fatalf("Accept(%d) = %t after highest %d", step.seq, got, w.highest)
+		}
+	}
+}
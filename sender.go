@@ -1,44 +1,25 @@
 package main
 
-import (
-	"bytes"
-	"encoding/gob"
-	"net"
-	"time"
-)
-
-// Send a Message. `to` is full address (ex 111.222.333.444:555).
-func Send(to string, msg *Message) error {
-	conn, err := net.Dial("udp", to)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	err = enc.Encode(msg)
+// Send a Message using transport t. `to` is full address (ex 111.222.333.444:555).
+// Messages larger than a single datagram are split into fragments.
+func Send(t Transport, to string, msg *Message) error {
+	data, err := gobEncode(msg)
 	if err != nil {
 		return err
 	}
 
-	_, err = conn.Write(buf.Bytes())
+	frags, err := Fragment(data)
 	if err != nil {
 		return err
 	}
 
-	// TODO: experiment to detect when a Send fails due to
-	// there being no one on the other side.
-	// SHOULD timeout most of the time. Since send is on a random ephemeral
-	// port, I would not expect to ever accidently read data meant to be
-	// read by "Listener()".
-	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-	_, err = conn.Read([]byte{0})
-	if neterr, ok := err.(net.Error); ok {
-		if !neterr.Timeout() { // timeout error is expected
+	// UDP gives no indication whether anyone received the datagrams.
+	// Delivery of Texts is confirmed by Acks instead.
+	for _, f := range frags {
+		err = t.Send(to, f)
+		if err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
@@ -5,22 +5,45 @@ import (
 	"crypto/ed25519"
 	"encoding/binary"
 	"fmt"
+	"sync"
 	"time"
 )
 
 // Session stores information required for a specific "connection" between two
-// chat clients, most important of which is likely the shared key for AES
+// chat clients, most important of which is likely the shared key for
 // encryption.
+//
+// A Session is shared between the UI and the engine's network goroutines, so
+// after it has been added to a ChatEngine its fields should only be read or
+// changed through its methods. ID never changes and may be read directly.
+// Nor does its handle once added to the engine.
 type Session struct {
 	Status         SessionStatus
 	ID             uint64
 	SessionPubKey  []byte
 	SessionPrivKey []byte
-	SharedKey      []byte
 	Me             *Profile
 	Other          *Profile
 	Expires        time.Time
 	Msgs           []*Text
+	Replays        int           // count of duplicate or replayed Texts dropped
+	route          []byte        // routing tag for Texts. set once Active
+	ratchet        *ratchet      // derives a key per Text. set once Active
+	sendControlKey []byte        // seals Acks, Closes and Profiles sent. set once Active
+	recvControlKey []byte        // opens Acks, Closes and Profiles received. set once Active
+	noise          *noiseSession // Noise handshake in progress, if any
+	addr           string        // where Messages are sent, if not Other's address. see Roam()
+	roamed         time.Time     // when addr last changed
+	sendSeq        uint64        // sequence number of last Text sent
+	recvWindow     replayWindow
+	opened         map[string]uint64    // Seq of recently opened Texts by ratchet header
+	openedOrder    []string             // keys of opened, oldest first
+	inflight       map[uint64]*delivery // sent but unacknowledged Texts by Seq
+	queued         []*Text              // Texts waiting for room in inflight
+	unsent         []outgoing           // Messages waiting for flush()
+	transport      Transport            // used to send Messages. set by the engine
+	handle         Handle               // set by the engine
+	mu             sync.Mutex
 }
 
 // SessionIdleTimeout is the length of time a Session can go without
@@ -28,6 +51,14 @@ type Session struct {
 // a Session may be dropped and clients would need to initiate a new session.
 const SessionIdleTimeout = 30 * time.Minute // TODO: make a sensible number
 
+// RoamInterval is the minimum time between changes to the address a
+// session sends to, so that a peer's address cannot be made to flap.
+const RoamInterval = 10 * time.Second
+
+// PendingTimeout is the length of time a Pending Session waits for a
+// Response before it expires.
+const PendingTimeout = 2 * time.Minute
+
 // SessionStatus is a session status.
 type SessionStatus string
 
@@ -36,6 +67,8 @@ const (
 	Pending SessionStatus = "pending"
 	// Active indicates the session has negotiated a shared key and may send/receive Texts.
 	Active SessionStatus = "active"
+	// Closed indicates the session has ended and its keys have been wiped.
+	Closed SessionStatus = "closed"
 )
 
 // InitiateSession creates a session based on intention to send Request to other.
@@ -52,9 +85,10 @@ func InitiateSession(me, other *Profile) (*Session, *Request, error) {
 		SessionPrivKey: sessPrivKey,
 		Me:             me,
 		Other:          other,
-		Expires:        time.Now().Add(SessionIdleTimeout),
+		Expires:        time.Now().Add(PendingTimeout),
 		Msgs:           make([]*Text, 0),
-		// will not know SharedKey until received Response
+		inflight:       make(map[uint64]*delivery),
+		// will not know the session keys until received Response
 	}
 
 	return s, req, err
@@ -62,8 +96,8 @@ func InitiateSession(me, other *Profile) (*Session, *Request, error) {
 
 // BeginSession creates a session based on already having accepted a Request.
 // It does much of the routine tasks involved in "accepting" a Request, including
-// generating, encrypting, and signing a Shared Key, as well as creating a
-// Response struct to be sent back to the other client.
+// deriving a Shared Key bound to both clients' identities and this session,
+// as well as creating a Response struct to be sent back to the other client.
 func BeginSession(me *Profile, req *Request) (*Session, *Response, error) {
 	// check that request isn't stale (older than session timeout)
 	if time.Since(req.TimeStamp.Time()) > SessionIdleTimeout {
@@ -75,10 +109,11 @@ func BeginSession(me *Profile, req *Request) (*Session, *Response, error) {
 		return nil, nil, err
 	}
 
-	sharedKey, err := EDHSharedKey(sessPrivKey, req.PublicSessionKey)
+	dh, err := EDHSharedKey(sessPrivKey, req.PublicSessionKey)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer wipe(dh)
 
 	resp := &Response{
 		SessionID:        binary.LittleEndian.Uint64(req.PublicSessionKey),
@@ -87,16 +122,40 @@ func BeginSession(me *Profile, req *Request) (*Session, *Response, error) {
 		TimeStamp:        Now(),
 	}
 
+	transcript := sessionTranscript(req.Profile.PublicSigningKey, me.PublicSigningKey,
+		req.PublicSessionKey, resp.PublicSessionKey, resp.SessionID)
+	sharedKey, confirmKey, err := sessionKeys(dh, transcript)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(sharedKey) // only the keys derived from it are kept
+	resp.Confirmation = confirmSession(confirmKey, transcript)
+	wipe(confirmKey)
+
+	r, err := newResponderRatchet(sharedKey, sessPrivKey, respReq.PublicSessionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	recvKey, sendKey, err := controlKeys(sharedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the session private key now belongs to the ratchet, which wipes it
+	// upon the first DH ratchet step
 	s := &Session{
 		Status:         Active,
 		ID:             resp.SessionID,
 		SessionPubKey:  resp.PublicSessionKey,
-		SessionPrivKey: sessPrivKey,
-		SharedKey:      sharedKey,
 		Me:             me,
 		Other:          req.Profile,
 		Expires:        time.Now().Add(SessionIdleTimeout),
 		Msgs:           make([]*Text, 0),
+		inflight:       make(map[uint64]*delivery),
+		route:          RouteTag(sharedKey, resp.SessionID),
+		ratchet:        r,
+		sendControlKey: sendKey,
+		recvControlKey: recvKey,
 	}
 
 	return s, resp, err
@@ -104,40 +163,151 @@ func BeginSession(me *Profile, req *Request) (*Session, *Response, error) {
 
 // ExtendExpiration to now + `SessionIdleTimeout`.
 func (s *Session) ExtendExpiration() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extendExpiration()
+}
+
+func (s *Session) extendExpiration() {
 	s.Expires = time.Now().Add(SessionIdleTimeout)
 }
 
+// Handle gets the session's handle in the engine.
+func (s *Session) Handle() Handle { return s.handle }
+
+// Route gets the session's routing tag, or nil if the session is not Active.
+func (s *Session) Route() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.route
+}
+
+// IsActive determines if the session may send and receive Texts.
+func (s *Session) IsActive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Status == Active
+}
+
+// Peer gets the profile of the other client.
+func (s *Session) Peer() *Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Other
+}
+
+// Address gets the address Messages to the other client are sent to.
+func (s *Session) Address() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendAddress()
+}
+
+func (s *Session) sendAddress() string {
+	if s.addr != "" {
+		return s.addr
+	}
+	return s.Other.FullAddress()
+}
+
+// keepAddress keeps sending to the address the other client was reached at
+// when its Profile, received upon upgrade, gives a different one; such as
+// when it is behind NAT.
+func (s *Session) keepAddress(peer *Profile) {
+	if s.addr == "" && peer.FullAddress() != s.Other.FullAddress() {
+		s.addr = s.Other.FullAddress()
+	}
+}
+
+// Roam changes the address Messages to the other client are sent to, after
+// the Text with seq arrived from addr and was accepted by PushIn(), such as
+// when the other client moved to a different network. Only the Text with the
+// highest Seq received so far moves the session, so that a delayed Text
+// which is replayed from elsewhere cannot. The address changes at most once
+// per RoamInterval. Return value indicates if the address changed.
+func (s *Session) Roam(addr string, seq uint64, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if addr == "" || addr == s.sendAddress() || now.Sub(s.roamed) < RoamInterval {
+		return false
+	}
+	if seq != s.recvWindow.highest {
+		return false
+	}
+
+	s.addr = addr
+	s.roamed = now
+	return true
+}
+
 // IsExpired determines if a session is older than the max session timeout.
-func (s *Session) IsExpired() bool { return time.Now().After(s.Expires) }
+func (s *Session) IsExpired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().After(s.Expires)
+}
+
+// Messages gets copies of the last n messages, or all messages if n <= 0.
+func (s *Session) Messages(n int) []Text {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := len(s.Msgs) - n
+	if n <= 0 || start < 0 {
+		start = 0
+	} // clamp
+
+	msgs := make([]Text, 0, len(s.Msgs)-start)
+	for _, t := range s.Msgs[start:] {
+		msgs = append(msgs, *t)
+	}
+	return msgs
+}
 
 // String representation of the session.
 func (s *Session) String() string {
-	return fmt.Sprintf("[%s][%d] %s\tleft: %s",
-		s.Status, s.ID, s.Other,
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var via string
+	if s.addr != "" {
+		via = " via " + s.addr
+	}
+	return fmt.Sprintf("[%s][%d] %s%s\tleft: %s",
+		s.Status, s.ID, s.Other, via,
 		time.Until(s.Expires))
 	// excessive detail debug version
 	// return fmt.Sprintf("[%s][%d] %s\tleft: %s\n\t\tshared key:  %s\n\t\tpublic key:  %s\n\t\tprivate key: %s",
 	// 	s.Status, s.ID, s.Other,
 	// 	time.Until(s.Expires),
-	// 	base64.RawStdEncoding.EncodeToString(s.SharedKey),
+	// 	base64.RawStdEncoding.EncodeToString(s.route),
 	// 	base64.RawStdEncoding.EncodeToString(s.SessionPubKey),
 	// 	base64.RawStdEncoding.EncodeToString(s.SessionPrivKey))
 }
 
-// Equal compares sessions based on fields: Status, Expires, SharedKey, and Other.
+// Equal compares sessions based on their ID and routing tag.
 func (s *Session) Equal(o *Session) bool {
-	return o != nil &&
-		bytes.Equal(s.SharedKey, o.SharedKey) && // probably most important thing
-		s.Status == o.Status &&
-		s.Expires.Equal(o.Expires) &&
-		s.Other.Equal(o.Other)
+	if o == nil {
+		return false
+	}
+	if s == o {
+		return true
+	}
+
+	// Route() locks each session in turn
+	return s.ID == o.ID && bytes.Equal(s.Route(), o.Route())
 }
 
 // Upgrade attempts to use the Response to change a "pending" session into an
-// "active" session. It does so by creating a shared key from a private key
-// and the received public key. Any error results in a failure to upgrade
+// "active" session. It does so by creating a shared key from a private key,
+// the received public key and the handshake transcript, and checking the
+// Response's key confirmation. Any error results in a failure to upgrade
 // and the session is not modified.
 func (s *Session) Upgrade(resp *Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if resp == nil {
 		return fmt.Errorf("nil Response")
 	}
@@ -145,49 +315,91 @@ func (s *Session) Upgrade(resp *Response) error {
 		return fmt.Errorf("session is not Pending")
 	}
 
-	sharedKey, err := EDHSharedKey(s.SessionPrivKey, resp.PublicSessionKey)
+	dh, err := EDHSharedKey(s.SessionPrivKey, resp.PublicSessionKey)
+	if err != nil {
+		return err
+	}
+	defer wipe(dh)
+
+	transcript := sessionTranscript(s.Me.PublicSigningKey, resp.Profile.PublicSigningKey,
+		s.SessionPubKey, resp.PublicSessionKey, s.ID)
+	sharedKey, confirmKey, err := sessionKeys(dh, transcript)
+	if err != nil {
+		return err
+	}
+	defer wipe(sharedKey) // only the keys derived from it are kept
+	defer wipe(confirmKey)
+	if err = checkConfirmation(resp.Confirmation, confirmKey, transcript); err != nil {
+		return err
+	}
+
+	r, err := newInitiatorRatchet(sharedKey, resp.PublicSessionKey)
+	if err != nil {
+		return err
+	}
+	sendKey, recvKey, err := controlKeys(sharedKey)
 	if err != nil {
 		return err
 	}
 
 	// shared key is now decrypted and the signature is valid
 	// upgrade session
+	s.keepAddress(resp.Profile)
 	s.Status = Active
-	s.SharedKey = sharedKey
 	s.Other = resp.Profile
+	s.route = RouteTag(sharedKey, s.ID)
+	s.ratchet = r
+	s.sendControlKey, s.recvControlKey = sendKey, recvKey
+
+	// no longer needed now that the ratchet has its own key pair
+	wipe(s.SessionPrivKey)
+	s.SessionPrivKey = nil
 
-	s.ExtendExpiration()
+	s.extendExpiration()
 	return nil
 }
 
 // SendText does the routine work of sending a message string from one client
-// to another. This includes packaging a Text into a Message and actually
-// sending the Message on the network.
+// to another. The Text is queued for reliable delivery; its State() reports
+// whether it was eventually acknowledged by the other client.
 func (s *Session) SendText(message string) error {
+	_, err := s.sendText(message)
+	return err
+}
+
+// sendText queues a Text like SendText, returning it so that its delivery
+// can be followed with textState().
+func (s *Session) sendText(message string) (*Text, error) {
+	defer s.flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.Status != Active {
-		return fmt.Errorf("session not Active")
+		return nil, fmt.Errorf("session not Active")
 	}
-	if s.IsExpired() {
-		return fmt.Errorf("session expired")
+	if time.Now().After(s.Expires) {
+		return nil, fmt.Errorf("session expired")
 	}
 
+	s.sendSeq++
 	text := &Text{
 		Message:   message,
+		Seq:       s.sendSeq,
 		TimeStamp: Now(),
+		state:     Queued,
 	}
 
-	m, err := PackageText(text, s.SharedKey)
-	if err != nil {
-		return err
-	}
-
-	err = Send(s.Other.FullAddress(), m)
-	if err != nil {
-		return err
-	}
+	s.pushOut(text)
+	s.queued = append(s.queued, text)
+	s.fillWindow()
+	return text, nil
+}
 
-	s.PushOut(text)
-	return nil
+// textState gets the delivery state of a Text sent by the session.
+func (s *Session) textState(t *Text) DeliveryState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return t.state
 }
 
 // SendRequest does the routine work of sending chat request from one client
@@ -199,7 +411,7 @@ func (s *Session) SendRequest(req *Request, privSigningKey ed25519.PrivateKey) e
 		return err
 	}
 
-	return Send(s.Other.FullAddress(), m)
+	return Send(s.transport, s.Peer().FullAddress(), m)
 }
 
 // SendResponse does the routine work of sending a chat acceptance from one client
@@ -211,19 +423,203 @@ func (s *Session) SendResponse(resp *Response, privSigningKey ed25519.PrivateKey
 		return err
 	}
 
-	return Send(s.Other.FullAddress(), m)
+	return Send(s.transport, s.Address(), m)
+}
+
+// Close ends the session, wiping its keys from memory. Texts still waiting
+// for delivery are marked Failed.
+func (s *Session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wipe(s.SessionPrivKey)
+	wipe(s.sendControlKey)
+	wipe(s.recvControlKey)
+	s.SessionPrivKey = nil
+	s.sendControlKey, s.recvControlKey = nil, nil
+	if s.ratchet != nil {
+		s.ratchet.wipe()
+		s.ratchet = nil
+	}
+	if s.noise != nil {
+		s.noise.wipe()
+		s.noise = nil
+	}
+
+	for _, d := range s.inflight {
+		d.text.state = Failed
+	}
+	for _, t := range s.queued {
+		t.state = Failed
+	}
+	s.inflight = make(map[uint64]*delivery)
+	s.queued = nil
+	s.unsent = nil
+
+	s.Status = Closed
+}
+
+// SendClose notifies the other client that the session is ending. It must
+// be sent before Close().
+func (s *Session) SendClose() error {
+	s.mu.Lock()
+	if s.Status != Active {
+		s.mu.Unlock()
+		return fmt.Errorf("session not Active")
+	}
+	c := &SessionClose{SessionID: s.ID, TimeStamp: Now()}
+	m, err := PackageClose(c, s.sendControlKey, s.route)
+	addr := s.sendAddress()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return Send(s.transport, addr, m)
+}
+
+// OpenClose decrypts a Message sent to this session into a SessionClose.
+func (s *Session) OpenClose(m *Message) (*SessionClose, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := m.GetClose(s.recvControlKey)
+	if err != nil {
+		return nil, err
+	}
+	if c.SessionID != s.ID {
+		return nil, fmt.Errorf("close is for a different session")
+	}
+	return c, nil
+}
+
+// SendProfile replaces the profile of this client in the session, and sends
+// it to the other client if the session is Active. The profile must be
+// signed.
+func (s *Session) SendProfile(p *Profile) error {
+	s.mu.Lock()
+	s.Me = p
+	if s.Status != Active {
+		s.mu.Unlock()
+		return nil
+	}
+	m, err := PackageProfile(p, s.sendControlKey, s.route)
+	addr := s.sendAddress()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return Send(s.transport, addr, m)
+}
+
+// OpenProfile decrypts a Message sent to this session into a Profile. It
+// must be signed by the other client and newer than the one the session has.
+func (s *Session) OpenProfile(m *Message) (*Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := m.GetProfile(s.recvControlKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p.PublicSigningKey, s.Other.PublicSigningKey) {
+		return nil, fmt.Errorf("profile is not of the other client")
+	}
+	if p.Seq <= s.Other.Seq {
+		return nil, fmt.Errorf("profile version %d is not newer than %d", p.Seq, s.Other.Seq)
+	}
+	return p, nil
+}
+
+// SetPeer replaces the profile of the other client, such as when it has
+// moved to a new address.
+func (s *Session) SetPeer(p *Profile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Other = p
+}
+
+// replayError is returned by OpenText for a Text whose message key was
+// already used, such as a retransmission whose Ack was lost. Seq is that of
+// the Text when it was recently received, or 0.
+type replayError struct {
+	Seq uint64
+}
+
+func (e *replayError) Error() string { return "replayed text" }
+
+// OpenText decrypts a Message sent to this session into a Text, advancing
+// the session's ratchet. A Text whose message key was already used is
+// counted in Replays, and a *replayError is returned.
+func (s *Session) OpenText(m *Message) (t *Text, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ratchet == nil {
+		return nil, fmt.Errorf("session not Active")
+	}
+
+	err = s.ratchet.Decrypt(m.Header, func(messageKey []byte) (err error) {
+		t, err = m.GetText(messageKey)
+		return
+	})
+	if err == errUsedKey {
+		s.Replays++
+		return nil, &replayError{Seq: s.opened[string(m.Header)]}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// remember the Seq of recent Texts, to acknowledge them again if the
+	// other client retransmits them
+	if s.opened == nil {
+		s.opened = make(map[string]uint64)
+	}
+	s.opened[string(m.Header)] = t.Seq
+	s.openedOrder = append(s.openedOrder, string(m.Header))
+	if len(s.openedOrder) > replayWindowSize {
+		delete(s.opened, s.openedOrder[0])
+		s.openedOrder = s.openedOrder[1:]
+	}
+	return t, nil
+}
+
+// OpenAck decrypts a Message sent to this session into an Ack.
+func (s *Session) OpenAck(m *Message) (*Ack, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return m.GetAck(s.recvControlKey)
 }
 
 // PushIn appends an incomming Text from "other" client to the session's message list.
-func (s *Session) PushIn(t *Text) {
+// Texts whose sequence number was already received (or is too old to tell)
+// are counted in Replays and dropped, in which case false is returned.
+func (s *Session) PushIn(t *Text) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.recvWindow.Accept(t.Seq) {
+		s.Replays++
+		return false
+	}
+
 	t.author = s.Other
 	s.Msgs = append(s.Msgs, t)
-	s.ExtendExpiration()
+	s.extendExpiration()
+	return true
 }
 
 // PushOut appends an outbound Text from "me" client to the session's message list.
 func (s *Session) PushOut(t *Text) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushOut(t)
+}
+
+func (s *Session) pushOut(t *Text) {
 	t.author = s.Me
 	s.Msgs = append(s.Msgs, t)
-	s.ExtendExpiration() // TODO: perhaps don't want to extend when sending Text, only receiving?
+	s.extendExpiration() // TODO: perhaps don't want to extend when sending Text, only receiving?
 }
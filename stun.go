@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// This file implements the parts of STUN (RFC 5389) needed to discover the
+// address and port a NAT maps a UDP socket to: Binding requests, and Binding
+// success responses carrying an XOR-MAPPED-ADDRESS (or the older
+// MAPPED-ADDRESS).
+//
+// STUN packets share the socket with chat fragments. They are told apart by
+// their first byte, which is never fragmentMagic, and the magic cookie.
+//
+// Each STUN message has a 20 byte header followed by attributes:
+//
+//	type     2 bytes   message type. top two bits are zero
+//	length   2 bytes   length of the attributes
+//	cookie   4 bytes   always stunMagicCookie
+//	id       12 bytes  transaction id, copied into the response
+const (
+	stunMagicCookie   uint32 = 0x2112A442
+	stunHeaderSize           = 20
+	stunBindingReq    uint16 = 0x0001
+	stunBindingResp   uint16 = 0x0101
+	stunMappedAddress uint16 = 0x0001
+	stunXORMapped     uint16 = 0x0020
+	stunFamilyIPv4    byte   = 0x01
+	stunFamilyIPv6    byte   = 0x02
+)
+
+// stunTxID is a STUN transaction id.
+type stunTxID [12]byte
+
+// isSTUN determines if a datagram is a STUN message.
+func isSTUN(b []byte) bool {
+	return len(b) >= stunHeaderSize &&
+		b[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(b[4:8]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(b[2:4])) == len(b)-stunHeaderSize
+}
+
+// stunHeader makes a STUN message header for attributes of length n.
+func stunHeader(msgType uint16, id stunTxID, n int) []byte {
+	b := make([]byte, stunHeaderSize, stunHeaderSize+n)
+	binary.BigEndian.PutUint16(b[0:2], msgType)
+	binary.BigEndian.PutUint16(b[2:4], uint16(n))
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	copy(b[8:20], id[:])
+	return b
+}
+
+// newBindingRequest makes a Binding request with a random transaction id.
+func newBindingRequest() (stunTxID, []byte, error) {
+	var id stunTxID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, nil, err
+	}
+	return id, stunHeader(stunBindingReq, id, 0), nil
+}
+
+// bindingResponse answers a Binding request from addr with its address, so
+// that the sender learns how it appears from outside its NAT.
+func bindingResponse(req []byte, addr string) ([]byte, error) {
+	if !isSTUN(req) || binary.BigEndian.Uint16(req[0:2]) != stunBindingReq {
+		return nil, fmt.Errorf("not a binding request")
+	}
+	var id stunTxID
+	copy(id[:], req[8:20])
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("address %s is not an IP address", addr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	family, ip := stunFamilyIPv6, ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		family, ip = stunFamilyIPv4, ip4
+	}
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(p)^uint16(stunMagicCookie>>16))
+	xorAddress(value[4:], ip, id)
+
+	b := stunHeader(stunBindingResp, id, 4+len(value))
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[stunHeaderSize:], stunXORMapped)
+	binary.BigEndian.PutUint16(b[stunHeaderSize+2:], uint16(len(value)))
+	return append(b, value...), nil
+}
+
+// parseBindingResponse gets the transaction id and mapped address of a
+// Binding success response.
+func parseBindingResponse(b []byte) (id stunTxID, addr string, err error) {
+	if !isSTUN(b) || binary.BigEndian.Uint16(b[0:2]) != stunBindingResp {
+		err = fmt.Errorf("not a binding response")
+		return
+	}
+	copy(id[:], b[8:20])
+
+	var mapped string
+	attrs := b[stunHeaderSize:]
+	for len(attrs) >= 4 {
+		t := binary.BigEndian.Uint16(attrs[0:2])
+		n := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+n > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+n]
+
+		switch t {
+		case stunXORMapped:
+			if a, err := stunAddress(value, id, true); err == nil {
+				return id, a, nil
+			}
+		case stunMappedAddress:
+			if a, err := stunAddress(value, id, false); err == nil {
+				mapped = a
+			}
+		}
+
+		n = (n + 3) &^ 3 // attributes are padded to 4 bytes
+		if 4+n > len(attrs) {
+			break
+		}
+		attrs = attrs[4+n:]
+	}
+
+	if mapped == "" {
+		err = fmt.Errorf("binding response has no mapped address")
+	}
+	return id, mapped, err
+}
+
+// stunAddress decodes a (XOR-)MAPPED-ADDRESS attribute value.
+func stunAddress(value []byte, id stunTxID, xor bool) (string, error) {
+	if len(value) < 4 {
+		return "", fmt.Errorf("short address")
+	}
+
+	var size int
+	switch value[1] {
+	case stunFamilyIPv4:
+		size = net.IPv4len
+	case stunFamilyIPv6:
+		size = net.IPv6len
+	default:
+		return "", fmt.Errorf("unknown address family %d", value[1])
+	}
+	if len(value) < 4+size {
+		return "", fmt.Errorf("short address")
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, size)
+	if xor {
+		port ^= uint16(stunMagicCookie >> 16)
+		xorAddress(ip, value[4:4+size], id)
+	} else {
+		copy(ip, value[4:4+size])
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+// xorAddress XORs an IP address with the magic cookie, followed by the
+// transaction id for IPv6 addresses.
+func xorAddress(dst, ip []byte, id stunTxID) {
+	key := make([]byte, 4, 16)
+	binary.BigEndian.PutUint32(key, stunMagicCookie)
+	key = append(key, id[:]...)
+	for i := range ip {
+		dst[i] = ip[i] ^ key[i]
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Address discovery timing parameters.
+const (
+	STUNTimeout    = 3 * time.Second        // time to wait for each STUN server
+	STUNRetransmit = 500 * time.Millisecond // time between Binding requests
+)
+
+// Endpoints are the addresses this client may be reached at.
+type Endpoints struct {
+	Local  []string // on this host's network interfaces
+	Mapped string   // as seen from outside any NAT. empty if unknown
+}
+
+// Endpoints discovers the addresses this client may be reached at: on local
+// interfaces, and the mapped address as seen by one of the STUNServers. An
+// error reports why the mapped address is unknown.
+func (eng *ChatEngine) Endpoints() (Endpoints, error) {
+	var e Endpoints
+
+	ips, err := LocalAddresses()
+	if err != nil {
+		return e, err
+	}
+	listening, err := eng.listenPort()
+	if err != nil {
+		return e, err
+	}
+	port := strconv.Itoa(listening)
+	for _, ip := range ips {
+		e.Local = append(e.Local, net.JoinHostPort(ip, port))
+	}
+
+	e.Mapped, err = eng.MappedAddress()
+	return e, err
+}
+
+// MappedAddress discovers the address and port this client's UDP socket is
+// mapped to by any NAT, by asking each of the STUNServers in turn until one
+// answers. The engine must be started.
+func (eng *ChatEngine) MappedAddress() (string, error) {
+	if _, ok := eng.transport.(*TCPTransport); ok {
+		return "", fmt.Errorf("address discovery needs the udp transport")
+	}
+	if len(eng.STUNServers) == 0 {
+		return "", fmt.Errorf("no STUN servers")
+	}
+
+	var err error
+	for _, server := range eng.STUNServers {
+		var addr string
+		addr, err = eng.bind(server)
+		if err == nil {
+			return addr, nil
+		}
+		log.Printf("STUN server %s: %s\n", server, err)
+	}
+	return "", err
+}
+
+// bind sends Binding requests to a STUN server until it responds or
+// STUNTimeout passes.
+func (eng *ChatEngine) bind(server string) (string, error) {
+	id, req, err := newBindingRequest()
+	if err != nil {
+		return "", err
+	}
+
+	resp := make(chan string, 1)
+	eng.mu.Lock()
+	eng.bindings[id] = resp
+	eng.mu.Unlock()
+	defer func() {
+		eng.mu.Lock()
+		delete(eng.bindings, id)
+		eng.mu.Unlock()
+	}()
+
+	timeout := time.NewTimer(STUNTimeout)
+	defer timeout.Stop()
+	retransmit := time.NewTicker(STUNRetransmit)
+	defer retransmit.Stop()
+
+	for {
+		if err := eng.transport.Send(server, req); err != nil {
+			return "", err
+		}
+
+		select {
+		case addr := <-resp:
+			return addr, nil
+		case <-timeout.C:
+			return "", fmt.Errorf("no response")
+		case <-retransmit.C:
+		}
+	}
+}
+
+// processSTUN handles a STUN packet received by the Listener, which should
+// be a response to one of this client's Binding requests.
+func (eng *ChatEngine) processSTUN(data []byte, addr string) {
+	id, mapped, err := parseBindingResponse(data)
+	if err != nil {
+		log.Printf("STUN from %s: %s\n", addr, err)
+		return
+	}
+
+	eng.mu.RLock()
+	resp, ok := eng.bindings[id]
+	eng.mu.RUnlock()
+	if !ok {
+		log.Printf("unexpected STUN response from %s\n", addr)
+		return
+	}
+
+	select {
+	case resp <- mapped:
+	default: // already answered
+	}
+}
+
+// LocalAddresses gets the IP addresses of this host's network interfaces,
+// IPv4 first, except for loopback and link-local addresses.
+func LocalAddresses() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 []string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	return append(v4, v6...), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBindingResponse(t *testing.T) {
+	// RFC 5769 2.2, attributes other than XOR-MAPPED-ADDRESS omitted
+	id := stunTxID{0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae}
+	b := stunHeader(stunBindingResp, id, 12)
+	b = append(b, 0x00, 0x20, 0x00, 0x08, 0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43)
+	if got, addr, err := parseBindingResponse(b); err != nil || got != id || addr != "192.0.2.1:32853" {
+		t.Fatalf("parsed %s: %v", addr, err)
+	}
+
+	for _, addr := range []string{"1.2.3.4:5", "[2001:db8::1]:65535"} {
+		id, req, err := newBindingRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := bindingResponse(req, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, mapped, err := parseBindingResponse(resp); err != nil || got != id || mapped != addr {
+			t.Errorf("response for %s gave %s: %v", addr, mapped, err)
+		}
+	}
+}
+
+func TestMappedAddress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// STUN maps IP endpoints, so the network uses those. alice's port is
+	// translated, as by a NAT.
+	n := NewMemoryNetwork()
+	rs, err := NewRendezvousServer(n.Transport("192.0.2.1:3478"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rs.Run(ctx)
+
+	a, err := NewChatEngine(n.Transport("198.51.100.7:40000"), nil,
+		&Profile{Name: "alice", Address: "10.0.0.2", Port: "1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.STUNServers = []string{"192.0.2.1:3478"}
+	a.Start(ctx)
+
+	addr, err := a.MappedAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "198.51.100.7:40000" {
+		t.Fatalf("mapped address = %s, want 198.51.100.7:40000", addr)
+	}
+}
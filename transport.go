@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packet is a unit of data received by a Transport.
+type Packet struct {
+	Addr string // full address of the sender
+	Data []byte
+}
+
+// Transport moves datagrams between chat clients. Implementations need not
+// be reliable, but must deliver each Packet whole (or not at all).
+type Transport interface {
+	Send(addr string, data []byte) error // send data to full address addr
+	Receive() <-chan Packet              // may be closed after Close()
+	Addr() string                        // full address listened on
+	Close() error
+}
+
+// NewTransport makes a Transport listening on port. Network is one of
+// "udp", "tcp".
+func NewTransport(network, port string) (Transport, error) {
+	switch network {
+	case "udp", "":
+		return NewUDPTransport(port)
+	case "tcp":
+		return NewTCPTransport(port)
+	}
+	return nil, fmt.Errorf("unknown transport %q", network)
+}
+
+//
+// UDP
+//
+
+// UDPTransport sends and receives datagrams using a single UDP socket, so
+// that replies to a Packet's Addr reach the same socket.
+type UDPTransport struct {
+	conn      *net.UDPConn
+	packets   chan Packet
+	done      chan struct{} // closed by Close()
+	closeOnce sync.Once
+}
+
+// NewUDPTransport makes a UDPTransport listening on port.
+func NewUDPTransport(port string) (*UDPTransport, error) {
+	const maxBufferSize = 4096
+
+	listenAddress, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &UDPTransport{
+		conn:    conn,
+		packets: make(chan Packet, 16),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(t.packets)
+		var delay time.Duration
+		for {
+			b := make([]byte, maxBufferSize)
+			n, addr, err := conn.ReadFromUDP(b) // blocking read
+			if err != nil {
+				select {
+				case <-t.done:
+					return
+				default:
+				}
+				if delay = retryDelay(err, delay); delay == 0 {
+					log.Printf("udp transport: %s\n", err)
+					return
+				}
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+
+			select {
+			case t.packets <- Packet{Addr: addr.String(), Data: b[:n]}:
+			case <-t.done:
+				return
+			}
+		}
+	}()
+
+	return t, nil
+}
+
+// Send data to addr.
+func (t *UDPTransport) Send(addr string, data []byte) error {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.conn.WriteToUDP(data, to)
+	return err
+}
+
+// Receive gets the channel of incoming Packets.
+func (t *UDPTransport) Receive() <-chan Packet { return t.packets }
+
+// Addr gets the address of the socket.
+func (t *UDPTransport) Addr() string { return t.conn.LocalAddr().String() }
+
+// Close the underlying socket.
+func (t *UDPTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return t.conn.Close()
+}
+
+// retryDelay gets how long to wait before retrying after err, doubling
+// the previous delay up to a second. It is 0 if err is not temporary.
+func retryDelay(err error, prev time.Duration) time.Duration {
+	if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+		return 0
+	}
+	switch {
+	case prev == 0:
+		return 5 * time.Millisecond
+	case prev < time.Second/2:
+		return 2 * prev
+	}
+	return time.Second
+}
+
+//
+// In-memory
+//
+
+// MemoryNetwork connects MemoryTransports within a single process. It is
+// intended for testing the engine without real sockets.
+type MemoryNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*MemoryTransport
+}
+
+// NewMemoryNetwork makes an empty MemoryNetwork.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*MemoryTransport)}
+}
+
+// Transport makes a MemoryTransport reachable on the network at addr.
+func (n *MemoryNetwork) Transport(addr string) *MemoryTransport {
+	t := &MemoryTransport{
+		addr:    addr,
+		network: n,
+		packets: make(chan Packet, 64),
+	}
+
+	n.mu.Lock()
+	n.nodes[addr] = t
+	n.mu.Unlock()
+	return t
+}
+
+// MemoryTransport is a Transport on a MemoryNetwork. Like UDP, packets sent
+// to unknown addresses or to a full receive queue are silently dropped.
+type MemoryTransport struct {
+	addr    string
+	network *MemoryNetwork
+	packets chan Packet
+	closed  bool
+}
+
+// Send data to addr.
+func (t *MemoryTransport) Send(addr string, data []byte) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if t.closed {
+		return fmt.Errorf("transport closed")
+	}
+
+	to, ok := t.network.nodes[addr]
+	if !ok {
+		return nil
+	}
+
+	b := append([]byte(nil), data...)
+	select {
+	case to.packets <- Packet{Addr: t.addr, Data: b}:
+	default:
+		log.Printf("memory transport %s dropped packet\n", addr)
+	}
+	return nil
+}
+
+// Receive gets the channel of incoming Packets.
+func (t *MemoryTransport) Receive() <-chan Packet { return t.packets }
+
+// Addr gets the address of the transport on its network.
+func (t *MemoryTransport) Addr() string { return t.addr }
+
+// Close removes the transport from its network.
+func (t *MemoryTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		delete(t.network.nodes, t.addr)
+		close(t.packets)
+	}
+	return nil
+}
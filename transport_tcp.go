@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPTransport sends Packets over TCP connections, each framed with a 4
+// byte big endian length prefix. Connections are reused in both directions,
+// so replies to a Packet's Addr use the connection it arrived on.
+type TCPTransport struct {
+	listener net.Listener
+	packets  chan Packet
+	done     chan struct{} // closed by Close()
+	mu       sync.Mutex
+	conns    map[string]net.Conn // keyed by remote address
+	closed   bool
+}
+
+// maxTCPFrame is the largest accepted frame.
+const maxTCPFrame = MaxMessageSize + fragmentHeaderSize
+
+// NewTCPTransport makes a TCPTransport listening on port.
+func NewTCPTransport(port string) (*TCPTransport, error) {
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TCPTransport{
+		listener: l,
+		packets:  make(chan Packet, 16),
+		done:     make(chan struct{}),
+		conns:    make(map[string]net.Conn),
+	}
+
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-t.done:
+					return
+				default:
+				}
+				if delay = retryDelay(err, delay); delay == 0 {
+					log.Printf("tcp transport: %s\n", err)
+					return
+				}
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			t.add(conn)
+		}
+	}()
+
+	return t, nil
+}
+
+// add begins reading frames from conn, or closes it if the transport is
+// closed.
+func (t *TCPTransport) add(conn net.Conn) error {
+	addr := conn.RemoteAddr().String()
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("transport closed")
+	}
+	t.conns[addr] = conn
+	t.mu.Unlock()
+
+	go func() {
+		defer t.remove(addr, conn)
+
+		r := bufio.NewReader(conn)
+		for {
+			data, err := ReadFrame(r, maxTCPFrame)
+			if err != nil {
+				if err != io.EOF {
+					log.Println(err)
+				}
+				return
+			}
+
+			select {
+			case t.packets <- Packet{Addr: addr, Data: data}:
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// remove closes and forgets conn.
+func (t *TCPTransport) remove(addr string, conn net.Conn) {
+	t.mu.Lock()
+	if t.conns[addr] == conn {
+		delete(t.conns, addr)
+	}
+	t.mu.Unlock()
+	conn.Close()
+}
+
+// Send data to addr, connecting if there isn't already a connection.
+func (t *TCPTransport) Send(addr string, data []byte) error {
+	t.mu.Lock()
+	conn, ok := t.conns[addr]
+	closed := t.closed
+	t.mu.Unlock()
+
+	if closed {
+		return fmt.Errorf("transport closed")
+	}
+
+	if !ok {
+		var err error
+		conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		if err := t.add(conn); err != nil {
+			return err
+		}
+	}
+
+	err := WriteFrame(conn, data)
+	if err != nil {
+		t.remove(addr, conn)
+	}
+	return err
+}
+
+// Receive gets the channel of incoming Packets.
+func (t *TCPTransport) Receive() <-chan Packet { return t.packets }
+
+// Addr gets the address of the listener.
+func (t *TCPTransport) Addr() string { return t.listener.Addr().String() }
+
+// Close the listener and all connections.
+func (t *TCPTransport) Close() error {
+	err := t.listener.Close()
+
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		for _, conn := range t.conns {
+			conn.Close()
+		}
+		close(t.done)
+	}
+	t.mu.Unlock()
+	return err
+}
+
+// WriteFrame writes data to w prefixed by its length.
+func WriteFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// ReadFrame reads a length prefixed frame from r. Frames longer than max
+// are rejected.
+func ReadFrame(r io.Reader, max int) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > uint32(max) {
+		return nil, fmt.Errorf("frame too large (%d bytes)", n)
+	}
+
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPTransportClose(t *testing.T) {
+	tr, err := NewTCPTransport("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Close()
+
+	// a connection made while closing is closed rather than kept
+	local, remote := net.Pipe()
+	defer remote.Close()
+	if err := tr.add(local); err == nil {
+		t.Fatal("added a connection after Close")
+	}
+	if _, err := local.Write([]byte{0}); err == nil {
+		t.Fatal("connection left open")
+	}
+	if len(tr.conns) != 0 {
+		t.Fatalf("%d connections kept", len(tr.conns))
+	}
+}
+
+func TestUDPTransportClose(t *testing.T) {
+	tr, err := NewUDPTransport("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Close()
+
+	// the reader stops, closing Receive
+	select {
+	case _, ok := <-tr.Receive():
+		if ok {
+			t.Fatal("received a packet")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader still running")
+	}
+}
+
+// temporaryError is a net.Error which may be retried.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestRetryDelay(t *testing.T) {
+	var delay time.Duration
+	for _, want := range []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000} {
+		if delay = retryDelay(temporaryError{}, delay); delay != want*time.Millisecond {
+			t.Fatalf("delay %s, want %dms", delay, want)
+		}
+	}
+	if delay := retryDelay(net.UnknownNetworkError("x"), 0); delay != 0 {
+		t.Fatalf("retried a permanent error after %s", delay)
+	}
+}
@@ -3,17 +3,23 @@ package main
 import (
 	"bytes"
 	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 /*
 Request is sent with key = []byte{}
 Response is sent with key = []byte{}, but SharedKey/KeySignature is encrypted and signed by RSA public/private keys
-Text is encrypted and signed by AES256 shared key
+Text is encrypted and authenticated by XChaCha20-Poly1305 with the shared key
 */
 
 // ZeroKey is a 'garbage' AES256 key used when pseudo-encrypting Messages
@@ -33,20 +39,30 @@ func Now() TimeStamp { return TimeStamp(time.Now().Unix()) }
 func (ts TimeStamp) Time() time.Time { return time.Unix(int64(ts), 0) }
 
 // Profile contains user identification and connection data.
+//
+// A Profile is signed by its owner, so that others can tell an update (such
+// as a new address) from an impersonation. Seq increases with each change,
+// so that an old Profile cannot replace a newer one.
 type Profile struct {
 	Name             string            // name. may contain spaces.
 	Address          string            // example ipv4 "61.2.73.242" or ipv6 "[::1]" or dns "mytld.com"
 	Port             string            // port without : (colon)
 	PublicSigningKey ed25519.PublicKey // 32 byte
+	Seq              uint64            `json:",omitempty"` // version of the profile. see Sign()
+	Signature        []byte            `json:",omitempty"` // self-signature over all other fields
 }
 
 // Request is sent to another party when wishing to begin a chat session.
 // The initiating client must provide a RSA public key so that the receiving
 // client can asymetrically encrypt a proposed shared key in the subsequent Response.
 type Request struct {
-	Profile          *Profile // connection info
-	PublicSessionKey []byte   // 32 byte
-	TimeStamp                 // unix time in seconds
+	Profile          *Profile      // connection info
+	PublicSessionKey []byte        // 32 byte
+	TimeStamp                      // unix time in seconds
+	handle           Handle        // not encoded for transmission. set by the engine
+	quarantined      bool          // not encoded for transmission. see KeyChangePolicy
+	noise            *noiseSession // not encoded for transmission. set if received by Noise handshake
+	addr             string        // not encoded for transmission. 'true' address the request came from
 }
 
 // Response is sent to another party when a Request is "accepted".
@@ -56,16 +72,118 @@ type Response struct {
 	Profile          *Profile // connection info
 	PublicSessionKey []byte   // 32 byte
 	SessionID        uint64
+	Confirmation     []byte // proves the session keys were derived. see confirmSession()
 	TimeStamp
 }
 
 // Text is used to transmit human messages.
 type Text struct {
 	Message string // ideal max len 1024 bytes
+	Seq     uint64 // per-session, per-direction sequence number starting at 1
+	TimeStamp
+	author *Profile      // not encoded for transmission
+	state  DeliveryState // not encoded for transmission
+}
+
+// SessionClose is sent to tell the other client a session has ended.
+type SessionClose struct {
+	SessionID uint64
 	TimeStamp
-	author *Profile // not encoded for transmission
 }
 
+// Ack is sent to acknowledge receipt of a Text.
+type Ack struct {
+	Seq uint64 // sequence number of the acknowledged Text
+}
+
+// Handshake carries one step of a session handshake other than the original
+// Request/Response exchange. Protocol identifies the handshake, so that
+// clients can tell which they are speaking.
+type Handshake struct {
+	Protocol  HandshakeProtocol
+	SessionID uint64 // chosen by the initiator
+	Step      byte   // see NoiseAccept
+	Data      []byte
+	Cookie    []byte // echoed from a NoiseCookie, in a repeated NoiseInit
+}
+
+// Rendezvous is exchanged with a rendezvous server, which introduces
+// clients behind NAT to each other. See RendezvousServer.
+type Rendezvous struct {
+	Op       RendezvousOp
+	Key      ed25519.PublicKey // key of the registering or introduced client
+	Target   string            // Fingerprint() of the client to be introduced to
+	Endpoint string            // address of the registering or introduced client, as seen by the server
+	Nonce    []byte            // challenge from the server, signed in a Register
+	TimeStamp
+}
+
+// RendezvousOp is the operation of a Rendezvous message.
+type RendezvousOp byte
+
+// Values of RendezvousOp. Messages sent to the server are signed by the
+// client's key.
+const (
+	RendezvousRegister     RendezvousOp = iota + 1 // client to server: register Key at the sender's address
+	RendezvousRegistered                           // server to client: Endpoint is the client's address
+	RendezvousIntroduce                            // client to server: introduce me to Target
+	RendezvousIntroduction                         // server to client: Key is at Endpoint, and introduced to you
+	RendezvousNotFound                             // server to client: Target is not registered
+	RendezvousChallenge                            // server to client: Register again with Nonce
+)
+
+// Relay is exchanged with a relay server, which holds sealed Letters for
+// clients until they fetch them. see RelayServer
+type Relay struct {
+	Op        RelayOp
+	Key       ed25519.PublicKey // recipient of deposited Envelopes, or the fetching client
+	Envelopes []Envelope        // deposited or delivered Envelopes
+	IDs       []uint64          // Envelopes acknowledged by the client
+	Nonce     []byte            // challenge signed by a fetching client
+	Signature []byte            // by Key over the challenge. see relayChallenge()
+	Error     string
+}
+
+// Envelope is a Letter sealed to its recipient's key. see sealLetter()
+type Envelope struct {
+	ID   uint64 // assigned by the server
+	Data []byte
+}
+
+// RelayOp is the operation of a Relay message.
+type RelayOp byte
+
+// Values of RelayOp.
+const (
+	RelayChallenge RelayOp = iota + 1 // server to client: Nonce to sign in order to fetch
+	RelayDeposit                      // client to server: hold Envelopes for Key
+	RelayFetch                        // client to server: Key signed the challenge. send its Envelopes
+	RelayDelivery                     // server to client: Envelopes held for the client
+	RelayAck                          // client to server: delete the Envelopes with IDs
+	RelayOK                           // server to client: deposit or ack done
+	RelayError                        // server to client: Error
+)
+
+// Letter is a Text sent through a relay server to a client which may be
+// offline. Letters are signed by the sender and sealed to the recipient's
+// key, so the server can neither read nor forge them, nor tell who sent them.
+type Letter struct {
+	From    *Profile
+	To      ed25519.PublicKey
+	Message string
+	TimeStamp
+}
+
+// HandshakeProtocol identifies a session handshake.
+type HandshakeProtocol byte
+
+// Values of HandshakeProtocol. LegacyHandshake is the Request/Response
+// exchange, which does not use Handshake messages.
+const (
+	LegacyHandshake HandshakeProtocol = iota
+	NoiseXXHandshake
+)
+
 //
 // Profile stuff
 //
@@ -92,7 +210,8 @@ func WriteProfile(p *Profile, filename string) error {
 }
 
 // ReadContacts in JSON format from filename.
-func ReadContacts(filename string) (contacts []*Profile, err error) {
+// Files containing plain Profiles are read as unverified Contacts.
+func ReadContacts(filename string) (contacts []*Contact, err error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return
@@ -103,7 +222,7 @@ func ReadContacts(filename string) (contacts []*Profile, err error) {
 }
 
 // WriteContacts in JSON format to filename.
-func WriteContacts(contacts []*Profile, filename string) error {
+func WriteContacts(contacts []*Contact, filename string) error {
 	data, err := json.MarshalIndent(contacts, "", "  ")
 	if err != nil {
 		return err
@@ -112,29 +231,138 @@ func WriteContacts(contacts []*Profile, filename string) error {
 	return ioutil.WriteFile(filename, data, 0644)
 }
 
-// ReadPrivateKey reads a JSON encoded ED25519 private key from filename.
-func ReadPrivateKey(filename string) (privateKey ed25519.PrivateKey, err error) {
+// PassphraseFunc gets a passphrase from the user. If confirm is true, a new
+// passphrase is being chosen and the user should be asked to type it twice.
+type PassphraseFunc func(confirm bool) ([]byte, error)
+
+// encryptedKey is the on-disk format of a passphrase protected private key.
+// The key is sealed by AEADSeal() with a key derived from the passphrase
+// using scrypt.
+type encryptedKey struct {
+	Version int
+	KDF     string // always "scrypt"
+	N, R, P int    // scrypt parameters
+	Salt    []byte
+	Key     []byte // sealed ED25519 private key
+}
+
+// Parameters for encrypting private keys.
+const (
+	keyFileVersion = 1
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+
+	// bounds on the parameters read from a key file, so that a corrupt one
+	// cannot make scrypt exhaust memory
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+// keyFileAD is the associated data used when sealing a private key.
+var keyFileAD = []byte("chat private key")
+
+// ReadPrivateKey reads an ED25519 private key from filename, using
+// passphrase to get the passphrase needed to decrypt it.
+//
+// Legacy files containing a plaintext JSON key are rewritten encrypted, in
+// which case passphrase is asked for a new passphrase.
+func ReadPrivateKey(filename string, passphrase PassphraseFunc) (privateKey ed25519.PrivateKey, err error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(data, &privateKey)
-	return
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) { // legacy plaintext
+		err = json.Unmarshal(data, &privateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		pass, err := passphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey, WritePrivateKey(privateKey, filename, pass)
+	}
+
+	var ek encryptedKey
+	err = json.Unmarshal(data, &ek)
+	if err != nil {
+		return nil, err
+	}
+	if ek.Version != keyFileVersion || ek.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key file version %d (%s)", ek.Version, ek.KDF)
+	}
+	if ek.N < 2 || ek.N > maxScryptN || ek.N&(ek.N-1) != 0 ||
+		ek.R < 1 || ek.R > maxScryptR || ek.P < 1 || ek.P > maxScryptP {
+		return nil, fmt.Errorf("invalid key file parameters N=%d r=%d p=%d", ek.N, ek.R, ek.P)
+	}
+
+	pass, err := passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key(pass, ek.Salt, ek.N, ek.R, ek.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+
+	plaintext, err := AEADOpen(ek.Key, key, keyFileAD)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupt key file")
+	}
+	if len(plaintext) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key")
+	}
+
+	return ed25519.PrivateKey(plaintext), nil
 }
 
-// WritePrivateKey writes an ED25519 private key to filename in JSON.
-func WritePrivateKey(privSigningKey ed25519.PrivateKey, filename string) error {
-	data, err := json.Marshal(privSigningKey)
+// WritePrivateKey writes an ED25519 private key to filename, encrypted with
+// a key derived from passphrase. The file is only readable by its owner.
+func WritePrivateKey(privSigningKey ed25519.PrivateKey, filename string, passphrase []byte) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
 	if err != nil {
 		return err
 	}
+	defer wipe(key)
 
-	return ioutil.WriteFile(filename, data, 0644)
+	sealed, err := AEADSeal(privSigningKey, key, keyFileAD)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(encryptedKey{
+		Version: keyFileVersion,
+		KDF:     "scrypt",
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    salt,
+		Key:     sealed,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(filename, 0600) // in case file already existed
 }
 
 // ParseProfile parses a string in the form <Name>@<Address>:<Port>
-// to a Profile.
+// to a Profile. The Profile has no key; invites include one. see ParseInvite
 func ParseProfile(raw string) (*Profile, error) {
 	p := &Profile{}
 
@@ -159,6 +387,61 @@ func ParseProfile(raw string) (*Profile, error) {
 	return p, nil
 }
 
+// splitEndpoint splits a host:port endpoint, such as an address seen by a
+// server, into a Profile's Address and Port.
+func splitEndpoint(endpoint string) (address, port string, err error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // ipv6
+	}
+	return host, port, nil
+}
+
+// signedData gets the encoding of the profile's fields covered by its
+// Signature.
+func (p *Profile) signedData() []byte {
+	buf := []byte("chat profile v1")
+	for _, f := range [][]byte{[]byte(p.Name), []byte(p.Address), []byte(p.Port), p.PublicSigningKey} {
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(len(f)))
+		buf = append(append(buf, n[:]...), f...)
+	}
+	var seq [8]byte
+	binary.LittleEndian.PutUint64(seq[:], p.Seq)
+	return append(buf, seq[:]...)
+}
+
+// Sign sets the profile's Signature. The private key must belong to the
+// profile's PublicSigningKey.
+func (p *Profile) Sign(privateKey ed25519.PrivateKey) error {
+	if !bytes.Equal(privateKey.Public().(ed25519.PublicKey), p.PublicSigningKey) {
+		return fmt.Errorf("profile does not match private key")
+	}
+	p.Signature = SignEd25519(privateKey, p.signedData())
+	return nil
+}
+
+// Verify checks that the profile was signed by the owner of its key.
+func (p *Profile) Verify() error {
+	if len(p.Signature) == 0 {
+		return fmt.Errorf("profile %s is not signed", p)
+	}
+	if len(p.PublicSigningKey) != ed25519.PublicKeySize ||
+		!ValidSignatureEd25519(p.Signature, p.signedData(), p.PublicSigningKey) {
+		return fmt.Errorf("profile %s has an invalid signature", p)
+	}
+	return nil
+}
+
+// SameFields determines if the profiles have the same Name, Address, Port,
+// PublicSigningKey and Seq.
+func (p *Profile) SameFields(o *Profile) bool {
+	return o != nil && bytes.Equal(p.signedData(), o.signedData())
+}
+
 // FullAddress gets the profile's Address + Port.
 func (p *Profile) FullAddress() string { return p.Address + ":" + p.Port }
 
@@ -197,6 +480,13 @@ func PrepareRequest(p *Profile) (r *Request, sessPrivKey []byte, err error) {
 	return r, sessPrivKey, nil
 }
 
+// Handle gets the request's handle in the engine.
+func (r *Request) Handle() Handle { return r.handle }
+
+// Quarantined determines if the request is held because its key differs
+// from the one pinned for the contact. See ChatEngine.TrustRequest().
+func (r *Request) Quarantined() bool { return r.quarantined }
+
 // Equal compares one request to another.
 func (r *Request) Equal(o *Request) bool {
 	return o != nil &&
@@ -211,3 +501,7 @@ func (r *Request) Equal(o *Request) bool {
 
 // From gets the profile of the Text writer.
 func (t *Text) From() *Profile { return t.author }
+
+// State gets the delivery state of an outbound Text. It is empty for
+// inbound Texts.
+func (t *Text) State() DeliveryState { return t.state }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements port mapping with a UPnP Internet Gateway Device. The
+// device is found by an SSDP search, its description read for the control
+// URL of its WANIPConnection (or WANPPPConnection) service, and mappings are
+// made by SOAP actions on that service.
+
+// UPnP parameters.
+const (
+	SSDPAddress   = "239.255.255.250:1900"
+	SSDPTimeout   = 2 * time.Second
+	upnpTimeout   = 5 * time.Second
+	upnpSearch    = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpOnlyLease = 725 // error code of IGDs which only support permanent mappings
+)
+
+// UPnPMapper maps ports on a UPnP Internet Gateway Device.
+type UPnPMapper struct {
+	controlURL  string
+	serviceType string
+	client      *http.Client
+}
+
+// NewUPnPMapper makes a UPnPMapper for the device described at location.
+func NewUPnPMapper(location string) (*UPnPMapper, error) {
+	client := &http.Client{Timeout: upnpTimeout}
+
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device description: %s", resp.Status)
+	}
+
+	var desc upnpDescription
+	if err = xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if desc.URLBase != "" {
+		if base, err = url.Parse(desc.URLBase); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range desc.Device.allServices() {
+		if !strings.Contains(s.ServiceType, ":WANIPConnection:") &&
+			!strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			continue
+		}
+		control, err := base.Parse(s.ControlURL)
+		if err != nil {
+			return nil, err
+		}
+		return &UPnPMapper{
+			controlURL:  control.String(),
+			serviceType: s.ServiceType,
+			client:      client,
+		}, nil
+	}
+	return nil, fmt.Errorf("no WAN connection service at %s", location)
+}
+
+// DiscoverUPnP searches for an Internet Gateway Device with SSDP.
+func DiscoverUPnP() (*UPnPMapper, error) {
+	addr, err := net.ResolveUDPAddr("udp4", SSDPAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDPAddress + "\r\n" +
+		"ST: " + upnpSearch + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err = conn.WriteTo([]byte(search), addr); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(SSDPTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no UPnP gateway found")
+		}
+		location := ssdpLocation(buf[:n])
+		if location == "" {
+			continue
+		}
+		if m, err := NewUPnPMapper(location); err == nil {
+			return m, nil
+		}
+	}
+}
+
+// ssdpLocation gets the LOCATION header of an SSDP response.
+func ssdpLocation(b []byte) string {
+	for _, line := range strings.Split(string(b), "\r\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), "location") {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+func (m *UPnPMapper) String() string { return "UPnP gateway " + m.controlURL }
+
+// Map asks the gateway to map the same external port to internal port for
+// lifetime. Gateways which only support permanent mappings are given one,
+// which is still deleted by Unmap.
+func (m *UPnPMapper) Map(protocol string, internal int, lifetime time.Duration) (*PortMapping, error) {
+	client, err := m.localAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	port := strconv.Itoa(internal)
+	args := [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", port},
+		{"NewProtocol", strings.ToUpper(protocol)},
+		{"NewInternalPort", port},
+		{"NewInternalClient", client},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "chat"},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	}
+	_, err = m.action("AddPortMapping", args)
+	if e, ok := err.(*upnpError); ok && e.Code == upnpOnlyLease {
+		args[len(args)-1][1] = "0"
+		lifetime = 0
+		_, err = m.action("AddPortMapping", args)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.action("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(resp["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("gateway has no external address")
+	}
+
+	return &PortMapping{
+		Protocol:     protocol,
+		InternalPort: internal,
+		ExternalPort: internal,
+		ExternalIP:   ip,
+		Lifetime:     lifetime,
+	}, nil
+}
+
+// Unmap deletes a mapping made by Map.
+func (m *UPnPMapper) Unmap(pm *PortMapping) error {
+	_, err := m.action("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(pm.ExternalPort)},
+		{"NewProtocol", strings.ToUpper(pm.Protocol)},
+	})
+	return err
+}
+
+// localAddress gets the local IP address used to reach the gateway, which
+// mapped packets are forwarded to.
+func (m *UPnPMapper) localAddress() (string, error) {
+	u, err := url.Parse(m.controlURL)
+	if err != nil {
+		return "", err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	conn, err := net.Dial("udp", host) // sends nothing
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// upnpError is a UPnP error returned by a SOAP action.
+type upnpError struct {
+	Code        int    `xml:"errorCode"`
+	Description string `xml:"errorDescription"`
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// action performs a SOAP action on the gateway's WAN connection service,
+// returning the output arguments.
+func (m *UPnPMapper) action(name string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, name, m.serviceType)
+	for _, a := range args {
+		fmt.Fprintf(&body, "<%s>", a[0])
+		xml.EscapeText(&body, []byte(a[1]))
+		fmt.Fprintf(&body, "</%s>", a[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, name)
+
+	req, err := http.NewRequest("POST", m.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.serviceType, name))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var env struct {
+		Body struct {
+			Fault struct {
+				Detail struct {
+					Error *upnpError `xml:"UPnPError"`
+				} `xml:"detail"`
+			} `xml:"Fault"`
+			Response struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err = xml.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, resp.Status)
+	}
+	if e := env.Body.Fault.Detail.Error; e != nil {
+		return nil, e
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", name, resp.Status)
+	}
+
+	out := make(map[string]string)
+	for _, a := range env.Body.Response.Args {
+		out[a.XMLName.Local] = a.Value
+	}
+	return out, nil
+}
+
+// upnpDescription is the part of a UPnP device description needed to find
+// the WAN connection service.
+type upnpDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// allServices gets the services of the device and its embedded devices.
+func (d upnpDevice) allServices() []upnpService {
+	services := d.Services
+	for _, sub := range d.Devices {
+		services = append(services, sub.allServices()...)
+	}
+	return services
+}